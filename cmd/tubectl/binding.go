@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"syscall"
 	"text/tabwriter"
+	"time"
 
 	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/log"
 	"inet.af/netaddr"
 )
 
@@ -19,11 +27,31 @@ func bindings(e *env, args ...string) error {
 		Examples:
 		  $ tubectl bindings
 		  $ tubectl bindings any 127.0.0.0/8
-		  $ tubectl bindings udp ::1 443`
+		  $ tubectl bindings udp ::1 443
+		  $ tubectl bindings -within any 10.0.0.0/8
+		  $ tubectl bindings -o json > bindings.json
+
+		By default bindings match if their prefix overlaps the given one.
+		Use -contains to only list bindings whose prefix contains the given
+		one, or -within to only list bindings strictly inside it.
+
+		JSON output uses the format understood by load-bindings. That format
+		doesn't distinguish between protocols.`
+	format := set.String("o", "text", "Output `format`, either text or json.")
+	contains := set.Bool("contains", false, "Only list bindings whose prefix contains the given prefix.")
+	within := set.Bool("within", false, "Only list bindings whose prefix is strictly inside the given prefix.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("%w: unknown output format %q", errBadArg, *format)
+	}
+
+	if *contains && *within {
+		return fmt.Errorf("%w: -contains and -within are mutually exclusive", errBadArg)
+	}
+
 	var proto internal.Protocol
 	if f := set.Arg(0); set.NArg() >= 1 && f != "any" {
 		if err := proto.UnmarshalText([]byte(f)); err != nil {
@@ -40,6 +68,24 @@ func bindings(e *env, args ...string) error {
 		}
 	}
 
+	// Protocol and port are filtered separately, so the query only differs
+	// from a binding in its prefix.
+	query := func(bind *internal.Binding) *internal.Binding {
+		return &internal.Binding{Protocol: bind.Protocol, Prefix: prefix, Port: bind.Port}
+	}
+
+	match := func(bind *internal.Binding) bool { return prefix.Overlaps(bind.Prefix) }
+	switch {
+	case (*contains || *within) && prefix.IsZero():
+		return fmt.Errorf("%w: -contains and -within require a prefix", errBadArg)
+	case *contains:
+		match = func(bind *internal.Binding) bool { return bind.Contains(query(bind)) }
+	case *within:
+		match = func(bind *internal.Binding) bool {
+			return bind.Prefix.Bits() > prefix.Bits() && query(bind).Contains(bind)
+		}
+	}
+
 	var port uint16
 	if set.NArg() >= 3 {
 		port64, err := strconv.ParseUint(set.Arg(2), 10, 16)
@@ -71,7 +117,7 @@ func bindings(e *env, args ...string) error {
 			continue
 		}
 
-		if !prefix.IsZero() && !prefix.Overlaps(bind.Prefix) {
+		if !prefix.IsZero() && !match(bind) {
 			continue
 		}
 
@@ -83,6 +129,10 @@ func bindings(e *env, args ...string) error {
 	}
 	bindings = filtered
 
+	if *format == "json" {
+		return printBindingsJSON(e.stdout, bindings)
+	}
+
 	if len(bindings) == 0 {
 		e.stdout.Log("no bindings matched")
 		return nil
@@ -94,21 +144,66 @@ func bindings(e *env, args ...string) error {
 }
 
 func bind(e *env, args ...string) error {
-	set := e.newFlagSet("bind", "label", "protocol", "ip[/mask]", "port")
+	set := e.newFlagSet("bind", "label", "protocol", "ip[/mask]", "port", "--", "ip[/mask]...")
+	set.Synopsis = []string{
+		"<label> <protocol> <ip[/mask]> <port>",
+		"<label> <protocol> <port> -- <ip[/mask]>...",
+	}
 	set.Description = `
 		Bind a given prefix, port and protocol to a label.
 
+		Multiple prefixes can be bound at once by passing the port instead
+		of a prefix, followed by -- and a list of prefixes.
+
+		A warning is printed if the label only has a socket registered for
+		the other address family, since traffic would be dropped. Use
+		-strict to refuse such bindings instead.
+
+		v4-mapped v6 prefixes like ::ffff:127.0.0.1 are rejected unless
+		-unmap is given, which converts them to ipv4.
+
+		Use -show-overlaps to list existing bindings for the same protocol
+		and port whose prefix overlaps, and which of them takes precedence.
+		Port 0 overlaps all ports.
+
 		Examples:
+		  # Bind a single prefix
 		  $ tubectl bind foo udp 127.0.0.1 0
-		  $ tubectl bind bar tcp 127.0.0.0/24 80`
+		  $ tubectl bind bar tcp 127.0.0.0/24 80
 
+		  # Bind several prefixes on port 80
+		  $ tubectl bind baz tcp 80 -- 127.0.0.0/8 10.0.0.0/8 ::1`
+	strict := set.Bool("strict", false, "Refuse bindings for a label which only has a socket for the other address family.")
+	unmap := set.Bool("unmap", false, "Convert v4-mapped v6 prefixes to ipv4.")
+	showOverlaps := set.Bool("show-overlaps", false, "List existing bindings which overlap.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
-	bind, err := bindingFromArgs(set.Args())
-	if err != nil {
-		return err
+	var binds internal.Bindings
+	if args := set.Args(); args[3] == "--" {
+		label, proto, port := args[0], args[1], args[2]
+		for _, prefix := range args[4:] {
+			bind, err := bindingFromArgs([]string{label, proto, prefix, port})
+			if err != nil {
+				return fmt.Errorf("prefix %s: %w", prefix, err)
+			}
+			binds = append(binds, bind)
+		}
+
+		if len(binds) == 0 {
+			return fmt.Errorf("%w: expected at least one prefix after --", errBadArg)
+		}
+	} else {
+		bind, err := bindingFromArgs(args)
+		if err != nil {
+			return err
+		}
+		binds = append(binds, bind)
+	}
+
+	if *unmap {
+		unmapBindings(e, binds)
 	}
 
 	dp, err := e.openDispatcher(false)
@@ -117,17 +212,77 @@ func bind(e *env, args ...string) error {
 	}
 	defer dp.Close()
 
-	if err := dp.AddBinding(bind); err != nil {
-		return err
+	var failed int
+	for _, bind := range binds {
+		if *showOverlaps {
+			if err := printOverlaps(e, dp, bind); err != nil {
+				return err
+			}
+		}
+
+		err := dp.CheckBinding(bind)
+		if errors.Is(err, internal.ErrWrongFamily) && !*strict {
+			e.stderr.Logf("Warning: %s: %s\n", bind, err)
+			err = nil
+		}
+
+		var replaced *internal.Binding
+		if err == nil {
+			replaced, err = dp.AddBinding(bind)
+		}
+
+		if err != nil {
+			if len(binds) == 1 {
+				return err
+			}
+
+			e.stderr.Logf("can't bind %s: %s\n", bind, err)
+			failed++
+			continue
+		}
+
+		if replaced != nil && replaced.Label != bind.Label {
+			e.stdout.Logf("rebound %v:[%s]:%d from %s to %s\n", bind.Protocol, bind.Prefix, bind.Port, replaced.Label, bind.Label)
+			continue
+		}
+
+		e.stdout.Logf("bound %s\n", bind)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d bindings failed", failed, len(binds))
+	}
+
+	return nil
+}
+
+// printOverlaps lists existing bindings which overlap bind, except for one
+// which bind would replace.
+func printOverlaps(e *env, dp *internal.Dispatcher, bind *internal.Binding) error {
+	overlaps, err := dp.OverlappingBindings(bind)
+	if err != nil {
+		return fmt.Errorf("find overlapping bindings: %s", err)
+	}
+
+	for _, other := range overlaps {
+		if other.Prefix == bind.Prefix && other.Port == bind.Port {
+			continue
+		}
+
+		if (internal.Bindings{other, bind}).Less(0, 1) {
+			e.stdout.Logf("%s overlaps %s, which takes precedence\n", bind, other)
+		} else {
+			e.stdout.Logf("%s overlaps %s, and takes precedence\n", bind, other)
+		}
 	}
 
-	e.stdout.Logf("bound %s", bind)
 	return nil
 }
 
 func unbind(e *env, args ...string) error {
 	set := e.newFlagSet("unbind", "label", "protocol", "ip[/mask]", "port")
 	set.Description = "Remove a previously created binding."
+	unmap := set.Bool("unmap", false, "Convert a v4-mapped v6 prefix to ipv4.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
@@ -137,6 +292,10 @@ func unbind(e *env, args ...string) error {
 		return err
 	}
 
+	if *unmap {
+		unmapBindings(e, internal.Bindings{bind})
+	}
+
 	dp, err := e.openDispatcher(false)
 	if err != nil {
 		return err
@@ -151,6 +310,17 @@ func unbind(e *env, args ...string) error {
 	return nil
 }
 
+// unmapBindings converts v4-mapped v6 prefixes to ipv4 in place.
+func unmapBindings(e *env, binds internal.Bindings) {
+	for _, bind := range binds {
+		prefix := internal.UnmapPrefix(bind.Prefix)
+		if prefix != bind.Prefix {
+			e.stderr.Logf("Warning: using %s instead of v4-mapped %s\n", prefix, bind.Prefix)
+			bind.Prefix = prefix
+		}
+	}
+}
+
 func bindingFromArgs(args []string) (*internal.Binding, error) {
 	if n := len(args); n != 4 {
 		return nil, fmt.Errorf("expected label, protocol, ip/prefix and port but got %d arguments", n)
@@ -177,11 +347,68 @@ func bindingFromArgs(args []string) (*internal.Binding, error) {
 type bindingJSON struct {
 	Label  string           `json:"label"`
 	Prefix netaddr.IPPrefix `json:"prefix"`
-	Port   *uint16          `json:"port"`
+	// Name of an entry in prefix_sets, used instead of Prefix.
+	PrefixSet string  `json:"prefix_set,omitempty"`
+	Port      *uint16 `json:"port"`
+}
+
+// configEntry is a binding from a config, after prefix sets are expanded.
+type configEntry struct {
+	bindingJSON
+	// Position of the entry in the bindings of the config.
+	index int
+	// Name of the prefix set the entry was expanded from, if any.
+	prefixSet string
+}
+
+func (ce *configEntry) String() string {
+	if ce.prefixSet != "" {
+		return fmt.Sprintf("binding %d (label %s, prefix set %s)", ce.index, ce.Label, ce.prefixSet)
+	}
+	return fmt.Sprintf("binding %d (label %s)", ce.index, ce.Label)
 }
 
 type configJSON struct {
-	Bindings []bindingJSON `json:"bindings"`
+	// Named lists of prefixes which bindings can refer to.
+	PrefixSets map[string][]netaddr.IPPrefix `json:"prefix_sets,omitempty"`
+	Bindings   []bindingJSON                 `json:"bindings"`
+}
+
+// printBindingsJSON writes bindings in the format accepted by load-bindings.
+func printBindingsJSON(w io.Writer, bindings internal.Bindings) error {
+	config := configJSON{Bindings: bindingsToJSON(bindings)}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&config)
+}
+
+// bindingsToJSON converts bindings into entries of the load-bindings format.
+//
+// The format implies both TCP and UDP, so bindings which only differ in
+// protocol are collapsed into a single entry.
+func bindingsToJSON(bindings internal.Bindings) []bindingJSON {
+	sort.Sort(bindings)
+
+	type key struct {
+		label  string
+		prefix netaddr.IPPrefix
+		port   uint16
+	}
+
+	seen := make(map[key]bool)
+	result := []bindingJSON{}
+	for _, bind := range bindings {
+		k := key{bind.Label, bind.Prefix, bind.Port}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+
+		port := bind.Port
+		result = append(result, bindingJSON{bind.Label, bind.Prefix, "", &port})
+	}
+	return result
 }
 
 func loadBindings(e *env, args ...string) error {
@@ -190,7 +417,7 @@ func loadBindings(e *env, args ...string) error {
 		port := uint16(80)
 		example := configJSON{
 			Bindings: []bindingJSON{
-				{"foo", netaddr.MustParseIPPrefix("127.0.0.1/32"), &port},
+				{"foo", netaddr.MustParseIPPrefix("127.0.0.1/32"), "", &port},
 			},
 		}
 
@@ -199,6 +426,18 @@ func loadBindings(e *env, args ...string) error {
 		set.Printf(
 			`Load a set of bindings from a JSON formatted file and replace
 			the currently active bindings with the ones from the file.
+			Bindings are read from standard input if file is "-".
+
+			Comments start with // or # and run until the end of the line.
+			A binding may use "prefix_set" instead of "prefix" to refer to a
+			list of prefixes in the top-level "prefix_sets" object, which
+			creates a binding for each prefix in the list.
+			${NAME} in a string is replaced by the value of the environment
+			variable NAME.
+
+			Examples:
+			  $ tubectl load-bindings bindings.json
+			  $ jsonnet config.jsonnet | tubectl load-bindings -
 
 			The format is:
 
@@ -207,6 +446,7 @@ func loadBindings(e *env, args ...string) error {
 		)
 	}
 
+	dryRun := set.Bool("dry-run", false, "Print the changes that would be made without applying them.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
@@ -216,50 +456,407 @@ func loadBindings(e *env, args ...string) error {
 		return errBadArg
 	}
 
-	bindings, err := loadConfig(set.Arg(0))
+	bindings, err := e.loadConfigArg(set.Arg(0))
 	if err != nil {
 		return err
 	}
 
-	dp, err := e.openDispatcher(false)
+	dp, err := e.openDispatcher(*dryRun)
 	if err != nil {
 		return err
 	}
 	defer dp.Close()
 
-	added, removed, err := dp.ReplaceBindings(bindings)
-	if err != nil {
-		return err
+	if *dryRun {
+		added, removed, err := dp.DiffBindings(bindings)
+		if err != nil {
+			return err
+		}
+
+		for _, bind := range added {
+			e.stdout.Log("would add", bind)
+		}
+		for _, bind := range removed {
+			e.stdout.Log("would remove", bind)
+		}
+		return nil
 	}
 
+	return replaceBindings(e, dp, bindings)
+}
+
+func replaceBindings(e *env, dp *internal.Dispatcher, bindings internal.Bindings) error {
+	// Log partial changes even if there is an error.
+	added, removed, err := dp.ReplaceBindingsContext(e.ctx, bindings)
 	for _, bind := range added {
-		e.stdout.Log("added", bind)
+		log.Fields(e.stdout, "added", "binding", bind)
 	}
 	for _, bind := range removed {
-		e.stdout.Log("removed", bind)
+		log.Fields(e.stdout, "removed", "binding", bind)
+	}
+
+	return err
+}
+
+func watchBindings(e *env, args ...string) error {
+	set := e.newFlagSet("watch-bindings", "file")
+	set.Description = `
+		Replace bindings with the contents of a file, and apply the file
+		again whenever it changes or SIGHUP is received. Runs until
+		interrupted.
+
+		The file uses the format accepted by load-bindings. An invalid file
+		is reported but doesn't change the active bindings.
+
+		Examples:
+		  $ tubectl watch-bindings /etc/tubular/bindings.json
+		  $ tubectl watch-bindings -interval 10s /etc/tubular/bindings.json`
+	interval := set.Duration("interval", time.Second, "Check the file for changes every `interval`.")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	if set.NArg() != 1 {
+		set.Usage()
+		return errBadArg
+	}
+
+	path := set.Arg(0)
+	if path == "-" {
+		return fmt.Errorf("%w: can't watch stdin", errBadArg)
+	}
+
+	if *interval <= 0 {
+		return fmt.Errorf("%w: interval must be positive", errBadArg)
+	}
+
+	apply := func() error {
+		bindings, err := e.loadConfigArg(path)
+		if err != nil {
+			return err
+		}
+
+		dp, err := e.openDispatcher(false)
+		if err != nil {
+			return err
+		}
+		defer dp.Close()
+
+		return replaceBindings(e, dp, bindings)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if err := apply(); err != nil {
+		return err
+	}
+
+	stop := e.cancelOnInterrupt()
+	defer stop()
+
+	reload := make(chan os.Signal, 1)
+	e.notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return nil
+
+		case <-reload:
+			e.stdout.Log("Reloading", path)
+
+		case <-ticker.C:
+			current, err := os.Stat(path)
+			if err != nil {
+				e.stderr.Log("Can't check bindings:", err)
+				continue
+			}
+
+			if current.ModTime().Equal(info.ModTime()) && current.Size() == info.Size() {
+				continue
+			}
+
+			info = current
+			e.stdout.Log(path, "changed, reloading")
+		}
+
+		if err := apply(); err != nil {
+			e.stderr.Log("Can't apply bindings:", err)
+		}
+	}
+}
+
+type bindingDiffJSON struct {
+	Added   []diffBindingJSON `json:"added"`
+	Removed []diffBindingJSON `json:"removed"`
+}
+
+type diffBindingJSON struct {
+	Label    string           `json:"label"`
+	Protocol string           `json:"protocol"`
+	Prefix   netaddr.IPPrefix `json:"prefix"`
+	Port     uint16           `json:"port"`
+}
+
+func diff(e *env, args ...string) error {
+	set := e.newFlagSet("diff", "file")
+	set.Description = `
+		Compare the active bindings with the ones from a file in the
+		format accepted by load-bindings, without making any changes.
+		Bindings are read from standard input if file is "-".
+
+		Returns an error if the bindings differ.
+
+		Examples:
+		  $ tubectl diff bindings.json
+		  $ tubectl diff -o json bindings.json`
+	format := set.String("o", "text", "Output `format`, either text or json.")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("%w: unknown output format %q", errBadArg, *format)
+	}
+
+	bindings, err := e.loadConfigArg(set.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var added, removed internal.Bindings
+	{
+		dp, err := e.openDispatcher(true)
+		if err != nil {
+			return err
+		}
+		defer dp.Close()
+
+		added, removed, err = dp.DiffBindings(bindings)
+		if err != nil {
+			return err
+		}
+
+		dp.Close()
+	}
+
+	sort.Sort(added)
+	sort.Sort(removed)
+
+	if *format == "json" {
+		out := bindingDiffJSON{
+			Added:   bindingsToDiffJSON(added),
+			Removed: bindingsToDiffJSON(removed),
+		}
+
+		enc := json.NewEncoder(e.stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(&out); err != nil {
+			return err
+		}
+	} else {
+		for _, bind := range added {
+			e.stdout.Log("+", bind)
+		}
+		for _, bind := range removed {
+			e.stdout.Log("-", bind)
+		}
+	}
+
+	if len(added) > 0 || len(removed) > 0 {
+		return fmt.Errorf("%w: %d to add, %d to remove", errDrift, len(added), len(removed))
 	}
 
 	return nil
 }
 
-func loadConfig(path string) (internal.Bindings, error) {
+func bindingsToDiffJSON(bindings internal.Bindings) []diffBindingJSON {
+	result := []diffBindingJSON{}
+	for _, bind := range bindings {
+		result = append(result, diffBindingJSON{
+			bind.Label,
+			bind.Protocol.String(),
+			bind.Prefix,
+			bind.Port,
+		})
+	}
+	return result
+}
+
+// loadConfigArg reads bindings from path, or from stdin if path is "-".
+func (e *env) loadConfigArg(path string) (internal.Bindings, error) {
+	if path == "-" {
+		return loadConfig(e.stdin, "stdin", e.getenv)
+	}
+	return loadConfigFile(path, e.getenv)
+}
+
+func loadConfigFile(path string, getenv func(string) string) (internal.Bindings, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	return loadConfig(file, file.Name(), getenv)
+}
+
+func loadConfig(r io.Reader, name string, getenv func(string) string) (internal.Bindings, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	data, err = preprocessConfig(data, getenv)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
 	var config configJSON
-	decoder := json.NewDecoder(file)
+	decoder := json.NewDecoder(bytes.NewReader(data))
 	decoder.DisallowUnknownFields()
 	if err := decoder.Decode(&config); err != nil {
-		return nil, fmt.Errorf("%s: %s", file.Name(), err)
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	entries, err := expandPrefixSets(config.Bindings, config.PrefixSets)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	bindings, err := bindingsFromJSON(entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	return bindings, nil
+}
+
+// expandPrefixSets replaces each entry which refers to a prefix set with an
+// entry for every prefix in the set.
+func expandPrefixSets(entries []bindingJSON, sets map[string][]netaddr.IPPrefix) ([]configEntry, error) {
+	var result []configEntry
+	for i, entry := range entries {
+		if entry.PrefixSet == "" {
+			result = append(result, configEntry{entry, i, ""})
+			continue
+		}
+
+		if !entry.Prefix.IsZero() {
+			return nil, fmt.Errorf("binding for label %s has both prefix and prefix_set", entry.Label)
+		}
+
+		prefixes, ok := sets[entry.PrefixSet]
+		if !ok {
+			return nil, fmt.Errorf("binding for label %s refers to unknown prefix set %q", entry.Label, entry.PrefixSet)
+		}
+
+		for _, prefix := range prefixes {
+			expanded := entry
+			expanded.Prefix = prefix
+			expanded.PrefixSet = ""
+			result = append(result, configEntry{expanded, i, entry.PrefixSet})
+		}
+	}
+	return result, nil
+}
+
+// preprocessConfig removes comments starting with // or # from JSON and
+// replaces ${NAME} in strings with the value of the environment variable.
+func preprocessConfig(data []byte, getenv func(string) string) ([]byte, error) {
+	var (
+		out      bytes.Buffer
+		inString bool
+	)
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+
+		if !inString {
+			if c == '#' || (c == '/' && i+1 < len(data) && data[i+1] == '/') {
+				for i < len(data) && data[i] != '\n' {
+					i++
+				}
+				if i < len(data) {
+					out.WriteByte('\n')
+				}
+				continue
+			}
+
+			inString = c == '"'
+			out.WriteByte(c)
+			continue
+		}
+
+		switch {
+		case c == '\\' && i+1 < len(data):
+			out.Write(data[i : i+2])
+			i++
+
+		case c == '"':
+			inString = false
+			out.WriteByte(c)
+
+		case c == '$' && i+1 < len(data) && data[i+1] == '{':
+			end := bytes.IndexByte(data[i:], '}')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated variable at offset %d", i)
+			}
+
+			name := string(data[i+2 : i+end])
+			value := getenv(name)
+			if value == "" {
+				return nil, fmt.Errorf("environment variable %s is empty or not set", name)
+			}
+
+			quoted, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+
+			// Strip the surrounding quotes.
+			out.Write(quoted[1 : len(quoted)-1])
+			i += end
+
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// bindingsFromJSON creates a TCP and a UDP binding for each entry.
+//
+// Returns an error if two entries with different labels have the same
+// prefix and port. The error refers to the entries by their position in the
+// config.
+func bindingsFromJSON(entries []configEntry) (internal.Bindings, error) {
+	type key struct {
+		prefix netaddr.IPPrefix
+		port   uint16
 	}
 
 	var bindings internal.Bindings
-	for _, bind := range config.Bindings {
+	seen := make(map[key]int)
+	for i, bind := range entries {
 		if bind.Port == nil {
-			return nil, fmt.Errorf("binding in json is missing port: %v", bind)
+			return nil, fmt.Errorf("binding in json is missing port: %v", bind.bindingJSON)
+		}
+
+		k := key{bind.Prefix.Masked(), *bind.Port}
+		if j, ok := seen[k]; ok && entries[j].Label != bind.Label {
+			return nil, fmt.Errorf("%s and %s both use prefix %s and port %d",
+				&entries[j], &bind, k.prefix, k.port)
+		} else if !ok {
+			seen[k] = i
 		}
 
 		bindings = append(bindings,
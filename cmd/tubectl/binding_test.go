@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/log"
 	"github.com/cloudflare/tubular/internal/testutil"
 	"github.com/google/go-cmp/cmp"
+	"inet.af/netaddr"
 )
 
 func TestBindings(t *testing.T) {
@@ -75,6 +85,63 @@ func TestBindings(t *testing.T) {
 	}
 }
 
+func TestBindingsContainment(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "narrow", internal.TCP, "10.1.0.0/16", 80)
+	mustAddBinding(t, dp, "broad", internal.TCP, "0.0.0.0/4", 80)
+	mustAddBinding(t, dp, "other", internal.TCP, "192.168.0.0/16", 80)
+	mustAddBinding(t, dp, "exact", internal.TCP, "10.0.0.0/8", 80)
+	dp.Close()
+
+	for _, test := range []struct {
+		flag   string
+		labels []string
+	}{
+		{"", []string{"narrow", "broad", "exact"}},
+		{"-contains", []string{"broad", "exact"}},
+		{"-within", []string{"narrow"}},
+	} {
+		t.Run(test.flag, func(t *testing.T) {
+			var args []string
+			if test.flag != "" {
+				args = append(args, test.flag)
+			}
+			args = append(args, "tcp", "10.0.0.0/8")
+
+			var stdout log.Buffer
+			list := tubectlTestCall{
+				NetNS:  netns,
+				Cmd:    "bindings",
+				Args:   args,
+				Stdout: &stdout,
+			}
+			list.MustRun(t)
+
+			for _, label := range []string{"narrow", "broad", "other", "exact"} {
+				want := false
+				for _, l := range test.labels {
+					want = want || l == label
+				}
+
+				if have := strings.Contains(stdout.String(), label); have != want {
+					t.Errorf("Expected label %s to be listed: %t", label, want)
+				}
+			}
+		})
+	}
+
+	for _, args := range [][]string{
+		{"-contains", "-within", "tcp", "10.0.0.0/8"},
+		{"-within", "tcp"},
+	} {
+		if _, err := testTubectl(t, netns, "bindings", args...); !errors.Is(err, errBadArg) {
+			t.Errorf("Expected errBadArg for %q, got %v", args, err)
+		}
+	}
+}
+
 func TestBindUnbind(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
@@ -103,6 +170,212 @@ func TestBindUnbind(t *testing.T) {
 	}
 }
 
+func TestBindRebound(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	mustTestTubectl(t, netns, "bind", "foo", "tcp", "127.0.0.0/8", "80")
+
+	output := mustTestTubectl(t, netns, "bind", "bar", "tcp", "127.0.0.0/8", "80")
+	if want := "rebound tcp:[127.0.0.0/8]:80 from foo to bar"; !strings.Contains(output.String(), want) {
+		t.Errorf("Output doesn't contain %q:\n%s", want, output)
+	}
+
+	output = mustTestTubectl(t, netns, "bind", "bar", "tcp", "127.0.0.0/8", "80")
+	if strings.Contains(output.String(), "rebound") {
+		t.Error("Binding the same label again is reported as rebound")
+	}
+}
+
+func TestBindNoDestinationIDs(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	metrics, err := dp.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < metrics.DestinationsCapacity; i++ {
+		mustAddBinding(t, dp, fmt.Sprint("label-", i), internal.TCP, "127.0.0.1", uint16(i+1))
+	}
+	dp.Close()
+
+	var output log.Buffer
+	tc := tubectlTestCall{
+		NetNS: netns,
+		Cmd:   "bind",
+		Args:  []string{"foo", "tcp", "127.0.0.1", "0"},
+	}
+	err = tc.run(t, context.Background(), &output)
+	if !errors.Is(err, internal.ErrNoDestinationIDs) {
+		t.Fatal("Expected ErrNoDestinationIDs, got", err)
+	}
+
+	if !strings.Contains(output.String(), "-max-destinations") {
+		t.Errorf("Output doesn't suggest increasing capacity:\n%s", output.String())
+	}
+}
+
+func TestBindShowOverlaps(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	mustTestTubectl(t, netns, "bind", "foo", "tcp", "127.0.0.0/24", "80")
+
+	output := mustTestTubectl(t, netns, "bind", "-show-overlaps", "bar", "tcp", "127.0.0.1", "80")
+	if want := "bar#tcp:[127.0.0.1/32]:80 overlaps foo#tcp:[127.0.0.0/24]:80, and takes precedence"; !strings.Contains(output.String(), want) {
+		t.Errorf("Output doesn't contain %q:\n%s", want, output)
+	}
+
+	output = mustTestTubectl(t, netns, "bind", "-show-overlaps", "baz", "tcp", "127.0.0.0/16", "80")
+	for _, want := range []string{
+		"baz#tcp:[127.0.0.0/16]:80 overlaps bar#tcp:[127.0.0.1/32]:80, which takes precedence",
+		"baz#tcp:[127.0.0.0/16]:80 overlaps foo#tcp:[127.0.0.0/24]:80, which takes precedence",
+	} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("Output doesn't contain %q:\n%s", want, output)
+		}
+	}
+
+	output = mustTestTubectl(t, netns, "bind", "-show-overlaps", "foo", "udp", "127.0.0.1", "80")
+	if strings.Contains(output.String(), "overlaps") {
+		t.Errorf("Bindings for other protocols are reported as overlapping:\n%s", output)
+	}
+
+	output = mustTestTubectl(t, netns, "bind", "-show-overlaps", "foo", "tcp", "127.0.0.1", "443")
+	if strings.Contains(output.String(), "overlaps") {
+		t.Errorf("Bindings for other ports are reported as overlapping:\n%s", output)
+	}
+
+	output = mustTestTubectl(t, netns, "bind", "-show-overlaps", "qux", "tcp", "127.0.0.0/8", "0")
+	if want := "overlaps foo#tcp:[127.0.0.0/24]:80"; !strings.Contains(output.String(), want) {
+		t.Errorf("Output doesn't contain %q:\n%s", want, output)
+	}
+}
+
+func TestBindUnmap(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	if _, err := testTubectl(t, netns, "bind", "foo", "tcp", "::ffff:127.0.0.1/104", "80"); err == nil {
+		t.Fatal("bind accepts a v4-mapped prefix without -unmap")
+	}
+
+	output := mustTestTubectl(t, netns, "bind", "-unmap", "foo", "tcp", "::ffff:127.0.0.1/104", "80")
+	if !strings.Contains(output.String(), "using 127.0.0.0/8 instead of") {
+		t.Error("Output doesn't contain a warning:\n", output)
+	}
+
+	dp := mustOpenDispatcher(t, netns)
+	bindings, err := dp.Bindings()
+	dp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := internal.Bindings{mustNewBinding(t, "foo", internal.TCP, "127.0.0.0/8", 80)}
+	if diff := cmp.Diff(want, bindings, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Bindings don't match (+y -x):\n%s", diff)
+	}
+
+	mustTestTubectl(t, netns, "unbind", "-unmap", "foo", "tcp", "::ffff:127.0.0.1/104", "80")
+}
+
+func TestBindMultiplePrefixes(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	mustTestTubectl(t, netns, "bind", "foo", "tcp", "80", "--", "127.0.0.1/8", "10.0.0.0/8", "::1")
+
+	bindings, err := mustOpenDispatcher(t, netns).Bindings()
+	if err != nil {
+		t.Fatal("Can't get bindings:", err)
+	}
+
+	want := internal.Bindings{
+		mustNewBinding(t, "foo", internal.TCP, "127.0.0.1/8", 80),
+		mustNewBinding(t, "foo", internal.TCP, "10.0.0.0/8", 80),
+		mustNewBinding(t, "foo", internal.TCP, "::1", 80),
+	}
+
+	sort.Sort(bindings)
+	sort.Sort(want)
+
+	if diff := cmp.Diff(want, bindings, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Bindings don't match (+y -x):\n%s", diff)
+	}
+
+	if _, err := testTubectl(t, netns, "bind", "foo", "tcp", "80", "--"); err == nil {
+		t.Error("bind accepts an empty list of prefixes")
+	}
+
+	if _, err := testTubectl(t, netns, "bind", "foo", "tcp", "80", "--", "::1", "not-a-prefix"); err == nil {
+		t.Error("bind accepts an invalid prefix")
+	}
+}
+
+func TestBindMultiplePrefixesPartialFailure(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	tc := tubectlTestCall{
+		NetNS: netns,
+		Cmd:   "bind",
+		Args:  []string{"foo", "udp", "53", "--", "127.0.0.1", "::ffff:192.0.2.128/96", "::1"},
+	}
+
+	var output log.Buffer
+	if err := tc.run(t, context.Background(), &output); err == nil {
+		t.Fatal("bind doesn't return an error if a binding fails")
+	}
+	t.Log(output.String())
+
+	bindings, err := mustOpenDispatcher(t, netns).Bindings()
+	if err != nil {
+		t.Fatal("Can't get bindings:", err)
+	}
+
+	if n := len(bindings); n != 2 {
+		t.Error("Expected two bindings, got", n)
+	}
+
+	if !strings.Contains(output.String(), "can't bind foo#udp:[::ffff:0:0/96]:53") {
+		t.Error("Output doesn't mention the failed prefix")
+	}
+}
+
+func TestBindWrongFamily(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustRegisterSocket(t, dp, "foo", makeListeningSocket(t, netns, "tcp4"))
+	dp.Close()
+
+	tc := tubectlTestCall{
+		NetNS: netns,
+		Cmd:   "bind",
+		Args:  []string{"foo", "tcp", "::1", "80"},
+	}
+
+	var output log.Buffer
+	if err := tc.run(t, context.Background(), &output); err != nil {
+		t.Fatal("bind without -strict returns an error:", err)
+	}
+
+	if !strings.Contains(output.String(), "Warning:") {
+		t.Error("bind doesn't warn about the missing ipv6 socket")
+	}
+
+	_, err := testTubectl(t, netns, "bind", "-strict", "foo", "tcp", "::2", "80")
+	if !errors.Is(err, internal.ErrWrongFamily) {
+		t.Fatal("Expected ErrWrongFamily with -strict, got", err)
+	}
+
+	bindings, err := mustOpenDispatcher(t, netns).Bindings()
+	if err != nil {
+		t.Fatal("Can't get bindings:", err)
+	}
+
+	if n := len(bindings); n != 1 {
+		t.Error("Expected one binding, got", n)
+	}
+}
+
 func TestBindInvariants(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
@@ -169,6 +442,11 @@ func TestBindInvalidInput(t *testing.T) {
 	if err == nil {
 		t.Error("Accepted v4-mapped prefix")
 	}
+
+	_, err = testTubectl(t, netns, "bind", "foo", "udp", "fe80::1%eth0", "443")
+	if err == nil {
+		t.Error("Accepted prefix with zone")
+	}
 }
 
 func TestLoadBindings(t *testing.T) {
@@ -213,6 +491,328 @@ func TestLoadBindings(t *testing.T) {
 	}
 }
 
+func TestLoadBindingsDryRun(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "baz", internal.TCP, "::1", 80)
+	dp.Close()
+
+	output := mustTestTubectl(t, netns, "load-bindings", "-dry-run", "testdata/bindings.json")
+	if n := strings.Count(output.String(), "would add"); n != 8 {
+		t.Error("Expected eight added bindings, got", n)
+	}
+	if n := strings.Count(output.String(), "would remove"); n != 1 {
+		t.Error("Expected one removed binding, got", n)
+	}
+
+	bindings, err := mustOpenDispatcher(t, netns).Bindings()
+	if err != nil {
+		t.Fatal("Can't get bindings:", err)
+	}
+
+	want := internal.Bindings{
+		mustNewBinding(t, "baz", internal.TCP, "::1", 80),
+	}
+
+	if diff := cmp.Diff(want, bindings, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Dry run changed bindings (+y -x):\n%s", diff)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	diff := func(args ...string) (*log.Buffer, error) {
+		tubectl := tubectlTestCall{
+			NetNS:  netns,
+			Cmd:    "diff",
+			Args:   args,
+			Stdout: new(log.Buffer),
+		}
+		_, err := tubectl.Run(t)
+		return tubectl.Stdout, err
+	}
+
+	output, err := diff("testdata/bindings.json")
+	if !errors.Is(err, errDrift) {
+		t.Fatal("Expected errDrift for an empty dispatcher, got", err)
+	}
+	if n := strings.Count(output.String(), "+ "); n != 8 {
+		t.Error("Expected eight added bindings, got", n)
+	}
+
+	mustTestTubectl(t, netns, "load-bindings", "testdata/bindings.json")
+	if _, err := diff("testdata/bindings.json"); err != nil {
+		t.Fatal("Expected no drift after loading bindings, got", err)
+	}
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "baz", internal.TCP, "::1", 80)
+	dp.Close()
+
+	output, err = diff("-o", "json", "testdata/bindings.json")
+	if !errors.Is(err, errDrift) {
+		t.Fatal("Expected errDrift, got", err)
+	}
+
+	var have bindingDiffJSON
+	if err := json.Unmarshal(output.Bytes(), &have); err != nil {
+		t.Fatal("Can't decode JSON:", err)
+	}
+
+	want := bindingDiffJSON{
+		Added: []diffBindingJSON{},
+		Removed: []diffBindingJSON{
+			{"baz", "tcp", netaddr.MustParseIPPrefix("::1/128"), 80},
+		},
+	}
+
+	if d := cmp.Diff(want, have, testutil.IPPrefixComparer()); d != "" {
+		t.Errorf("Diff doesn't match (-want +got):\n%s", d)
+	}
+}
+
+func TestLoadBindingsFromStdin(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	config, err := os.ReadFile("testdata/bindings.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	go func() {
+		defer w.Close()
+		w.Write(config)
+	}()
+
+	load := tubectlTestCall{
+		NetNS: netns,
+		Cmd:   "load-bindings",
+		Args:  []string{"-"},
+		Stdin: r,
+	}
+	load.MustRun(t)
+
+	bindings, err := mustOpenDispatcher(t, netns).Bindings()
+	if err != nil {
+		t.Fatal("Can't get bindings:", err)
+	}
+
+	want, err := loadConfigFile("testdata/bindings.json", os.Getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Sort(bindings)
+	sort.Sort(want)
+
+	if diff := cmp.Diff(want, bindings, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Bindings don't match (+y -x):\n%s", diff)
+	}
+}
+
+func TestLoadBindingsCommentsAndEnv(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	load := tubectlTestCall{
+		NetNS: netns,
+		Cmd:   "load-bindings",
+		Args:  []string{"testdata/commented-bindings.json"},
+		Env:   testEnv{"TUBULAR_LABEL": "foo", "TUBULAR_PREFIX": "127.0.0.0/8"},
+	}
+	load.MustRun(t)
+
+	bindings, err := mustOpenDispatcher(t, netns).Bindings()
+	if err != nil {
+		t.Fatal("Can't get bindings:", err)
+	}
+
+	want := internal.Bindings{
+		mustNewBinding(t, "foo", internal.TCP, "127.0.0.0/8", 80),
+		mustNewBinding(t, "foo", internal.UDP, "127.0.0.0/8", 80),
+		mustNewBinding(t, "foo-//-#", internal.TCP, "::1", 443),
+		mustNewBinding(t, "foo-//-#", internal.UDP, "::1", 443),
+	}
+
+	sort.Sort(bindings)
+	sort.Sort(want)
+
+	if diff := cmp.Diff(want, bindings, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Bindings don't match (+y -x):\n%s", diff)
+	}
+
+	load.Env = testEnv{"TUBULAR_LABEL": "foo"}
+	if _, err := load.Run(t); err == nil {
+		t.Error("load-bindings accepts an unset environment variable")
+	}
+}
+
+func TestLoadBindingsConflict(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	_, err := testTubectl(t, netns, "load-bindings", "testdata/conflicting-bindings.json")
+	if err == nil {
+		t.Fatal("Conflicting bindings must return an error")
+	}
+
+	for _, want := range []string{"binding 0 (label foo)", "binding 2 (label bar)"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error doesn't contain %q: %s", want, err)
+		}
+	}
+}
+
+func TestLoadConfigPrefixSets(t *testing.T) {
+	bindings, err := loadConfigFile("testdata/prefix-set-bindings.json", os.Getenv)
+	if err != nil {
+		t.Fatal("Can't load config:", err)
+	}
+
+	var want internal.Bindings
+	for _, label := range []struct {
+		name string
+		port uint16
+	}{{"foo", 80}, {"bar", 443}} {
+		for _, prefix := range []string{"127.0.0.0/24", "::1"} {
+			want = append(want,
+				mustNewBinding(t, label.name, internal.TCP, prefix, label.port),
+				mustNewBinding(t, label.name, internal.UDP, prefix, label.port),
+			)
+		}
+	}
+	want = append(want,
+		mustNewBinding(t, "baz", internal.TCP, "127.0.1.0/24", 80),
+		mustNewBinding(t, "baz", internal.UDP, "127.0.1.0/24", 80),
+	)
+
+	sort.Sort(bindings)
+	sort.Sort(want)
+
+	if diff := cmp.Diff(want, bindings, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Bindings don't match (+y -x):\n%s", diff)
+	}
+
+	config := `{
+		"prefix_sets": {"a": ["127.0.0.1/32", "::1/128"]},
+		"bindings": [
+			{"label": "foo", "prefix_set": "a", "port": 80},
+			{"label": "bar", "prefix": "::1/128", "port": 80}
+		]
+	}`
+	_, err = loadConfig(strings.NewReader(config), "test", os.Getenv)
+	if err == nil {
+		t.Fatal("No error for conflicting bindings")
+	}
+	for _, want := range []string{"binding 0 (label foo, prefix set a)", "binding 1 (label bar)"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error doesn't contain %q: %s", want, err)
+		}
+	}
+
+	for _, config := range []string{
+		`{"bindings": [{"label": "foo", "prefix_set": "missing", "port": 80}]}`,
+		`{"prefix_sets": {"a": ["::1/128"]}, "bindings": [{"label": "foo", "prefix": "::1/128", "prefix_set": "a", "port": 80}]}`,
+	} {
+		if _, err := loadConfig(strings.NewReader(config), "test", os.Getenv); err == nil {
+			t.Errorf("No error for %s", config)
+		}
+	}
+}
+
+func TestPreprocessConfig(t *testing.T) {
+	getenv := func(name string) string {
+		return map[string]string{"QUOTE": `a"b`}[name]
+	}
+
+	for _, test := range []struct {
+		in, out string
+	}{
+		{"{} // comment", "{} "},
+		{"# comment\n{}", "\n{}"},
+		{`{"a": "//#"}`, `{"a": "//#"}`},
+		{`{"a": "\"//"} # c`, `{"a": "\"//"} `},
+		{`{"a": "${QUOTE}"}`, `{"a": "a\"b"}`},
+		{`{"a": "$QUOTE"}`, `{"a": "$QUOTE"}`},
+	} {
+		out, err := preprocessConfig([]byte(test.in), getenv)
+		if err != nil {
+			t.Errorf("%q: %s", test.in, err)
+			continue
+		}
+
+		if string(out) != test.out {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, out)
+		}
+	}
+
+	for _, in := range []string{
+		`{"a": "${QUOTE"}`,
+		`{"a": "${MISSING}"}`,
+	} {
+		if _, err := preprocessConfig([]byte(in), getenv); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestBindingsJSON(t *testing.T) {
+	netns := mustReadyNetNS(t)
+	mustTestTubectl(t, netns, "load-bindings", "testdata/bindings.json")
+
+	var stdout log.Buffer
+	dump := tubectlTestCall{
+		NetNS:  netns,
+		Cmd:    "bindings",
+		Args:   []string{"-o", "json"},
+		Stdout: &stdout,
+	}
+	dump.MustRun(t)
+
+	var config configJSON
+	if err := json.Unmarshal(stdout.Bytes(), &config); err != nil {
+		t.Fatalf("Can't decode output: %s\n%s", err, stdout.String())
+	}
+
+	if n := len(config.Bindings); n != 4 {
+		t.Errorf("Expected four entries, got %d", n)
+	}
+
+	path := filepath.Join(t.TempDir(), "bindings.json")
+	if err := os.WriteFile(path, stdout.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := mustReadyNetNS(t)
+	mustTestTubectl(t, fresh, "load-bindings", path)
+
+	want, err := mustOpenDispatcher(t, netns).Bindings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := mustOpenDispatcher(t, fresh).Bindings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Sort(want)
+	sort.Sort(have)
+	if diff := cmp.Diff(want, have, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Bindings don't match (+y -x):\n%s", diff)
+	}
+
+	if _, err := testTubectl(t, netns, "bindings", "-o", "yaml"); err == nil {
+		t.Error("Accepted unknown output format")
+	}
+}
+
 func mustNewBinding(tb testing.TB, label string, proto internal.Protocol, prefix string, port uint16) *internal.Binding {
 	tb.Helper()
 
@@ -223,3 +823,106 @@ func mustNewBinding(tb testing.TB, label string, proto internal.Protocol, prefix
 
 	return bind
 }
+
+func TestWatchBindings(t *testing.T) {
+	netns := mustReadyNetNS(t)
+	path := filepath.Join(t.TempDir(), "bindings.json")
+
+	writeConfig := func(config string, mtime time.Time) {
+		t.Helper()
+
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForBindings := func(want internal.Bindings) {
+		t.Helper()
+
+		sort.Sort(want)
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			dp := mustOpenDispatcher(t, netns)
+			have, err := dp.Bindings()
+			dp.Close()
+			if err != nil {
+				t.Fatal("Can't get bindings:", err)
+			}
+
+			sort.Sort(have)
+			diff := cmp.Diff(want, have, testutil.IPPrefixComparer())
+			if diff == "" {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("Bindings don't match (+y -x):\n%s", diff)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	now := time.Now()
+	writeConfig(`{"bindings":[{"label":"foo","prefix":"127.0.0.1/32","port":80}]}`, now)
+
+	tc := tubectlTestCall{
+		NetNS:   netns,
+		Cmd:     "watch-bindings",
+		Args:    []string{"-interval", "10ms", path},
+		Signals: make(chan chan<- os.Signal, 1),
+	}
+	stop := tc.Start(t)
+	defer stop()
+
+	waitForBindings(internal.Bindings{
+		mustNewBinding(t, "foo", internal.TCP, "127.0.0.1", 80),
+		mustNewBinding(t, "foo", internal.UDP, "127.0.0.1", 80),
+	})
+
+	writeConfig(`{"bindings":[{"label":"bar","prefix":"::1/128","port":443}]}`, now.Add(time.Second))
+	waitForBindings(internal.Bindings{
+		mustNewBinding(t, "bar", internal.TCP, "::1", 443),
+		mustNewBinding(t, "bar", internal.UDP, "::1", 443),
+	})
+
+	// An invalid file leaves the bindings alone.
+	writeConfig(`{"bindings":[`, now.Add(2*time.Second))
+	time.Sleep(50 * time.Millisecond)
+	waitForBindings(internal.Bindings{
+		mustNewBinding(t, "bar", internal.TCP, "::1", 443),
+		mustNewBinding(t, "bar", internal.UDP, "::1", 443),
+	})
+
+	var reload chan<- os.Signal
+	select {
+	case reload = <-tc.Signals:
+	case <-time.After(time.Second):
+		t.Fatal("tubectl doesn't handle signals after one second")
+	}
+
+	// Bindings are reapplied on SIGHUP even if the file didn't change.
+	writeConfig(`{"bindings":[{"label":"baz","prefix":"127.0.0.2/32","port":53}]}`, now.Add(2*time.Second))
+	reload <- syscall.SIGHUP
+	waitForBindings(internal.Bindings{
+		mustNewBinding(t, "baz", internal.TCP, "127.0.0.2", 53),
+		mustNewBinding(t, "baz", internal.UDP, "127.0.0.2", 53),
+	})
+}
+
+func TestWatchBindingsInvalidArgs(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	for _, args := range [][]string{
+		{},
+		{"-"},
+		{"-interval", "0", "testdata/bindings.json"},
+		{"testdata/does-not-exist.json"},
+		{"testdata/invalid-bindings.json"},
+	} {
+		if _, err := testTubectl(t, netns, "watch-bindings", args...); err == nil {
+			t.Errorf("Accepted arguments %q", args)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/tubular/internal"
+)
+
+func cookie(e *env, args ...string) error {
+	set := e.newFlagSet("cookie", "label", "domain", "proto")
+	set.Description = `
+		Print the cookie of the socket registered for a destination.
+
+		The cookie matches the sk: field in the output of ss -e.
+
+		Examples:
+		  $ tubectl cookie foo ipv4 tcp
+		  $ tubectl cookie bar ipv6 udp`
+
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	label := set.Arg(0)
+
+	var domain internal.Domain
+	if err := domain.UnmarshalText([]byte(set.Arg(1))); err != nil {
+		return fmt.Errorf("%w: %s", errBadArg, err)
+	}
+
+	var proto internal.Protocol
+	if err := proto.UnmarshalText([]byte(set.Arg(2))); err != nil {
+		return fmt.Errorf("%w: %s", errBadArg, err)
+	}
+
+	dp, err := e.openDispatcher(true)
+	if err != nil {
+		return err
+	}
+	defer dp.Close()
+
+	_, cookies, err := dp.Destinations()
+	if err != nil {
+		return fmt.Errorf("get destinations: %s", err)
+	}
+
+	dest := internal.Destination{Label: label, Domain: domain, Protocol: proto}
+	cookie := cookies[dest]
+	if cookie == 0 {
+		return fmt.Errorf("no socket registered for %s", &dest)
+	}
+
+	e.stdout.Log(cookie)
+	return nil
+}
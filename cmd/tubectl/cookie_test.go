@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal/log"
+)
+
+func TestCookie(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	sock := makeListeningSocket(t, netns, "tcp4")
+	dp := mustOpenDispatcher(t, netns)
+	mustRegisterSocket(t, dp, "foo", sock)
+	dp.Close()
+
+	var stdout log.Buffer
+	tc := tubectlTestCall{
+		NetNS:  netns,
+		Cmd:    "cookie",
+		Args:   []string{"foo", "ipv4", "tcp"},
+		Stdout: &stdout,
+	}
+	tc.MustRun(t)
+
+	want := mustSocketCookie(t, sock).String()
+	if have := strings.TrimSpace(stdout.String()); have != want {
+		t.Errorf("Expected cookie %s, got %q", want, have)
+	}
+
+	for _, args := range [][]string{
+		{"foo", "ipv6", "tcp"},
+		{"foo", "ipv4", "udp"},
+		{"bar", "ipv4", "tcp"},
+	} {
+		if _, err := testTubectl(t, netns, "cookie", args...); err == nil {
+			t.Errorf("cookie %s doesn't return an error", strings.Join(args, " "))
+		}
+	}
+}
+
+func TestCookieInvalidArgs(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	for _, args := range [][]string{
+		{},
+		{"foo", "ipv4"},
+		{"foo", "ipv5", "tcp"},
+		{"foo", "ipv4", "sctp"},
+		{"foo", "ipv4", "tcp", "extra"},
+	} {
+		if _, err := testTubectl(t, netns, "cookie", args...); err == nil {
+			t.Errorf("cookie %s doesn't return an error", strings.Join(args, " "))
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+)
+
+func debug(e *env, args ...string) error {
+	set := e.newFlagSet("debug", "topic")
+	set.Description = `
+		Show information useful when debugging the dispatcher.
+
+		Available topics:
+		  maps  List the pinned maps and their sizes.
+
+		Examples:
+		  $ tubectl debug maps`
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	switch topic := set.Arg(0); topic {
+	case "maps":
+		return debugMaps(e)
+	default:
+		return fmt.Errorf("%w: unknown topic %q", errBadArg, topic)
+	}
+}
+
+func debugMaps(e *env) error {
+	dp, err := e.openDispatcher(true)
+	if err != nil {
+		return err
+	}
+	defer dp.Close()
+
+	maps, err := dp.PinnedMaps()
+	if err != nil {
+		return err
+	}
+
+	e.stdout.Log("Pinned maps in", dp.Path)
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "name\ttype\tkey size\tvalue size\tmax entries\tentries\t")
+	for _, m := range maps {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t\n", m.Name, m.Type, m.KeySize, m.ValueSize, m.MaxEntries, m.Entries)
+	}
+	return w.Flush()
+}
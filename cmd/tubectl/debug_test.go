@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/log"
+	"github.com/cloudflare/tubular/internal/testutil"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDebugMaps(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", internal.TCP, "127.0.0.1", 80)
+	mustRegisterSocket(t, dp, "foo", testutil.Listen(t, netns, "tcp4", "127.0.0.1:0"))
+	dp.Close()
+
+	var stdout log.Buffer
+	tc := tubectlTestCall{
+		NetNS:  netns,
+		Cmd:    "debug",
+		Args:   []string{"maps"},
+		Stdout: &stdout,
+	}
+	tc.MustRun(t)
+
+	maps := make(map[string][]string)
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 6 {
+			maps[fields[0]] = fields[1:]
+		}
+	}
+
+	// Max entries depends on how the dispatcher was compiled.
+	for name, want := range map[string][]string{
+		"bindings": {"LPMTrie", "23", "8", "1"},
+		"sockets":  {"SockMap", "4", "8", "1"},
+	} {
+		have, ok := maps[name]
+		if !ok {
+			t.Errorf("Output doesn't contain %s:\n%s", name, stdout.String())
+			continue
+		}
+
+		have = append(have[:3:3], have[4])
+		if diff := cmp.Diff(want, have); diff != "" {
+			t.Errorf("%s doesn't match (-want +got):\n%s", name, diff)
+		}
+	}
+}
+
+func TestDebugUnknownTopic(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	_, err := testTubectl(t, netns, "debug", "foo")
+	if !errors.Is(err, errBadArg) {
+		t.Fatal("Expected errBadArg, got", err)
+	}
+}
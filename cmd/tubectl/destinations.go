@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/cloudflare/tubular/internal"
+)
+
+type destinationJSON struct {
+	Label     string `json:"label"`
+	Domain    string `json:"domain"`
+	Protocol  string `json:"protocol"`
+	Socket    string `json:"socket"`
+	HasSocket bool   `json:"has_socket"`
+}
+
+type destinationsJSON struct {
+	Destinations []destinationJSON `json:"destinations"`
+}
+
+func destinations(e *env, args ...string) error {
+	set := e.newFlagSet("destinations", "--", "label", "domain")
+	set.Description = `
+		List destinations and their sockets.
+
+		Use "any" as label to match all labels when filtering by domain.
+
+		Examples:
+		  $ tubectl destinations
+		  $ tubectl destinations foo
+		  $ tubectl destinations any ipv6
+		  $ tubectl destinations -o json`
+	format := set.String("o", "text", "Output `format`, either text or json.")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("%w: unknown output format %q", errBadArg, *format)
+	}
+
+	label := set.Arg(0)
+	if label == "any" {
+		label = ""
+	}
+
+	var domain internal.Domain
+	if set.NArg() >= 2 {
+		if err := domain.UnmarshalText([]byte(set.Arg(1))); err != nil {
+			return fmt.Errorf("%w: %s", errBadArg, err)
+		}
+	}
+
+	var (
+		dests   []internal.Destination
+		cookies map[internal.Destination]internal.SocketCookie
+	)
+	{
+		dp, err := e.openDispatcher(true)
+		if err != nil {
+			return err
+		}
+		defer dp.Close()
+
+		dests, cookies, err = dp.Destinations()
+		if err != nil {
+			return fmt.Errorf("get destinations: %s", err)
+		}
+
+		dp.Close()
+	}
+
+	var filtered []internal.Destination
+	for _, dest := range dests {
+		if label != "" && dest.Label != label {
+			continue
+		}
+
+		if domain != 0 && dest.Domain != domain {
+			continue
+		}
+
+		filtered = append(filtered, dest)
+	}
+	dests = filtered
+
+	sortDestinations(dests)
+
+	if *format == "json" {
+		out := destinationsJSON{Destinations: []destinationJSON{}}
+		for _, dest := range dests {
+			cookie := cookies[dest]
+			out.Destinations = append(out.Destinations, destinationJSON{
+				dest.Label,
+				dest.Domain.String(),
+				dest.Protocol.String(),
+				cookie.String(),
+				cookie != 0,
+			})
+		}
+
+		enc := json.NewEncoder(e.stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(&out)
+	}
+
+	if len(dests) == 0 {
+		e.stdout.Log("no destinations matched")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "label\tdomain\tprotocol\tsocket\tpresent\t")
+
+	for _, dest := range dests {
+		cookie := cookies[dest]
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t\n", dest.Label, dest.Domain, dest.Protocol, cookie, cookie != 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
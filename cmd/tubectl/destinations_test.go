@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/log"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDestinations(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustRegisterSocket(t, dp, "foo", makeListeningSocket(t, netns, "tcp4"))
+	mustRegisterSocket(t, dp, "foo", makeListeningSocket(t, netns, "tcp6"))
+	mustAddBinding(t, dp, "bar", internal.UDP, "::1", 53)
+	dp.Close()
+
+	for _, test := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"bar ipv6", "foo ipv4", "foo ipv6"}},
+		{[]string{"foo"}, []string{"foo ipv4", "foo ipv6"}},
+		{[]string{"any", "ipv4"}, []string{"foo ipv4"}},
+		{[]string{"any", "ipv6"}, []string{"bar ipv6", "foo ipv6"}},
+		{[]string{"bar", "ipv4"}, nil},
+	} {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			var stdout log.Buffer
+			tc := tubectlTestCall{
+				NetNS:  netns,
+				Cmd:    "destinations",
+				Args:   append([]string{"-o", "json"}, test.args...),
+				Stdout: &stdout,
+			}
+			tc.MustRun(t)
+
+			var out destinationsJSON
+			if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+				t.Fatalf("Can't decode output: %s\n%s", err, stdout.String())
+			}
+
+			var have []string
+			for _, dest := range out.Destinations {
+				have = append(have, dest.Label+" "+dest.Domain)
+			}
+
+			if diff := cmp.Diff(test.want, have); diff != "" {
+				t.Errorf("Destinations don't match (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := testTubectl(t, netns, "destinations", "any", "ipv5"); err == nil {
+		t.Error("Accepted invalid domain")
+	}
+
+	output := mustTestTubectl(t, netns, "destinations", "bar")
+	if !strings.Contains(output.String(), "sk:-") {
+		t.Error("Output doesn't show missing socket")
+	}
+}
+
+func TestDestinationsJSON(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustRegisterSocket(t, dp, "foo", makeListeningSocket(t, netns, "tcp4"))
+	mustAddBinding(t, dp, "bar", internal.UDP, "::1", 53)
+	dp.Close()
+
+	var stdout log.Buffer
+	tc := tubectlTestCall{
+		NetNS:  netns,
+		Cmd:    "destinations",
+		Args:   []string{"-o", "json"},
+		Stdout: &stdout,
+	}
+	tc.MustRun(t)
+
+	var out struct {
+		Destinations []map[string]interface{} `json:"destinations"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		t.Fatalf("Can't decode output: %s\n%s", err, stdout.String())
+	}
+
+	if n := len(out.Destinations); n != 2 {
+		t.Fatalf("Expected two destinations, got %d", n)
+	}
+
+	bar, foo := out.Destinations[0], out.Destinations[1]
+	want := map[string]interface{}{
+		"label":      "bar",
+		"domain":     "ipv6",
+		"protocol":   "udp",
+		"socket":     "sk:-",
+		"has_socket": false,
+	}
+	if diff := cmp.Diff(want, bar); diff != "" {
+		t.Errorf("Destination without socket doesn't match (-want +got):\n%s", diff)
+	}
+
+	if foo["has_socket"] != true {
+		t.Error("Destination with socket has has_socket false")
+	}
+
+	if socket, _ := foo["socket"].(string); !strings.HasPrefix(socket, "sk:") || socket == "sk:-" {
+		t.Errorf("Invalid socket for destination: %q", socket)
+	}
+}
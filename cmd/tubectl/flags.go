@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,12 +14,15 @@ type flagSet struct {
 	args         []string
 	optionalArgs []string
 	Description  interface{}
+	// Synopsis replaces the arguments shown in the usage, with one line per
+	// form the command accepts. Arguments are still validated against args.
+	Synopsis []string
 }
 
 // newFlagSet creates a flag set for a command with the given name.
 //
 // args contains both required an optional arguments, separated by the special
-// string "--".
+// string "--". The last optional argument may be repeated if it ends in "...".
 func newFlagSet(output io.Writer, name string, args ...string) *flagSet {
 	set := flag.NewFlagSet(name, flag.ContinueOnError)
 	set.SetOutput(output)
@@ -37,6 +41,7 @@ func newFlagSet(output io.Writer, name string, args ...string) *flagSet {
 		args,
 		optionalArgs,
 		nil,
+		nil,
 	}
 
 	fs.Usage = func() {
@@ -63,17 +68,23 @@ func newFlagSet(output io.Writer, name string, args ...string) *flagSet {
 }
 
 func (fs *flagSet) Parse(args []string) error {
-	if err := fs.FlagSet.Parse(args); err != nil {
+	if err := fs.FlagSet.Parse(args); errors.Is(err, flag.ErrHelp) {
 		return err
+	} else if err != nil {
+		return fmt.Errorf("%w: %s", errBadArg, err)
 	}
 
 	var err error
 	minArgs := len(fs.args)
 	maxArgs := minArgs + len(fs.optionalArgs)
+	if n := len(fs.optionalArgs); n > 0 && strings.HasSuffix(fs.optionalArgs[n-1], "...") {
+		maxArgs = -1
+	}
+
 	switch n := fs.NArg(); {
 	case n < minArgs:
 		err = fmt.Errorf("%w: expected at least %d arguments, got %d", errBadArg, minArgs, n)
-	case n > maxArgs:
+	case maxArgs >= 0 && n > maxArgs:
 		err = fmt.Errorf("%w: expected at most %d arguments, got %d", errBadArg, maxArgs, n)
 	default:
 		return nil
@@ -86,6 +97,18 @@ func (fs *flagSet) Parse(args []string) error {
 func (fs *flagSet) PrintCommand() {
 	o := fs.Output()
 
+	if len(fs.Synopsis) > 0 {
+		for i, args := range fs.Synopsis {
+			prefix := "Usage:"
+			if i > 0 {
+				prefix = "      "
+			}
+			fmt.Fprintf(o, "%s tubectl %s %s\n", prefix, fs.Name(), args)
+		}
+		fmt.Fprintln(o)
+		return
+	}
+
 	var args string
 	if len(fs.args) > 0 {
 		args = fmt.Sprintf(" <%s>", strings.Join(fs.args, "> <"))
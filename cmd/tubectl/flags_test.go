@@ -22,6 +22,36 @@ func TestOptionalArgs(t *testing.T) {
 	}
 }
 
+func TestRepeatedOptionalArgs(t *testing.T) {
+	var buf bytes.Buffer
+
+	fs := newFlagSet(&buf, "test", "a", "--", "b...")
+	if err := fs.Parse([]string{"foo"}); err != nil {
+		t.Fatal("Can't invoke without optional argument")
+	}
+
+	if err := fs.Parse([]string{"foo", "bar", "baz"}); err != nil {
+		t.Fatal("Can't invoke with repeated optional argument")
+	}
+
+	if err := fs.Parse(nil); err == nil {
+		t.Fatal("Accepted missing argument")
+	}
+}
+
+func TestSynopsis(t *testing.T) {
+	var buf bytes.Buffer
+
+	fs := newFlagSet(&buf, "test", "a", "--", "b...")
+	fs.Synopsis = []string{"<a>", "<a> -- <b>..."}
+	fs.PrintCommand()
+
+	const want = "Usage: tubectl test <a>\n       tubectl test <a> -- <b>...\n\n"
+	if have := buf.String(); have != want {
+		t.Errorf("Want %q, have %q", want, have)
+	}
+}
+
 func TestTrimLeadingTabsAndSpace(t *testing.T) {
 	const want = "a\n\nb\nc\nd"
 	have := trimLeadingTabsAndSpace("\na\n\n\tb\n\t\tc\n\t\t\td\n")
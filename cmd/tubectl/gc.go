@@ -0,0 +1,30 @@
+package main
+
+func gc(e *env, args ...string) error {
+	set := e.newFlagSet("gc")
+	set.Description = `
+		Remove destinations which have neither bindings nor a registered
+		socket. These are left behind if a process exits without
+		unregistering its sockets.
+
+		Examples:
+		  $ tubectl gc`
+
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	dp, err := e.openDispatcher(false)
+	if err != nil {
+		return err
+	}
+	defer dp.Close()
+
+	removed, err := dp.GCDestinations()
+	if err != nil {
+		return err
+	}
+
+	e.stdout.Logf("removed %d unused destination(s)\n", removed)
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestGC(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	sock := makeListeningSocket(t, netns, "tcp4")
+	mustRegisterSocket(t, dp, "foo", sock)
+	dp.Close()
+
+	output := mustTestTubectl(t, netns, "gc")
+	if !strings.Contains(output.String(), "removed 0 ") {
+		t.Error("gc removed a destination with a registered socket")
+	}
+
+	sock.(*net.TCPListener).Close()
+
+	output = mustTestTubectl(t, netns, "gc")
+	if !strings.Contains(output.String(), "removed 1 ") {
+		t.Error("gc didn't remove the destination of a closed socket")
+	}
+}
@@ -2,6 +2,11 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
 
 	"github.com/cloudflare/tubular/internal"
 )
@@ -9,11 +14,33 @@ import (
 func load(e *env, args ...string) error {
 	set := e.newFlagSet("load")
 	set.Description = "Load the tubular dispatcher."
+	perms := permissionFlags(set)
+	maxDests := set.Uint("max-destinations", 0, "The maximum `number` of destinations, or zero for the default.")
+	allowHost := set.Bool("allow-host-netns", false, "Don't warn when loading into the network namespace of the host.")
+	mountBPFFS := set.Bool("mount-bpffs", false, "Mount a BPF filesystem at the -bpffs path if there isn't one already.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
-	dp, err := e.createDispatcher()
+	if *mountBPFFS {
+		if err := e.mountBPFFS(); err != nil {
+			return err
+		}
+	}
+
+	if !*allowHost && isHostNetNS(e) {
+		e.stderr.Logf("Warning: %s is the host network namespace, the dispatcher will steer traffic for the whole host.\n", e.netns)
+		e.stderr.Log("Warning: pass -allow-host-netns if this is intended.")
+	}
+
+	if *maxDests > math.MaxUint32 {
+		return fmt.Errorf("%w: -max-destinations %d is too large", errBadArg, *maxDests)
+	}
+
+	dp, err := e.createDispatcher(internal.CreateOptions{
+		Permissions:     *perms,
+		MaxDestinations: uint32(*maxDests),
+	})
 	if errors.Is(err, internal.ErrLoaded) {
 		e.stderr.Log("dispatcher is already loaded in", e.netns)
 		return nil
@@ -26,17 +53,47 @@ func load(e *env, args ...string) error {
 	return nil
 }
 
+// isHostNetNS returns true if e.netns is the network namespace of the host.
+// Errors are ignored, since the check is only advisory.
+func isHostNetNS(e *env) bool {
+	if e.hostNetNS == "" {
+		return false
+	}
+
+	host, err := namespaceID(e.hostNetNS)
+	if err != nil {
+		return false
+	}
+
+	netns, err := namespaceID(e.netns)
+	if err != nil {
+		return false
+	}
+
+	return host == netns
+}
+
 func unload(e *env, args ...string) error {
 	set := e.newFlagSet("unload")
-	set.Description = "Unload the tubular dispatcher, removing any present state."
+	set.Description = `
+		Unload the tubular dispatcher, removing any present state.
+
+		Refuses to unload a dispatcher which has bindings or registered
+		sockets, since it is likely serving traffic. Pass -force to unload
+		it anyway.`
+	force := set.Bool("force", false, "Unload even if there are bindings or registered sockets.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
-	err := internal.UnloadDispatcher(e.netns, e.bpfFs)
+	err := internal.UnloadDispatcherWithOptions(e.netns, e.bpfFs, internal.UnloadOptions{
+		IfUnused: !*force,
+	})
 	if errors.Is(err, internal.ErrNotLoaded) {
 		e.stderr.Log("dispatcher is not loaded in", e.netns)
 		return nil
+	} else if errors.Is(err, internal.ErrInUse) {
+		return fmt.Errorf("%s, use -force to unload anyway", err)
 	} else if err != nil {
 		return err
 	}
@@ -47,16 +104,39 @@ func unload(e *env, args ...string) error {
 
 func upgrade(e *env, args ...string) error {
 	set := e.newFlagSet("upgrade")
-	set.Description = "Upgrade the tubular dispatcher, while preserving present state."
+	set.Description = `
+		Upgrade the tubular dispatcher, while preserving present state.
+
+		The permissions of the state are kept unless one of -dir-mode,
+		-object-mode or -gid is given.`
+	perms := permissionFlags(set)
+	prune := set.Bool("prune", false, "Remove pinned objects which aren't used by the new dispatcher.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
+	changePerms := false
+	set.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dir-mode", "object-mode", "gid":
+			changePerms = true
+		}
+	})
+	if !changePerms {
+		// The zero value keeps the current permissions.
+		*perms = internal.Permissions{}
+	}
+
 	if err := e.setupEnv(); err != nil {
 		return err
 	}
 
-	id, err := internal.UpgradeDispatcher(e.netns, e.bpfFs)
+	id, err := internal.UpgradeDispatcherWithOptions(e.netns, e.bpfFs, internal.UpgradeOptions{
+		Permissions: *perms,
+		Prune:       *prune,
+		Audit:       e.audit(),
+		Logger:      e.stderr,
+	})
 	if err != nil {
 		return err
 	}
@@ -64,3 +144,34 @@ func upgrade(e *env, args ...string) error {
 	e.stdout.Logf("Upgraded dispatcher to %s, program ID #%d", Version, id)
 	return nil
 }
+
+// permissionFlags adds flags which control access to the state of the
+// dispatcher to set.
+func permissionFlags(set *flagSet) *internal.Permissions {
+	perms := internal.DefaultPermissions
+	set.Var((*octalMode)(&perms.DirMode), "dir-mode", "Access `mode` of the state directory.")
+	set.Var((*octalMode)(&perms.ObjectMode), "object-mode", "Access `mode` of the pinned state.")
+	set.IntVar(&perms.GID, "gid", perms.GID, "Change the group of the state to `gid` if it isn't -1.")
+	return &perms
+}
+
+// octalMode is a flag.Value for file permissions in octal notation.
+type octalMode os.FileMode
+
+func (m *octalMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *octalMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return err
+	}
+
+	if os.FileMode(mode)&^os.ModePerm != 0 {
+		return fmt.Errorf("%#o isn't a permission", mode)
+	}
+
+	*m = octalMode(mode)
+	return nil
+}
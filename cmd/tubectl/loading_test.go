@@ -1,11 +1,18 @@
 package main
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/cloudflare/tubular/internal"
 	"github.com/cloudflare/tubular/internal/testutil"
+
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
 func TestLoadUnload(t *testing.T) {
@@ -21,6 +28,165 @@ func TestLoadUnload(t *testing.T) {
 	mustTestTubectl(t, netns, "unload")
 }
 
+func TestUnloadInUse(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", internal.TCP, "127.0.0.1", 80)
+	dp.Close()
+
+	_, err := testTubectl(t, netns, "unload")
+	if err == nil {
+		t.Fatal("unload doesn't refuse a dispatcher with bindings")
+	}
+	if !strings.Contains(err.Error(), "1 bindings") {
+		t.Error("Error doesn't mention the number of bindings:", err)
+	}
+
+	mustOpenDispatcher(t, netns).Close()
+
+	mustTestTubectl(t, netns, "unload", "-force")
+
+	if _, err := internal.OpenDispatcher(netns.Path(), "/sys/fs/bpf", true); !errors.Is(err, internal.ErrNotLoaded) {
+		t.Error("Dispatcher is still loaded after unload -force:", err)
+	}
+}
+
+func TestLoadTwice(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	load := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "load",
+		Effective: internal.CreateCapabilities,
+	}
+	load.MustRun(t)
+	defer mustTestTubectl(t, netns, "unload")
+
+	// Loading is idempotent so that provisioning scripts don't have to check
+	// whether the dispatcher is present.
+	output := load.MustRun(t)
+	if !strings.Contains(output.String(), "already loaded") {
+		t.Error("Output doesn't mention that the dispatcher is already loaded")
+	}
+}
+
+func TestLoadMaxDestinations(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	load := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "load",
+		Args:      []string{"-max-destinations", "2048"},
+		Effective: internal.CreateCapabilities,
+	}
+	load.MustRun(t)
+	defer mustTestTubectl(t, netns, "unload")
+
+	upgrade := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "upgrade",
+		Effective: internal.CreateCapabilities,
+	}
+	upgrade.MustRun(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	metrics, err := dp.Metrics()
+	dp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metrics.DestinationsCapacity != 2048 {
+		t.Error("Expected capacity of 2048 destinations, got", metrics.DestinationsCapacity)
+	}
+}
+
+func TestLoadHostNetNS(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		args []string
+		warn bool
+	}{
+		{"default", nil, true},
+		{"allowed", []string{"-allow-host-netns"}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			netns := testutil.NewNetNS(t)
+
+			load := tubectlTestCall{
+				NetNS:     netns,
+				HostNetNS: netns,
+				Cmd:       "load",
+				Args:      test.args,
+				Effective: internal.CreateCapabilities,
+			}
+			output := load.MustRun(t)
+			defer mustTestTubectl(t, netns, "unload")
+
+			if warned := strings.Contains(output.String(), "host network namespace"); warned != test.warn {
+				t.Errorf("Expected warning to be %t, got %t:\n%s", test.warn, warned, output)
+			}
+		})
+	}
+
+	// Other namespaces don't trigger the warning.
+	netns := testutil.NewNetNS(t)
+	load := tubectlTestCall{
+		NetNS:     netns,
+		HostNetNS: testutil.NewNetNS(t),
+		Cmd:       "load",
+		Effective: internal.CreateCapabilities,
+	}
+	output := load.MustRun(t)
+	defer mustTestTubectl(t, netns, "unload")
+
+	if strings.Contains(output.String(), "host network namespace") {
+		t.Errorf("Warning for a namespace which isn't the host's:\n%s", output)
+	}
+}
+
+func TestLoadMountBPFFS(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	bpfFs := t.TempDir()
+
+	load := tubectlTestCall{
+		NetNS: netns,
+		Flags: []string{"-bpffs", bpfFs},
+		Cmd:   "load",
+	}
+	if _, err := load.Run(t); !errors.Is(err, internal.ErrNotBPFFS) {
+		t.Fatal("Expected ErrNotBPFFS without -mount-bpffs, got", err)
+	}
+
+	load.Args = []string{"-mount-bpffs"}
+	if _, err := load.Run(t); !errors.Is(err, unix.EPERM) {
+		t.Fatal("Expected EPERM without CAP_SYS_ADMIN, got", err)
+	}
+
+	load.Effective = internal.CreateCapabilities
+	load.MustRun(t)
+	t.Cleanup(func() {
+		err := testutil.WithCapabilities(func() error {
+			return unix.Unmount(bpfFs, unix.MNT_DETACH)
+		}, cap.SYS_ADMIN)
+		if err != nil {
+			t.Error("Can't unmount BPF filesystem:", err)
+		}
+	})
+
+	unload := tubectlTestCall{
+		NetNS: netns,
+		Flags: []string{"-bpffs", bpfFs},
+		Cmd:   "unload",
+	}
+	unload.MustRun(t)
+
+	// Mounting is skipped if the filesystem is already there.
+	load.MustRun(t)
+	unload.MustRun(t)
+}
+
 func TestUpgrade(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
@@ -35,3 +201,105 @@ func TestUpgrade(t *testing.T) {
 		t.Error("Output doesn't contain version")
 	}
 }
+
+func TestLoadPermissions(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	load := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "load",
+		Args:      []string{"-dir-mode", "0700", "-object-mode", "0600"},
+		Effective: internal.CreateCapabilities,
+	}
+	load.MustRun(t)
+	defer mustTestTubectl(t, netns, "unload")
+
+	dp := mustOpenDispatcher(t, netns)
+	info, err := os.Stat(dp.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := info.Mode().Perm(); mode != 0700 {
+		t.Errorf("State directory has mode %v instead of 0700", mode)
+	}
+	dp.Close()
+
+	for _, mode := range []string{"800", "01777", "rw"} {
+		if _, err := testTubectl(t, netns, "load", "-dir-mode", mode); err == nil {
+			t.Errorf("Accepted invalid mode %q", mode)
+		}
+	}
+}
+
+func TestUpgradeKeepsPermissions(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	load := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "load",
+		Args:      []string{"-dir-mode", "0770", "-object-mode", "0660", "-gid", strconv.Itoa(os.Getgid())},
+		Effective: internal.CreateCapabilities,
+	}
+	load.MustRun(t)
+	defer mustTestTubectl(t, netns, "unload")
+
+	upgrade := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "upgrade",
+		Effective: internal.CreateCapabilities,
+	}
+	upgrade.MustRun(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	defer dp.Close()
+
+	info, err := os.Stat(dp.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0770 {
+		t.Errorf("State directory has mode %v instead of 0770 after upgrade", mode)
+	}
+
+	entries, err := os.ReadDir(dp.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0660 {
+			t.Errorf("%s has mode %v instead of 0660 after upgrade", entry.Name(), mode)
+		}
+	}
+}
+
+func TestUpgradePrune(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	path := dp.Path
+	dp.Close()
+
+	stray := filepath.Join(path, "stray")
+	if err := os.Mkdir(stray, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	upgrade := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "upgrade",
+		Args:      []string{"-prune"},
+		Effective: internal.CreateCapabilities,
+	}
+	upgrade.MustRun(t)
+
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Error("upgrade -prune didn't remove stray state:", err)
+	}
+
+	mustOpenDispatcher(t, netns).Close()
+}
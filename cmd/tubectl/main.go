@@ -3,12 +3,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"syscall"
+	"os/signal"
 
 	"github.com/cloudflare/tubular/internal"
 	"github.com/cloudflare/tubular/internal/log"
@@ -23,29 +25,69 @@ type env struct {
 	netns          string
 	bpfFs          string
 	ctx            context.Context
+	// Path to the network namespace of the host.
+	hostNetNS string
+	// Receives a JSON line for each change to state if not nil.
+	auditLog io.Writer
+	// Override for os.Stdin
+	stdin io.Reader
 	// Override for os.Getenv
 	getenv func(key string) string
 	// Override for os.NewFile
 	newFile func(fd uintptr, name string) *os.File
 	// Override for net.Listen
 	listen func(network, addr string) (net.Listener, error)
+	// Override for signal.Notify
+	notify func(c chan<- os.Signal, sig ...os.Signal)
 }
 
 var (
 	defaultEnv = env{
-		stdout:  log.NewStdLogger(os.Stdout),
-		stderr:  log.NewStdLogger(os.Stderr),
-		ctx:     context.Background(),
-		getenv:  os.Getenv,
-		newFile: os.NewFile,
-		listen:  net.Listen,
+		stdout:    log.NewStdLogger(os.Stdout),
+		stderr:    log.NewStdLogger(os.Stderr),
+		ctx:       context.Background(),
+		hostNetNS: "/proc/1/ns/net",
+		stdin:     os.Stdin,
+		getenv:    os.Getenv,
+		newFile:   os.NewFile,
+		listen:    net.Listen,
+		notify:    signal.Notify,
 	}
 
 	// Errors returned by tubectl
-	errBadArg = syscall.EINVAL
-	errBadFD  = syscall.EBADF
+	errBadArg = errors.New("invalid argument")
+	errBadFD  = errors.New("bad file descriptor")
+	errDrift  = errors.New("bindings differ")
 )
 
+// exitCodes maps errors to the exit code of tubectl. Any other error exits
+// with 1. 2 is skipped since the Go runtime exits with it on panic.
+var exitCodes = []struct {
+	err         error
+	code        int
+	description string
+}{
+	{errBadArg, 3, "invalid arguments"},
+	{errBadFD, 4, "invalid file descriptor"},
+	{internal.ErrNotLoaded, 5, "dispatcher isn't loaded"},
+	{os.ErrPermission, 6, "permission denied"},
+	{errDrift, 7, "bindings differ"},
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	for _, ec := range exitCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+
+	return 1
+}
+
 func (e *env) setupEnv() error {
 	haveSysResource, err := cap.GetProc().GetFlag(cap.Effective, cap.SYS_RESOURCE)
 	if err != nil {
@@ -63,17 +105,31 @@ func (e *env) setupEnv() error {
 	return nil
 }
 
-func (e *env) createDispatcher() (*internal.Dispatcher, error) {
+func (e *env) mountBPFFS() error {
+	mounted, err := internal.MountBPFFS(e.bpfFs)
+	if errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("can't mount BPF filesystem at %s without CAP_SYS_ADMIN, mount it manually or run as root: %w", e.bpfFs, err)
+	} else if err != nil {
+		return err
+	}
+
+	if mounted {
+		e.stderr.Logf("mounted BPF filesystem at %s\n", e.bpfFs)
+	}
+	return nil
+}
+
+func (e *env) createDispatcher(opts internal.CreateOptions) (*internal.Dispatcher, error) {
 	if err := e.setupEnv(); err != nil {
 		return nil, err
 	}
 
-	dp, err := internal.CreateDispatcher(e.netns, e.bpfFs)
+	dp, err := internal.CreateDispatcherWithOptions(e.netns, e.bpfFs, opts)
 	if err != nil {
 		return nil, fmt.Errorf("can't load dispatcher: %w", err)
 	}
 
-	e.stdout.Logf("created dispatcher in %v\n", dp.Path)
+	log.Fields(e.stdout, "created dispatcher in", "path", dp.Path)
 	return dp, nil
 }
 
@@ -87,10 +143,45 @@ func (e *env) openDispatcher(readOnly bool) (*internal.Dispatcher, error) {
 		return nil, fmt.Errorf("can't open dispatcher: %w", err)
 	}
 
-	e.stdout.Logf("opened dispatcher at %v\n", dp.Path)
+	// Log to stderr so that machine readable output on stdout isn't garbled.
+	e.stderr.Logf("opened dispatcher at %v\n", dp.Path)
+
+	if !readOnly {
+		dp.Audit = e.audit()
+	}
+
+	if have, want := dp.StateVersion(), internal.CurrentStateVersion; have < want {
+		e.stderr.Logf("Warning: state version %d predates %d, consider running upgrade\n", have, want)
+	} else if have > want {
+		e.stderr.Logf("Warning: state version %d is newer than %d\n", have, want)
+	}
+
 	return dp, nil
 }
 
+// audit returns a function which writes records to the audit log, or nil if
+// there is no audit log.
+func (e *env) audit() func(*internal.AuditRecord) {
+	if e.auditLog == nil {
+		return nil
+	}
+
+	enc := json.NewEncoder(e.auditLog)
+	return func(record *internal.AuditRecord) {
+		if err := enc.Encode(record); err != nil {
+			e.stderr.Log("Warning: can't write audit log:", err)
+		}
+	}
+}
+
+// cancelOnInterrupt cancels e.ctx on SIGINT, which allows long running
+// commands to exit cleanly. Other commands keep the default behaviour of
+// exiting immediately.
+func (e *env) cancelOnInterrupt() (stop func()) {
+	e.ctx, stop = signal.NotifyContext(e.ctx, os.Interrupt)
+	return stop
+}
+
 func (e *env) newFlagSet(name string, args ...string) *flagSet {
 	return newFlagSet(e.stderr, name, args...)
 }
@@ -114,10 +205,22 @@ var cmds = []struct {
 	{"bind", bind, false},
 	{"unbind", unbind, false},
 	{"load-bindings", loadBindings, false},
+	{"diff", diff, false},
+	{"watch-bindings", watchBindings, false},
 	// Destinations
+	{"destinations", destinations, false},
+	{"cookie", cookie, false},
 	{"register", register, false},
 	{"register-pid", registerPID, false},
+	{"register-cgroup", registerCgroup, false},
+	{"register-manifest", registerManifest, false},
 	{"unregister", unregister, false},
+	{"gc", gc, false},
+	// State
+	{"export-state", exportState, false},
+	{"import-state", importState, false},
+	// Debugging
+	{"debug", debug, false},
 	// Deprecated
 	{"list", list, true},
 }
@@ -131,8 +234,9 @@ func tubectl(e env, args []string) (err error) {
 
 	set := flag.NewFlagSet("tubectl", flag.ContinueOnError)
 	set.SetOutput(e.stderr)
-	set.StringVar(&e.netns, "netns", "/proc/self/ns/net", "`path` to the network namespace")
-	set.StringVar(&e.bpfFs, "bpffs", "/sys/fs/bpf", "`path` to a BPF filesystem for state")
+	set.StringVar(&e.netns, "netns", "/proc/self/ns/net", "`path` to the network namespace, overrides $TUBECTL_NETNS")
+	set.StringVar(&e.bpfFs, "bpffs", "/sys/fs/bpf", "`path` to a BPF filesystem for state, overrides $TUBECTL_BPFFS")
+	auditLog := set.String("audit-log", "", "append a JSON record of each change to state to `path`")
 
 	set.Usage = func() {
 		out := set.Output()
@@ -150,25 +254,53 @@ func tubectl(e env, args []string) (err error) {
 			fmt.Fprintln(out, "  "+cmd.name)
 		}
 		fmt.Fprintln(out)
+
+		fmt.Fprintln(out, "Exit codes:")
+		fmt.Fprintln(out, "  0  success")
+		fmt.Fprintln(out, "  1  any other error")
+		for _, ec := range exitCodes {
+			fmt.Fprintf(out, "  %d  %s\n", ec.code, ec.description)
+		}
+		fmt.Fprintln(out)
 	}
 
 	if err := set.Parse(args); errors.Is(err, flag.ErrHelp) {
 		return nil
 	} else if err != nil {
-		return err
+		return fmt.Errorf("%w: %s", errBadArg, err)
+	}
+
+	// Flags take precedence over the environment.
+	explicit := make(map[string]bool)
+	set.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if netns := e.getenv("TUBECTL_NETNS"); netns != "" && !explicit["netns"] {
+		e.netns = netns
+	}
+	if bpfFs := e.getenv("TUBECTL_BPFFS"); bpfFs != "" && !explicit["bpffs"] {
+		e.bpfFs = bpfFs
 	}
 
 	if e.netns == "" {
-		return fmt.Errorf("invalid -netns flag")
+		return fmt.Errorf("%w: invalid -netns flag", errBadArg)
 	}
 
 	if e.bpfFs == "" {
-		return fmt.Errorf("invalid -bpffs flag")
+		return fmt.Errorf("%w: invalid -bpffs flag", errBadArg)
 	}
 
 	if set.NArg() < 1 {
 		set.Usage()
-		return fmt.Errorf("missing command")
+		return fmt.Errorf("%w: missing command", errBadArg)
+	}
+
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("open audit log: %s", err)
+		}
+		defer f.Close()
+
+		e.auditLog = f
 	}
 
 	var (
@@ -182,6 +314,9 @@ func tubectl(e env, args []string) (err error) {
 		}
 
 		err := cmd.fn(&e, cmdArgs...)
+		if errors.Is(err, internal.ErrNoDestinationIDs) {
+			e.stderr.Log("Hint: all destinations are in use. Remove unused ones with gc, or unload and load the dispatcher with a larger -max-destinations.")
+		}
 		if err != nil && !errors.Is(err, flag.ErrHelp) {
 			return fmt.Errorf("%s: %w", cmdName, err)
 		}
@@ -190,11 +325,12 @@ func tubectl(e env, args []string) (err error) {
 	}
 
 	set.Usage()
-	return fmt.Errorf("unknown command '%s'", cmdName)
+	return fmt.Errorf("%w: unknown command '%s'", errBadArg, cmdName)
 }
 
 func main() {
-	if err := tubectl(defaultEnv, os.Args[1:]); err != nil {
-		os.Exit(1)
+	err := tubectl(defaultEnv, os.Args[1:])
+	if code := exitCode(err); code != 0 {
+		os.Exit(code)
 	}
 }
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/tubular/internal"
 	"github.com/cloudflare/tubular/internal/log"
@@ -18,6 +24,7 @@ import (
 	"github.com/cloudflare/tubular/internal/testutil"
 
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/google/go-cmp/cmp"
 	"golang.org/x/sys/unix"
 	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
@@ -52,6 +59,154 @@ func TestSubcommandHelp(t *testing.T) {
 	}
 }
 
+func TestExitCodes(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	for _, test := range []struct {
+		name string
+		call tubectlTestCall
+		code int
+	}{
+		{"unknown command", tubectlTestCall{Cmd: "does-not-exist"}, 3},
+		{"unknown flag", tubectlTestCall{Cmd: "bindings", Args: []string{"-does-not-exist"}}, 3},
+		{"bad argument", tubectlTestCall{Cmd: "bindings", Args: []string{"-o", "yaml"}}, 3},
+		{"bad fd", tubectlTestCall{
+			Cmd:      "register",
+			Args:     []string{"foo"},
+			Env:      testEnv{"LISTEN_FDS": "1"},
+			ExtraFds: testFds{nil},
+		}, 4},
+		{"not loaded", tubectlTestCall{Cmd: "bindings"}, 5},
+		{"permission denied", tubectlTestCall{Cmd: "load"}, 6},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.call.NetNS = netns
+			test.call.ExecNS = netns
+			_, err := test.call.Run(t)
+			if code := exitCode(err); code != test.code {
+				t.Errorf("Expected exit code %d, got %d: %v", test.code, code, err)
+			}
+		})
+	}
+
+	if code := exitCode(fmt.Errorf("diff: %w", errDrift)); code != 7 {
+		t.Error("Expected exit code 7 for errDrift, got", code)
+	}
+
+	if code := exitCode(nil); code != 0 {
+		t.Error("Expected exit code 0 for nil, got", code)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	netns := mustReadyNetNS(t)
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+
+	calls := []tubectlTestCall{
+		{Cmd: "bind", Args: []string{"foo", "tcp", "127.0.0.1", "80"}},
+		{Cmd: "bind", Args: []string{"foo", "udp", "::1", "53"}},
+		{Cmd: "unbind", Args: []string{"foo", "udp", "::1", "53"}},
+		{
+			Cmd:      "register",
+			Args:     []string{"foo"},
+			Env:      testEnv{"LISTEN_FDS": "1"},
+			ExtraFds: testFds{makeListeningSocket(t, netns, "tcp4")},
+		},
+		{Cmd: "unregister", Args: []string{"foo", "ipv4", "tcp"}},
+		{Cmd: "upgrade", Effective: internal.CreateCapabilities},
+		// Read-only commands aren't audited.
+		{Cmd: "bindings"},
+	}
+
+	for _, tc := range calls {
+		tc.NetNS = netns
+		tc.ExecNS = netns
+		tc.Flags = []string{"-audit-log", auditLog}
+		tc.MustRun(t)
+	}
+
+	port := func(p uint16) *uint16 { return &p }
+	want := []internal.AuditRecord{
+		{Operation: internal.AuditAddBinding, Label: "foo", Protocol: "tcp", Prefix: "127.0.0.1/32", Port: port(80)},
+		{Operation: internal.AuditAddBinding, Label: "foo", Protocol: "udp", Prefix: "::1/128", Port: port(53)},
+		{Operation: internal.AuditRemoveBinding, Label: "foo", Protocol: "udp", Prefix: "::1/128", Port: port(53)},
+		{Operation: internal.AuditRegisterSocket, Label: "foo", Protocol: "tcp", Domain: "ipv4"},
+		{Operation: internal.AuditUnregisterSocket, Label: "foo", Protocol: "tcp", Domain: "ipv4"},
+		{Operation: internal.AuditUpgrade},
+	}
+
+	f, err := os.Open(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var have []internal.AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record internal.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid line %q: %s", scanner.Text(), err)
+		}
+
+		if record.Time.IsZero() {
+			t.Error("Record is missing a timestamp:", scanner.Text())
+		}
+		record.Time = time.Time{}
+
+		if record.Operation == internal.AuditUpgrade {
+			if record.PreviousProgramID == 0 || record.ProgramID == 0 {
+				t.Error("Upgrade record is missing program IDs:", scanner.Text())
+			}
+			if bytes.Contains(scanner.Bytes(), []byte(`"label"`)) {
+				t.Error("Upgrade record contains an empty label:", scanner.Text())
+			}
+			record.PreviousProgramID, record.ProgramID = 0, 0
+		}
+
+		have = append(have, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("Audit log doesn't match (-want +have):\n%s", diff)
+	}
+}
+
+func TestNetNSFromEnv(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	load := tubectlTestCall{
+		Cmd:       "load",
+		Env:       testEnv{"TUBECTL_NETNS": netns.Path()},
+		Effective: internal.CreateCapabilities,
+	}
+	load.MustRun(t)
+	defer mustTestTubectl(t, netns, "unload")
+
+	// Opening fails if the dispatcher was loaded into another namespace.
+	mustOpenDispatcher(t, netns).Close()
+
+	// Flags take precedence over the environment.
+	bindings := tubectlTestCall{
+		NetNS: netns,
+		Cmd:   "bindings",
+		Env: testEnv{
+			"TUBECTL_NETNS": "/does/not/exist",
+			"TUBECTL_BPFFS": "/does/not/exist",
+		},
+		Flags: []string{"-bpffs", "/sys/fs/bpf"},
+	}
+	bindings.MustRun(t)
+
+	bindings.Flags = nil
+	if _, err := bindings.Run(t); err == nil {
+		t.Error("TUBECTL_BPFFS is ignored")
+	}
+}
+
 func testTubectl(tb testing.TB, netns ns.NetNS, cmd string, args ...string) (*bytes.Buffer, error) {
 	tc := tubectlTestCall{
 		NetNS: netns,
@@ -114,7 +269,7 @@ func mustAddBinding(tb testing.TB, dp *internal.Dispatcher, label string, proto
 		tb.Fatal(err)
 	}
 
-	err = dp.AddBinding(bind)
+	_, err = dp.AddBinding(bind)
 	if err != nil {
 		tb.Fatal("Can't add binding:", err)
 	}
@@ -145,6 +300,13 @@ type tubectlTestCall struct {
 	// the current namespace.
 	ExecNS ns.NetNS
 
+	// Flags are passed to tubectl before Cmd.
+	Flags []string
+
+	// HostNetNS is considered to be the network namespace of the host.
+	// Defaults to the namespace of PID 1.
+	HostNetNS ns.NetNS
+
 	Cmd  string
 	Args []string
 
@@ -159,9 +321,20 @@ type tubectlTestCall struct {
 	// becomes file descriptor 3+i.
 	ExtraFds testFds
 
+	// Stdin specifies the standard input of the call. Reads return EOF if it
+	// is nil.
+	Stdin io.Reader
+
 	// Listeners receives the created listeners if the channel is not nil.
 	Listeners chan net.Listener
 
+	// Signals receives the channels passed to signal.Notify if it is not nil.
+	Signals chan chan<- os.Signal
+
+	// Stdout receives standard output if it is not nil. The output returned
+	// from Run then only contains standard error.
+	Stdout *log.Buffer
+
 	// Effective lists the capabilities required for this call. The effective
 	// set isn't changed if the slice is empty.
 	Effective []cap.Value
@@ -178,11 +351,28 @@ func (tc *tubectlTestCall) Run(tb testing.TB) (*bytes.Buffer, error) {
 }
 
 func (tc *tubectlTestCall) run(tb testing.TB, ctx context.Context, output log.Logger) error {
+	stdout := output
+	if tc.Stdout != nil {
+		stdout = tc.Stdout
+	}
+
+	stdin := tc.Stdin
+	if stdin == nil {
+		stdin = strings.NewReader("")
+	}
+
+	hostNetNS := "/proc/1/ns/net"
+	if tc.HostNetNS != nil {
+		hostNetNS = tc.HostNetNS.Path()
+	}
+
 	env := env{
-		stdout: output,
-		stderr: output,
-		ctx:    ctx,
-		getenv: func(key string) string { return tc.getenv(key) },
+		stdout:    stdout,
+		stderr:    output,
+		ctx:       ctx,
+		hostNetNS: hostNetNS,
+		stdin:     stdin,
+		getenv:    func(key string) string { return tc.getenv(key) },
 		newFile: func(fd uintptr, name string) *os.File {
 			return tc.newFile(fd, name)
 		},
@@ -197,11 +387,17 @@ func (tc *tubectlTestCall) run(tb testing.TB, ctx context.Context, output log.Lo
 			}
 			return ln, nil
 		},
+		notify: func(c chan<- os.Signal, sig ...os.Signal) {
+			if tc.Signals != nil {
+				tc.Signals <- c
+			}
+		},
 	}
 	var args []string
 	if tc.NetNS != nil {
 		args = append(args, "-netns", tc.NetNS.Path())
 	}
+	args = append(args, tc.Flags...)
 	if tc.Cmd != "" {
 		args = append(args, tc.Cmd)
 	}
@@ -292,7 +488,7 @@ func (tc *tubectlTestCall) newFile(fd uintptr, name string) *os.File {
 			return nil
 		}
 
-		f, _ := dupFile(c)
+		f, _ := dupFile(c, name)
 		return f
 	}
 	return nil
@@ -300,7 +496,7 @@ func (tc *tubectlTestCall) newFile(fd uintptr, name string) *os.File {
 
 // Creates an os.File for the same file _description_, but not the same file
 // _descriptor_, as represented by passed syscall.Conn.
-func dupFile(old syscall.Conn) (*os.File, error) {
+func dupFile(old syscall.Conn, name string) (*os.File, error) {
 	newFd, err := sysconn.ControlInt(old, func(fd int) (int, error) {
 		return unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
 	})
@@ -308,5 +504,5 @@ func dupFile(old syscall.Conn) (*os.File, error) {
 		return nil, err
 	}
 
-	return os.NewFile(uintptr(newFd), ""), nil
+	return os.NewFile(uintptr(newFd), name), nil
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -22,22 +25,60 @@ const (
 )
 
 func register(e *env, args ...string) error {
-	set := e.newFlagSet("register", "label")
+	set := e.newFlagSet("register", "--", "label")
 	set.Description = `
 		Register sockets under the given label.
 
 		Used together with systemd socket activation, it expects the
-		number of sockets in LISTEN_FDS. LISTEN_PID and LISTEN_FDNAMES are
-		ignored.
+		number of sockets in LISTEN_FDS. LISTEN_PID is ignored.
+
+		LISTEN_FDNAMES is ignored unless -use-fdnames is given. Each socket
+		is then registered under label/name, or under its name if no label
+		is specified.
+
+		Launchers other than systemd can pass a list of file descriptors
+		with -fds instead, in which case LISTEN_FDS is ignored.
+
+		Dual-stack ipv6 sockets are rejected unless -allow-dual-stack is
+		given. They are then registered for both ipv4 and ipv6, and the
+		same socket receives traffic for both.
 
 		Examples:
 		  # Register all sockets passed from systemd under label foo
-		  $ tubectl register foo`
+		  $ tubectl register foo
+
+		  # Register sockets from systemd under foo/http, foo/dns, etc.
+		  $ tubectl register -use-fdnames foo
+
+		  # Register file descriptors 5, 6 and 7 under label foo
+		  $ tubectl register -fds 5,6,7 foo`
 
+	dualStack := set.Bool("allow-dual-stack", false, "Register dual-stack ipv6 sockets for both ipv4 and ipv6.")
+	useNames := set.Bool("use-fdnames", false, "Derive labels from the socket names in LISTEN_FDNAMES.")
+	fdList := set.String("fds", "", "Comma separated `list` of file descriptors to register instead of LISTEN_FDS.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
+	label := set.Arg(0)
+	if label == "" && !*useNames {
+		set.Usage()
+		return fmt.Errorf("%w: missing label", errBadArg)
+	}
+
+	var fds []int
+	if *fdList != "" {
+		if *useNames {
+			return fmt.Errorf("%w: -fds and -use-fdnames are mutually exclusive", errBadArg)
+		}
+
+		var err error
+		fds, err = parseFds(*fdList)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Use the current thread's netns, unit tests don't work well with
 	// /proc/self/ns/net.
 	targetNSPath := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
@@ -45,9 +86,7 @@ func register(e *env, args ...string) error {
 		return err
 	}
 
-	label := set.Arg(0)
-
-	files, err := listenFds(e, sysconn.FirstReuseport())
+	files, groupSizes, err := listenFds(e, fds, sysconn.FirstReuseport(), *useNames)
 	if err != nil {
 		return err
 	}
@@ -58,7 +97,29 @@ func register(e *env, args ...string) error {
 		}
 	}()
 
-	return registerFiles(e, label, files)
+	labels := make([]string, 0, len(files))
+	for _, file := range files {
+		switch {
+		case !*useNames:
+			labels = append(labels, label)
+		case label == "":
+			labels = append(labels, file.Name())
+		default:
+			labels = append(labels, label+"/"+file.Name())
+		}
+	}
+
+	if err := registerFiles(e, labels, files, *dualStack); err != nil {
+		return err
+	}
+
+	for i, size := range groupSizes {
+		if size > 1 {
+			e.stdout.Logf("registered %s: collapsed reuseport group of %d\n", labels[i], size)
+		}
+	}
+
+	return nil
 }
 
 func registerPID(e *env, args ...string) error {
@@ -67,15 +128,32 @@ func registerPID(e *env, args ...string) error {
 		Register sockets from a process under the given label.
 
 		The file descriptors of the target process will be enumerated to find
-		matching sockets according to protocol, ip and port.
+		matching sockets according to protocol, ip and port. Use "any" as ip
+		and 0 as port to match sockets regardless of their address. Only one
+		socket per address family may match.
+
+		Only one socket of each reuseport group is registered, by default the
+		first one found. Pass -reuseport-newest to register the most recently
+		created one instead.
 
 		Examples:
 			# Register all supported sockets from the process with pid 12345
 			$ tubectl register-pid 12345 foo tcp 127.0.0.1 80
 
+			# Register listening sockets on any address and port
+			$ tubectl register-pid 12345 foo tcp any 0
+
 			# Read the pid from a file
-			$ tubectl register-pid /path/to.pid foo tcp 127.0.0.1 80`
+			$ tubectl register-pid /path/to.pid foo tcp 127.0.0.1 80
+
+			# Make sure that the pid still belongs to nginx
+			$ tubectl register-pid -comm nginx /path/to.pid foo tcp 127.0.0.1 80
 
+			# Prefer the most recent listener of a reuseport group
+			$ tubectl register-pid -reuseport-newest 12345 foo tcp any 0`
+
+	comm := set.String("comm", "", "Only register sockets if the process `name` matches.")
+	newest := set.Bool("reuseport-newest", false, "Register the most recently created socket of each reuseport group.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
@@ -91,32 +169,319 @@ func registerPID(e *env, args ...string) error {
 		return fmt.Errorf("invalid pid %q: %s", set.Arg(0), err)
 	}
 
-	if err := namespacesEqual(e.netns, fmt.Sprintf("/proc/%d/ns/net", pid)); err != nil {
+	label := set.Arg(1)
+	protocol := set.Arg(2)
+
+	port, err := strconv.ParseUint(set.Arg(4), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: %s", set.Arg(4), err)
+	}
+
+	filter, err := addressFilter(protocol, set.Arg(3), uint16(port))
+	if err != nil {
 		return err
 	}
+	if !*newest {
+		filter = append(filter, sysconn.FirstReuseport())
+	}
 
-	label := set.Arg(1)
-	protocol := set.Arg(2)
+	var procs []pidfd.ProcessPredicate
+	if *comm != "" {
+		procs = append(procs, pidfd.Comm(*comm))
+	}
+
+	return registerProcess(e, int(pid), label, procs, filter, *newest)
+}
+
+type registerManifestJSON struct {
+	Processes []registerProcessJSON `json:"processes"`
+}
+
+type registerProcessJSON struct {
+	Label    string `json:"label"`
+	PID      int    `json:"pid"`
+	Protocol string `json:"protocol"`
+	IP       string `json:"ip"`
+	Port     uint16 `json:"port"`
+}
 
-	ip, err := netaddr.ParseIP(set.Arg(3))
+func registerManifest(e *env, args ...string) error {
+	set := e.newFlagSet("register-manifest", "file")
+	set.Description = func() {
+		example := registerManifestJSON{
+			Processes: []registerProcessJSON{
+				{"foo", 12345, "tcp", "127.0.0.1", 80},
+				{"bar", 23456, "udp", "any", 0},
+			},
+		}
+
+		out, _ := json.MarshalIndent(example, "    ", "    ")
+
+		set.Printf(
+			`Register sockets from multiple processes, as described by a JSON
+			formatted file. Each entry is equivalent to an invocation of
+			register-pid. All entries are validated before any sockets are
+			registered.
+
+			The format is:
+
+			    %s`,
+			string(out),
+		)
+	}
+
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	file, err := os.Open(set.Arg(0))
 	if err != nil {
-		return fmt.Errorf("invalid IP %q: %s", set.Arg(3), err)
+		return err
 	}
+	defer file.Close()
 
-	port, err := strconv.ParseUint(set.Arg(4), 10, 16)
+	var manifest registerManifestJSON
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&manifest); err != nil {
+		return fmt.Errorf("%s: %s", file.Name(), err)
+	}
+
+	filters := make([][]sysconn.Predicate, 0, len(manifest.Processes))
+	for i, proc := range manifest.Processes {
+		if proc.Label == "" {
+			return fmt.Errorf("entry %d: %w: label is empty", i, errBadArg)
+		}
+
+		if proc.PID <= 0 {
+			return fmt.Errorf("entry %d: %w: invalid pid %d", i, errBadArg, proc.PID)
+		}
+
+		filter, err := socketFilter(proc.Protocol, proc.IP, proc.Port)
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		filters = append(filters, filter)
+	}
+
+	var (
+		files  []*os.File
+		labels []string
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	// Sockets matched by more than one entry are rejected before any of
+	// them are registered.
+	entries := make(map[internal.SocketCookie]int)
+	for i, proc := range manifest.Processes {
+		pidFiles, err := processFiles(e, proc.PID, nil, filters[i])
+		if err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		if len(pidFiles) == 0 {
+			return fmt.Errorf("entry %d: pid %d: no sockets: %w", i, proc.PID, errBadArg)
+		}
+
+		for _, f := range pidFiles {
+			files = append(files, f)
+
+			cookie, err := socketCookie(f)
+			if err != nil {
+				return fmt.Errorf("entry %d: %s", i, err)
+			}
+
+			if j, ok := entries[cookie]; ok {
+				return fmt.Errorf("entry %d: socket %s is also matched by entry %d: %w", i, cookie, j, errBadArg)
+			}
+			entries[cookie] = i
+
+			labels = append(labels, proc.Label)
+		}
+	}
+
+	return registerFiles(e, labels, files, false)
+}
+
+// socketFilter is like addressFilter, but only keeps the first socket of each
+// reuseport group.
+func socketFilter(protocol, ip string, port uint16) ([]sysconn.Predicate, error) {
+	filter, err := addressFilter(protocol, ip, port)
 	if err != nil {
-		return fmt.Errorf("invalid port %q: %s", set.Arg(4), err)
+		return nil, err
+	}
+	return append(filter, sysconn.FirstReuseport()), nil
+}
+
+// addressFilter returns predicates which match listening sockets with the
+// given protocol, ip and port.
+//
+// ip may be "any" and port may be 0 to match sockets regardless of address.
+func addressFilter(protocol, ip string, port uint16) ([]sysconn.Predicate, error) {
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("%w: expected protocol tcp or udp, got %q", errBadArg, protocol)
+	}
+
+	// The zero IP matches any address.
+	var addr netaddr.IP
+	if ip != "any" {
+		var err error
+		addr, err = netaddr.ParseIP(ip)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q: %s", ip, err)
+		}
 	}
 
 	filter := []sysconn.Predicate{
 		sysconn.IgnoreENOTSOCK(sysconn.InetListener(protocol)),
-		sysconn.LocalAddress(ip, int(port)),
-		sysconn.FirstReuseport(),
 	}
+	if !addr.IsZero() || port != 0 {
+		filter = append(filter, sysconn.LocalAddress(addr, int(port)))
+	}
+	return filter, nil
+}
+
+func registerCgroup(e *env, args ...string) error {
+	set := e.newFlagSet("register-cgroup", "cgroup", "label", "protocol", "ip", "port")
+	set.Description = `
+		Register sockets from all processes in a cgroup under the given label.
 
-	files, err := pidfd.Files(int(pid), filter...)
+		Works like register-pid, except that the processes are read from
+		the cgroup.procs files of a cgroup v2 directory and all of its
+		descendants. Processes which exit while their sockets are
+		enumerated are skipped. A socket shared by multiple processes, for
+		example because it was inherited across fork, is registered once.
+		Only one socket per address family may match across all processes.
+
+		Examples:
+			$ tubectl register-cgroup /sys/fs/cgroup/system.slice/nginx.service foo tcp 127.0.0.1 80
+
+			# Only consider nginx processes
+			$ tubectl register-cgroup -comm nginx /sys/fs/cgroup/kubepods.slice/pod1234 foo tcp any 0`
+
+	comm := set.String("comm", "", "Only register sockets of processes with `name`.")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	label := set.Arg(1)
+	protocol := set.Arg(2)
+
+	port, err := strconv.ParseUint(set.Arg(4), 10, 16)
 	if err != nil {
-		return fmt.Errorf("pid %d: %w", pid, err)
+		return fmt.Errorf("invalid port %q: %s", set.Arg(4), err)
+	}
+
+	filter, err := socketFilter(protocol, set.Arg(3), uint16(port))
+	if err != nil {
+		return err
+	}
+
+	var procs []pidfd.ProcessPredicate
+	if *comm != "" {
+		procs = append(procs, pidfd.Comm(*comm))
+	}
+
+	pids, err := cgroupProcs(set.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var files, allFiles []*os.File
+	defer func() {
+		for _, f := range allFiles {
+			f.Close()
+		}
+	}()
+
+	// filter is shared between processes, so FirstReuseport only keeps one
+	// socket per reuseport group across the whole cgroup.
+	seen := make(map[internal.SocketCookie]bool)
+	for _, pid := range pids {
+		err := namespacesEqual(e.netns, fmt.Sprintf("/proc/%d/ns/net", pid))
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("pid %d: %w", pid, err)
+		}
+
+		pidFiles, err := pidfd.FilesOf(pid, procs, filter...)
+		if errors.Is(err, unix.ESRCH) || errors.Is(err, pidfd.ErrProcessMismatch) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("pid %d: %w", pid, err)
+		}
+
+		allFiles = append(allFiles, pidFiles...)
+		for _, f := range pidFiles {
+			cookie, err := socketCookie(f)
+			if err != nil {
+				return fmt.Errorf("pid %d: %w", pid, err)
+			}
+
+			if !seen[cookie] {
+				seen[cookie] = true
+				files = append(files, f)
+			}
+		}
+	}
+
+	labels := make([]string, len(files))
+	for i := range labels {
+		labels[i] = label
+	}
+
+	if err := registerFiles(e, labels, files, false); err != nil {
+		return fmt.Errorf("cgroup %s: %w", set.Arg(0), err)
+	}
+
+	return nil
+}
+
+// cgroupProcs returns the processes which are members of a cgroup v2 or any
+// of its descendants.
+func cgroupProcs(path string) ([]int, error) {
+	var pids []int
+	err := filepath.WalkDir(path, func(dir string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			return nil
+		}
+
+		var data []byte
+		if err == nil {
+			data, err = os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+		}
+		if errors.Is(err, fs.ErrNotExist) && dir != path {
+			// The cgroup was removed while walking the hierarchy.
+			return filepath.SkipDir
+		} else if err != nil {
+			return fmt.Errorf("read cgroup processes: %w", err)
+		}
+
+		for _, line := range strings.Fields(string(data)) {
+			pid, err := strconv.Atoi(line)
+			if err != nil {
+				return fmt.Errorf("invalid pid %q in %s: %s", line, dir, err)
+			}
+			pids = append(pids, pid)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pids, nil
+}
+
+func registerProcess(e *env, pid int, label string, procs []pidfd.ProcessPredicate, filter []sysconn.Predicate, newest bool) error {
+	files, err := processFiles(e, pid, procs, filter)
+	if err != nil {
+		return err
 	}
 
 	defer func() {
@@ -125,14 +490,76 @@ func registerPID(e *env, args ...string) error {
 		}
 	}()
 
-	if err := registerFiles(e, label, files); err != nil {
+	if newest {
+		files, err = newestReuseport(files)
+		if err != nil {
+			return fmt.Errorf("pid %d: %w", pid, err)
+		}
+	}
+
+	labels := make([]string, len(files))
+	for i := range labels {
+		labels[i] = label
+	}
+
+	if err := registerFiles(e, labels, files, false); err != nil {
 		return fmt.Errorf("pid %d: %w", pid, err)
 	}
 
 	return nil
 }
 
-func registerFiles(e *env, label string, files []*os.File) error {
+// newestReuseport keeps the most recently created socket of each reuseport
+// group in files, and closes the others.
+func newestReuseport(files []*os.File) ([]*os.File, error) {
+	conns := make([]syscall.Conn, 0, len(files))
+	for _, f := range files {
+		conns = append(conns, f)
+	}
+
+	kept, err := sysconn.ReuseportBy(conns, func(fd int) (int, error) {
+		// Socket cookies are allocated in increasing order, so the newest
+		// socket has the highest cookie.
+		cookie, err := unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
+		return -int(cookie), err
+	})
+	if err != nil {
+		return files, err
+	}
+
+	keep := make(map[*os.File]bool)
+	for _, conn := range kept {
+		keep[conn.(*os.File)] = true
+	}
+
+	var result []*os.File
+	for _, f := range files {
+		if keep[f] {
+			result = append(result, f)
+		} else {
+			f.Close()
+		}
+	}
+	return result, nil
+}
+
+// processFiles returns the files of a process in the same network namespace
+// as the dispatcher.
+func processFiles(e *env, pid int, procs []pidfd.ProcessPredicate, filter []sysconn.Predicate) ([]*os.File, error) {
+	if err := namespacesEqual(e.netns, fmt.Sprintf("/proc/%d/ns/net", pid)); err != nil {
+		return nil, err
+	}
+
+	files, err := pidfd.FilesOf(pid, procs, filter...)
+	if err != nil {
+		return nil, fmt.Errorf("pid %d: %w", pid, err)
+	}
+
+	return files, nil
+}
+
+// registerFiles registers each file under the label with the same index.
+func registerFiles(e *env, labels []string, files []*os.File, dualStack bool) error {
 	if len(files) == 0 {
 		return fmt.Errorf("no sockets: %w", errBadArg)
 	}
@@ -143,27 +570,27 @@ func registerFiles(e *env, label string, files []*os.File) error {
 	}
 	defer dp.Close()
 
-	registered := make(map[internal.Destination]bool)
+	conns := make([]syscall.Conn, 0, len(files))
 	for _, file := range files {
-		dst, created, err := dp.RegisterSocket(label, file)
-		if err != nil {
-			return fmt.Errorf("register fd: %w", err)
-		}
-
-		if registered[*dst] {
-			return fmt.Errorf("found multiple sockets for destination %s", dst)
-		}
-		registered[*dst] = true
+		conns = append(conns, file)
+	}
 
-		var msg string
-		if created {
-			msg = fmt.Sprintf("created destination %s", dst.String())
-		} else {
-			msg = fmt.Sprintf("updated destination %s", dst.String())
+	dsts, created, err := dp.RegisterSockets(labels, conns, dualStack)
+	for i, created := range created {
+		cookie, _ := socketCookie(files[i])
+		for j, dst := range dsts[i] {
+			var msg string
+			if created[j] {
+				msg = fmt.Sprintf("created destination %s", dst.String())
+			} else {
+				msg = fmt.Sprintf("updated destination %s", dst.String())
+			}
+
+			e.stdout.Logf("registered socket %s: %s\n", cookie, msg)
 		}
-
-		cookie, _ := socketCookie(file)
-		e.stdout.Logf("registered socket %s: %s\n", cookie, msg)
+	}
+	if err != nil {
+		return fmt.Errorf("register fd: %w", err)
 	}
 
 	return nil
@@ -171,42 +598,156 @@ func registerFiles(e *env, label string, files []*os.File) error {
 
 // Returns os.File for the first FD passed with systemd protocol for socket
 // activation. Only LISTEN_FDS environment variable is taken into
-// account. LISTEN_PID is ignored. LISTEN_FDNAMES are also ignored, name passed
-// as an argument is used instead.  See sd_listen_fds(3) man-page for more info.
-func listenFds(e *env, p sysconn.Predicate) (res []*os.File, err error) {
+// account. LISTEN_PID is ignored. LISTEN_FDNAMES is used to name the files if
+// useNames is true, and ignored otherwise. See sd_listen_fds(3) man-page for
+// more info.
+//
+// The environment is ignored if fds is not empty, and fds are used instead.
+//
+// Also returns the size of the reuseport group of each file, counting the
+// sockets which were dropped by p.
+func listenFds(e *env, fds []int, p sysconn.Predicate, useNames bool) (res []*os.File, groupSizes []int, err error) {
+	var conns []syscall.Conn
 	defer func() {
 		if err == nil {
 			return
 		}
 
-		for _, f := range res {
-			f.Close()
+		for _, conn := range conns {
+			conn.(*os.File).Close()
 		}
-		res = nil
 	}()
 
-	// 1. Check LISTEN_FDS value
-	listenFds := e.getenv("LISTEN_FDS")
-	nfds, err := strconv.Atoi(listenFds)
-	if err != nil {
-		return nil, fmt.Errorf("parse LISTEN_FDS=%q: %w", listenFds, errBadArg)
+	if len(fds) == 0 {
+		// 1. Check LISTEN_FDS value
+		listenFds := e.getenv("LISTEN_FDS")
+		nfds, err := strconv.Atoi(listenFds)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse LISTEN_FDS=%q: %w", listenFds, errBadArg)
+		}
+
+		for i := 0; i < nfds; i++ {
+			fds = append(fds, listenFdsStart+i)
+		}
 	}
 
-	for i := 0; i < nfds; i++ {
-		file := e.newFile(uintptr(listenFdsStart+i), "")
+	names := make([]string, len(fds))
+	if useNames {
+		names, err = listenFdNames(e, len(fds))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for i, fd := range fds {
+		file := e.newFile(uintptr(fd), names[i])
 		if file == nil {
-			return nil, errBadFD // Can't happen on Linux if 0 <= fd <= MaxInt
+			return nil, nil, errBadFD // Can't happen on Linux if 0 <= fd <= MaxInt
 		}
-		if keep, err := sysconn.FilterConn(file, p); err != nil {
-			file.Close()
-			return nil, err
-		} else if !keep {
-			file.Close()
-			continue
+		conns = append(conns, file)
+
+		err := sysconn.Control(file, func(raw int) error {
+			_, err := unix.FcntlInt(uintptr(raw), unix.F_GETFD, 0)
+			return err
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("fd %d: %w", fd, err)
+		}
+	}
+
+	kept, dropped, err := sysconn.Partition(conns, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groupSizes = reuseportGroupSizes(kept, dropped)
+
+	for _, conn := range dropped {
+		conn.(*os.File).Close()
+	}
+
+	if len(dropped) > 0 {
+		e.stderr.Logf("ignored %d of %d sockets\n", len(dropped), len(conns))
+	}
+
+	for _, conn := range kept {
+		res = append(res, conn.(*os.File))
+	}
+	return res, groupSizes, nil
+}
+
+// reuseportGroupSizes returns the number of sockets from kept and dropped
+// which share the protocol and local address of each kept socket.
+func reuseportGroupSizes(kept, dropped []syscall.Conn) []int {
+	groups := make(map[string]int)
+	for _, conn := range dropped {
+		if group, err := reuseportGroup(conn); err == nil {
+			groups[group]++
+		}
+	}
+
+	sizes := make([]int, len(kept))
+	for i, conn := range kept {
+		sizes[i] = 1
+		if group, err := reuseportGroup(conn); err == nil {
+			sizes[i] += groups[group]
 		}
-		res = append(res, file)
 	}
-	return res, nil
+	return sizes
+}
+
+func reuseportGroup(conn syscall.Conn) (string, error) {
+	var group string
+	err := sysconn.Control(conn, func(fd int) error {
+		proto, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PROTOCOL)
+		if err != nil {
+			return err
+		}
+
+		sa, err := unix.Getsockname(fd)
+		if err != nil {
+			return err
+		}
+
+		group = fmt.Sprintf("%d %+v", proto, sa)
+		return nil
+	})
+	return group, err
+}
+
+// listenFdNames parses LISTEN_FDNAMES, which must contain a name for each of
+// the nfds sockets.
+func listenFdNames(e *env, nfds int) ([]string, error) {
+	listenFdNames := e.getenv("LISTEN_FDNAMES")
+	if listenFdNames == "" {
+		return nil, fmt.Errorf("LISTEN_FDNAMES is not set: %w", errBadArg)
+	}
+
+	names := strings.Split(listenFdNames, ":")
+	if len(names) != nfds {
+		return nil, fmt.Errorf("LISTEN_FDNAMES=%q contains %d names instead of %d: %w", listenFdNames, len(names), nfds, errBadArg)
+	}
+
+	for i, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("LISTEN_FDNAMES=%q: name %d is empty: %w", listenFdNames, i, errBadArg)
+		}
+	}
+
+	return names, nil
+}
+
+// parseFds parses a comma separated list of file descriptors.
+func parseFds(list string) ([]int, error) {
+	var fds []int
+	for _, field := range strings.Split(list, ",") {
+		fd, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("%w: invalid file descriptor %q", errBadArg, field)
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
 }
 
 func socketCookie(conn syscall.Conn) (internal.SocketCookie, error) {
@@ -222,20 +763,37 @@ func socketCookie(conn syscall.Conn) (internal.SocketCookie, error) {
 }
 
 func namespacesEqual(want, have string) error {
-	var stat unix.Stat_t
-	if err := unix.Stat(want, &stat); err != nil {
+	wantID, err := namespaceID(want)
+	if err != nil {
 		return err
 	}
-	wantIno := stat.Ino
 
-	if err := unix.Stat(have, &stat); err != nil {
+	haveID, err := namespaceID(have)
+	if err != nil {
 		return err
 	}
-	haveIno := stat.Ino
 
-	if wantIno != haveIno {
-		return errors.New("can't register sockets from different network namespace")
+	if wantID != haveID {
+		return fmt.Errorf("can't register sockets from different network namespace: %s is %s, but %s is %s", want, wantID, have, haveID)
 	}
 
 	return nil
 }
+
+// nsID identifies a namespace. Inode numbers are only unique per device.
+type nsID struct {
+	dev uint64
+	ino uint64
+}
+
+func namespaceID(path string) (nsID, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return nsID{}, fmt.Errorf("stat namespace: %w", err)
+	}
+	return nsID{uint64(stat.Dev), stat.Ino}, nil
+}
+
+func (id nsID) String() string {
+	return fmt.Sprintf("dev %d:%d inode %d", unix.Major(id.dev), unix.Minor(id.dev), id.ino)
+}
@@ -1,21 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/pidfd"
 	"github.com/cloudflare/tubular/internal/sysconn"
 	"github.com/cloudflare/tubular/internal/testutil"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
 func TestSingleRegisterCommand(t *testing.T) {
@@ -38,7 +44,7 @@ func TestSingleRegisterCommand(t *testing.T) {
 	}
 
 	check := func(t *testing.T, dp *internal.Dispatcher, fds testFds) {
-		dests := destinations(t, dp)
+		dests := destinationsByCookie(t, dp)
 		if len(dests) != len(fds) {
 			t.Fatalf("expected %v registered destination(s), have %v", len(fds), len(dests))
 		}
@@ -186,6 +192,21 @@ func TestRegisterPID(t *testing.T) {
 		tubectl.MustRun(t)
 	})
 
+	t.Run("comm", func(t *testing.T) {
+		tubectl := tubectlTestCall{
+			NetNS:  netns,
+			ExecNS: netns,
+			Cmd:    "register-pid",
+			Args:   []string{"-comm", "cat", fmt.Sprint(child), "my-service", "tcp", "127.0.0.1", "8080"},
+		}
+		tubectl.MustRun(t)
+
+		tubectl.Args[1] = "dog"
+		if _, err := tubectl.Run(t); !errors.Is(err, pidfd.ErrProcessMismatch) {
+			t.Error("Expected ErrProcessMismatch, got", err)
+		}
+	})
+
 	t.Run("not found", func(t *testing.T) {
 		tubectl := tubectlTestCall{
 			NetNS:  netns,
@@ -215,7 +236,476 @@ func TestRegisterPID(t *testing.T) {
 	}
 }
 
-func destinations(tb testing.TB, dp *internal.Dispatcher) map[internal.SocketCookie]internal.Destination {
+func TestRegisterPIDReuseportNewest(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	var files []*os.File
+	for _, conn := range testutil.ReuseportGroup(t, netns, "tcp4", 3) {
+		file, err := conn.(filer).File()
+		if err != nil {
+			t.Fatal("File:", err)
+		}
+		defer file.Close()
+		files = append(files, file)
+	}
+
+	var child int
+	testutil.JoinNetNS(t, netns, func() error {
+		child = testutil.SpawnChildWithFiles(t, files...)
+		return nil
+	})
+
+	tubectl := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "register-pid",
+		Args:   []string{"-reuseport-newest", fmt.Sprint(child), "my-service", "tcp", "any", "0"},
+	}
+	tubectl.MustRun(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	defer dp.Close()
+
+	dests := destinationsByCookie(t, dp)
+	if len(dests) != 1 {
+		t.Fatalf("Expected one registered socket, got %d", len(dests))
+	}
+
+	// The last socket of the group was created most recently.
+	if cookie := mustSocketCookie(t, files[2]); dests[cookie] == (internal.Destination{}) {
+		t.Error("Registered socket isn't the newest one of the group")
+	}
+}
+
+func TestRegisterCgroup(t *testing.T) {
+	cgroup := mustCreateCgroup(t)
+	child := mustCreateChildCgroup(t, cgroup)
+	netns := mustReadyNetNS(t)
+
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	conn := testutil.Listen(t, netns, "tcp4", "127.0.0.1:8080")
+	file, err := conn.(filer).File()
+	if err != nil {
+		t.Fatal("File:", err)
+	}
+	defer file.Close()
+
+	moveTo := func(cgroup string, pid int) {
+		t.Helper()
+
+		err := os.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(fmt.Sprint(pid)), 0)
+		if err != nil {
+			t.Fatal("Can't move process into cgroup:", err)
+		}
+	}
+
+	testutil.JoinNetNS(t, netns, func() error {
+		// Two processes share the socket, as if it was inherited across
+		// fork. One of them is in a descendant cgroup.
+		moveTo(cgroup, testutil.SpawnChildWithFiles(t))
+		moveTo(cgroup, testutil.SpawnChildWithFiles(t, file))
+		moveTo(child, testutil.SpawnChildWithFiles(t, file))
+		return nil
+	})
+
+	tubectl := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "register-cgroup",
+		Args:   []string{cgroup, "my-service", "tcp", "127.0.0.1", "8080"},
+	}
+	tubectl.MustRun(t)
+
+	dests := destinationsByCookie(t, mustOpenDispatcher(t, netns))
+	if dest, ok := dests[mustSocketCookie(t, file)]; !ok || dest.Label != "my-service" {
+		t.Error("Socket isn't registered under my-service")
+	}
+
+	tubectl.Args = []string{"-comm", "dog", cgroup, "my-service", "tcp", "127.0.0.1", "8080"}
+	if _, err := tubectl.Run(t); !errors.Is(err, errBadArg) {
+		t.Error("Expected errBadArg when no process matches, got", err)
+	}
+}
+
+// mustCreateCgroup creates a cgroup v2 which is removed at the end of the
+// test. Skips the test if cgroup v2 isn't mounted.
+func mustCreateCgroup(tb testing.TB) string {
+	tb.Helper()
+
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var root string
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				root = fields[4]
+			}
+		}
+		if root != "" {
+			break
+		}
+	}
+	if root == "" {
+		tb.Skip("cgroup v2 is not mounted")
+	}
+
+	return mustCreateChildCgroup(tb, root)
+}
+
+// mustCreateChildCgroup creates a cgroup below parent which is removed at the
+// end of the test.
+func mustCreateChildCgroup(tb testing.TB, parent string) string {
+	tb.Helper()
+
+	path, err := os.MkdirTemp(parent, "tubectl-test-")
+	if err != nil {
+		tb.Skip("Can't create cgroup:", err)
+	}
+
+	tb.Cleanup(func() {
+		// Processes may take a moment to leave the cgroup after being killed.
+		for deadline := time.Now().Add(time.Second); ; {
+			err := os.Remove(path)
+			if err == nil || time.Now().After(deadline) {
+				if err != nil {
+					tb.Error("Can't remove cgroup:", err)
+				}
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	return path
+}
+
+func TestRegisterPIDAnyAddress(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	var files []*os.File
+	for _, conn := range []syscall.Conn{
+		testutil.Listen(t, netns, "tcp4", "127.0.0.1:8080"),
+		testutil.Listen(t, netns, "tcp6", "[::1]:8443"),
+		testutil.Listen(t, netns, "udp4", "127.0.0.1:8053"),
+	} {
+		file, err := conn.(filer).File()
+		if err != nil {
+			t.Fatal("File:", err)
+		}
+		defer file.Close()
+		files = append(files, file)
+	}
+
+	var child int
+	testutil.JoinNetNS(t, netns, func() error {
+		child = testutil.SpawnChildWithFiles(t, files...)
+		return nil
+	})
+
+	tubectl := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "register-pid",
+		Args:   []string{fmt.Sprint(child), "my-service", "tcp", "any", "0"},
+	}
+	tubectl.MustRun(t)
+
+	dests := destinationsByCookie(t, mustOpenDispatcher(t, netns))
+	if len(dests) != 2 {
+		t.Fatal("Expected two registered sockets, got", len(dests))
+	}
+
+	for _, file := range files[:2] {
+		if _, ok := dests[mustSocketCookie(t, file)]; !ok {
+			t.Error("Socket isn't registered:", mustSocketCookie(t, file))
+		}
+	}
+}
+
+func TestRegisterManifest(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	spawn := func(network, address string) int {
+		conn := testutil.Listen(t, netns, network, address)
+		file, err := conn.(filer).File()
+		if err != nil {
+			t.Fatal("File:", err)
+		}
+		defer file.Close()
+
+		var child int
+		testutil.JoinNetNS(t, netns, func() error {
+			child = testutil.SpawnChildWithFiles(t, file)
+			return nil
+		})
+		return child
+	}
+
+	foo := spawn("tcp4", "127.0.0.1:8080")
+	bar := spawn("udp6", "[::1]:8053")
+
+	writeManifest := func(manifest registerManifestJSON) string {
+		path := filepath.Join(t.TempDir(), "manifest.json")
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for _, invalid := range []registerProcessJSON{
+		{"", foo, "tcp", "any", 0},
+		{"foo", 0, "tcp", "any", 0},
+		{"foo", foo, "sctp", "any", 0},
+		{"foo", foo, "tcp", "localhost", 0},
+		// bar doesn't have a TCP socket.
+		{"bar", bar, "tcp", "any", 0},
+		// The socket is already part of the first entry.
+		{"bar", bar, "udp", "any", 0},
+		// The socket is already part of the first entry, under another label.
+		{"baz", bar, "udp", "::1", 0},
+	} {
+		path := writeManifest(registerManifestJSON{
+			Processes: []registerProcessJSON{{"bar", bar, "udp", "::1", 8053}, invalid},
+		})
+
+		tubectl := tubectlTestCall{
+			NetNS:  netns,
+			ExecNS: netns,
+			Cmd:    "register-manifest",
+			Args:   []string{path},
+		}
+		if _, err := tubectl.Run(t); err == nil {
+			t.Errorf("Accepted invalid entry %+v", invalid)
+		}
+	}
+
+	dp := mustOpenDispatcher(t, netns)
+	if dests := destinationsByCookie(t, dp); len(dests) != 0 {
+		t.Fatal("Invalid manifest registered sockets")
+	}
+	dp.Close()
+
+	path := writeManifest(registerManifestJSON{
+		Processes: []registerProcessJSON{
+			{"foo", foo, "tcp", "127.0.0.1", 8080},
+			{"bar", bar, "udp", "any", 0},
+		},
+	})
+
+	tubectl := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "register-manifest",
+		Args:   []string{path},
+	}
+	tubectl.MustRun(t)
+
+	labels := make(map[string]bool)
+	for _, dest := range destinationsByCookie(t, mustOpenDispatcher(t, netns)) {
+		labels[dest.Label] = true
+	}
+
+	if !labels["foo"] || !labels["bar"] || len(labels) != 2 {
+		t.Error("Expected destinations for foo and bar, got", labels)
+	}
+}
+
+func TestRegisterDualStack(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	mustLoadDispatcher(t, netns)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "svc-label", internal.TCP, "127.0.0.1", 8080)
+	mustAddBinding(t, dp, "svc-label", internal.TCP, "::1", 8080)
+	dp.Close()
+
+	// Go creates dual-stack sockets when listening on the wildcard address.
+	ln := testutil.ListenAndEchoWithName(t, netns, "tcp", ":0", "dual")
+
+	tubectl := tubectlTestCall{
+		NetNS:    netns,
+		ExecNS:   netns,
+		Cmd:      "register",
+		Args:     []string{"-allow-dual-stack", "svc-label"},
+		Env:      testEnv{"LISTEN_FDS": "1"},
+		ExtraFds: testFds{ln},
+	}
+	tubectl.MustRun(t)
+
+	dp = mustOpenDispatcher(t, netns)
+	_, cookies, err := dp.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cookies); n != 2 {
+		t.Fatal("Expected two destinations, got", n)
+	}
+	for dest, cookie := range cookies {
+		if cookie != mustSocketCookie(t, ln) {
+			t.Errorf("Destination %s doesn't have the dual-stack socket", &dest)
+		}
+	}
+
+	testutil.CanDialName(t, netns, "tcp4", "127.0.0.1:8080", "dual")
+	testutil.CanDialName(t, netns, "tcp6", "[::1]:8080", "dual")
+}
+
+func TestRegisterReuseportGroupSize(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	fds := testFds(testutil.ReuseportGroup(t, netns, "tcp4", 4))
+	fds = append(fds, makeListeningSocket(t, netns, "udp4"))
+
+	tubectl := tubectlTestCall{
+		NetNS:    netns,
+		ExecNS:   netns,
+		Cmd:      "register",
+		Args:     []string{"svc-label"},
+		Env:      testEnv{"LISTEN_FDS": "5"},
+		ExtraFds: fds,
+	}
+	output := tubectl.MustRun(t)
+
+	if n := strings.Count(output.String(), "collapsed reuseport group"); n != 1 {
+		t.Fatal("Expected one collapsed group, got", n)
+	}
+	if !strings.Contains(output.String(), "registered svc-label: collapsed reuseport group of 4") {
+		t.Error("Output doesn't mention the size of the reuseport group")
+	}
+}
+
+func TestRegisterExplicitFds(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	tcp := makeListeningSocket(t, netns, "tcp4")
+	udp := makeListeningSocket(t, netns, "udp4")
+
+	tubectl := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "register",
+		Args:   []string{"-fds", "3,5", "svc-label"},
+		// LISTEN_FDS is ignored when -fds is given.
+		Env:      testEnv{"LISTEN_FDS": "invalid"},
+		ExtraFds: testFds{tcp, nil, udp},
+	}
+	tubectl.MustRun(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	_, cookies, err := dp.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[internal.SocketCookie]bool{
+		mustSocketCookie(t, tcp): true,
+		mustSocketCookie(t, udp): true,
+	}
+	for dest, cookie := range cookies {
+		if !want[cookie] {
+			t.Errorf("Destination %s has unexpected socket %v", &dest, cookie)
+		}
+		delete(want, cookie)
+	}
+	if len(want) > 0 {
+		t.Error("Sockets weren't registered:", want)
+	}
+
+	for _, tc := range []struct {
+		fds  string
+		want error
+	}{
+		{"3,foo", errBadArg},
+		{"-1", errBadArg},
+		{"4", errBadFD},
+	} {
+		tubectl.Args = []string{"-fds", tc.fds, "svc-label"}
+		if _, err := tubectl.Run(t); !errors.Is(err, tc.want) {
+			t.Errorf("Expected %v for -fds %s, got %v", tc.want, tc.fds, err)
+		}
+	}
+}
+
+func TestRegisterFdNames(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		labels []string
+	}{
+		{"prefixed", []string{"-use-fdnames", "svc"}, []string{"svc/http", "svc/dns"}},
+		{"unprefixed", []string{"-use-fdnames"}, []string{"http", "dns"}},
+		{"ignored", []string{"svc"}, []string{"svc", "svc"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			netns := mustReadyNetNS(t)
+			fds := testFds{makeListeningSocket(t, netns, "tcp4"), makeListeningSocket(t, netns, "udp6")}
+
+			tubectl := tubectlTestCall{
+				NetNS:    netns,
+				ExecNS:   netns,
+				Cmd:      "register",
+				Args:     tc.args,
+				Env:      testEnv{"LISTEN_FDS": "2", "LISTEN_FDNAMES": "http:dns"},
+				ExtraFds: fds,
+			}
+			tubectl.MustRun(t)
+
+			dests := destinationsByCookie(t, mustOpenDispatcher(t, netns))
+			for i, f := range fds {
+				dest, ok := dests[mustSocketCookie(t, f)]
+				if !ok {
+					t.Fatalf("Socket %d isn't registered", i)
+				}
+				if dest.Label != tc.labels[i] {
+					t.Errorf("Socket %d has label %q instead of %q", i, dest.Label, tc.labels[i])
+				}
+			}
+		})
+	}
+
+	for _, names := range []string{"", "http", "http:dns:extra", "http:"} {
+		t.Run("invalid "+strconv.Quote(names), func(t *testing.T) {
+			netns := mustReadyNetNS(t)
+
+			tubectl := tubectlTestCall{
+				NetNS:    netns,
+				ExecNS:   netns,
+				Cmd:      "register",
+				Args:     []string{"-use-fdnames", "svc"},
+				Env:      testEnv{"LISTEN_FDS": "2", "LISTEN_FDNAMES": names},
+				ExtraFds: testFds{makeListeningSocket(t, netns, "tcp4"), makeListeningSocket(t, netns, "udp6")},
+			}
+			if _, err := tubectl.Run(t); !errors.Is(err, errBadArg) {
+				t.Fatal("Expected errBadArg, got", err)
+			}
+		})
+	}
+}
+
+func destinationsByCookie(tb testing.TB, dp *internal.Dispatcher) map[internal.SocketCookie]internal.Destination {
 	tb.Helper()
 
 	_, cookies, err := dp.Destinations()
@@ -241,6 +731,60 @@ func mustSocketCookie(tb testing.TB, conn syscall.Conn) internal.SocketCookie {
 	return cookie
 }
 
+func TestRegisterUnsupportedSocket(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	for _, tc := range []struct {
+		name               string
+		domain, typ, proto int
+	}{
+		{"raw4", unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_ICMP},
+		{"raw6", unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_ICMPV6},
+		{"sctp4", unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_SCTP},
+		{"sctp6 seqpacket", unix.AF_INET6, unix.SOCK_SEQPACKET, unix.IPPROTO_SCTP},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sk := makeSocket(t, netns, tc.domain, tc.typ, tc.proto)
+
+			tubectl := tubectlTestCall{
+				NetNS:    netns,
+				ExecNS:   netns,
+				Cmd:      "register",
+				Args:     []string{"svc-label"},
+				Env:      testEnv{"LISTEN_FDS": "1"},
+				ExtraFds: testFds{sk},
+			}
+
+			_, err := tubectl.Run(t)
+			if !errors.Is(err, internal.ErrUnsupportedSocket) {
+				t.Fatal("Expected ErrUnsupportedSocket, got", err)
+			}
+		})
+	}
+}
+
+// makeSocket creates a socket in netns, or skips the test if the kernel
+// doesn't allow it.
+func makeSocket(tb testing.TB, netns ns.NetNS, domain, typ, proto int) syscall.Conn {
+	tb.Helper()
+
+	var (
+		fd  int
+		err error
+	)
+	testutil.JoinNetNS(tb, netns, func() error {
+		fd, err = unix.Socket(domain, typ, proto)
+		return nil
+	}, cap.NET_RAW)
+	if err != nil {
+		tb.Skip("Can't create socket:", err)
+	}
+
+	file := os.NewFile(uintptr(fd), "socket")
+	tb.Cleanup(func() { file.Close() })
+	return file
+}
+
 func makeNonSocket(tb testing.TB) syscall.Conn {
 	tb.Helper()
 
@@ -336,3 +880,27 @@ func TestRegisterRefuseDifferentNamespace(t *testing.T) {
 		t.Error("Didn't refuse a socket from a different namespace")
 	}
 }
+
+func TestRegisterPIDRefuseDifferentNamespace(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	// The child runs in the namespace of the test, not in netns.
+	child := testutil.SpawnChildWithFiles(t)
+
+	tubectl := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "register-pid",
+		Args:   []string{fmt.Sprint(child), "my-service", "tcp", "any", "0"},
+	}
+	_, err := tubectl.Run(t)
+	if err == nil {
+		t.Fatal("Didn't refuse a process from a different namespace")
+	}
+
+	for _, want := range []string{netns.Path(), fmt.Sprintf("/proc/%d/ns/net", child), "inode"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error doesn't contain %q: %s", want, err)
+		}
+	}
+}
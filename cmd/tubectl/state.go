@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/log"
+
+	"inet.af/netaddr"
+)
+
+type stateJSON struct {
+	Bindings     []stateBindingJSON     `json:"bindings"`
+	Destinations []stateDestinationJSON `json:"destinations"`
+}
+
+// stateBindingJSON is a single binding. Unlike bindingJSON it includes the
+// protocol, so that the state can be restored exactly.
+type stateBindingJSON struct {
+	Label    string           `json:"label"`
+	Protocol string           `json:"protocol"`
+	Prefix   netaddr.IPPrefix `json:"prefix"`
+	Port     uint16           `json:"port"`
+}
+
+type stateDestinationJSON struct {
+	Label    string `json:"label"`
+	Domain   string `json:"domain"`
+	Protocol string `json:"protocol"`
+}
+
+func exportState(e *env, args ...string) error {
+	set := e.newFlagSet("export-state")
+	set.Description = `
+		Write the state of the dispatcher to stdout as JSON.
+
+		The state contains all bindings and destinations, and can be
+		restored on a different host using import-state. Sockets can't be
+		exported.
+
+		Examples:
+		  $ tubectl export-state > state.json`
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	var (
+		bindings internal.Bindings
+		dests    []internal.Destination
+	)
+	{
+		dp, err := e.openDispatcher(true)
+		if err != nil {
+			return err
+		}
+		defer dp.Close()
+
+		bindings, err = dp.Bindings()
+		if err != nil {
+			return fmt.Errorf("get bindings: %s", err)
+		}
+
+		dests, _, err = dp.Destinations()
+		if err != nil {
+			return fmt.Errorf("get destinations: %s", err)
+		}
+
+		dp.Close()
+	}
+
+	sort.Sort(bindings)
+	sortDestinations(dests)
+
+	state := stateJSON{
+		Bindings:     []stateBindingJSON{},
+		Destinations: []stateDestinationJSON{},
+	}
+	for _, bind := range bindings {
+		state.Bindings = append(state.Bindings, stateBindingJSON{
+			bind.Label,
+			bind.Protocol.String(),
+			bind.Prefix,
+			bind.Port,
+		})
+	}
+	for _, dest := range dests {
+		state.Destinations = append(state.Destinations, stateDestinationJSON{
+			dest.Label,
+			dest.Domain.String(),
+			dest.Protocol.String(),
+		})
+	}
+
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&state)
+}
+
+func importState(e *env, args ...string) error {
+	set := e.newFlagSet("import-state", "file")
+	set.Description = `
+		Replace the bindings of the dispatcher with the ones from a file
+		created by export-state. The file is read from standard input if
+		file is "-".
+
+		Sockets aren't part of the state, services have to register
+		them again.
+
+		Examples:
+		  $ tubectl import-state state.json`
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	var (
+		state stateJSON
+		err   error
+	)
+	if path := set.Arg(0); path == "-" {
+		err = decodeState(e.stdin, "stdin", &state)
+	} else {
+		var file *os.File
+		file, err = os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		err = decodeState(file, file.Name(), &state)
+	}
+	if err != nil {
+		return err
+	}
+
+	var bindings internal.Bindings
+	for _, bind := range state.Bindings {
+		var proto internal.Protocol
+		if err := proto.UnmarshalText([]byte(bind.Protocol)); err != nil {
+			return fmt.Errorf("binding %s: %s", bind.Label, err)
+		}
+
+		bindings = append(bindings, &internal.Binding{
+			Label:    bind.Label,
+			Prefix:   bind.Prefix.Masked(),
+			Protocol: proto,
+			Port:     bind.Port,
+		})
+	}
+
+	for _, dest := range state.Destinations {
+		var domain internal.Domain
+		if err := domain.UnmarshalText([]byte(dest.Domain)); err != nil {
+			return fmt.Errorf("destination %s: %s", dest.Label, err)
+		}
+
+		var proto internal.Protocol
+		if err := proto.UnmarshalText([]byte(dest.Protocol)); err != nil {
+			return fmt.Errorf("destination %s: %s", dest.Label, err)
+		}
+	}
+
+	dp, err := e.openDispatcher(false)
+	if err != nil {
+		return err
+	}
+	defer dp.Close()
+
+	added, removed, err := dp.ReplaceBindings(bindings)
+	if err != nil {
+		return err
+	}
+
+	for _, bind := range added {
+		log.Fields(e.stdout, "added", "binding", bind)
+	}
+	for _, bind := range removed {
+		log.Fields(e.stdout, "removed", "binding", bind)
+	}
+
+	for _, dest := range state.Destinations {
+		e.stdout.Logf("socket for %s:%s:%s must be registered again\n", dest.Domain, dest.Protocol, dest.Label)
+	}
+
+	return nil
+}
+
+func decodeState(r io.Reader, name string, state *stateJSON) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(state); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/log"
+	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExportImportState(t *testing.T) {
+	netns := mustReadyNetNS(t)
+	mustTestTubectl(t, netns, "load-bindings", "testdata/bindings.json")
+
+	dp := mustOpenDispatcher(t, netns)
+	mustRegisterSocket(t, dp, "foo", makeListeningSocket(t, netns, "tcp4"))
+	dp.Close()
+
+	state := mustRoundTripState(t, netns)
+	if len(state.Destinations) == 0 {
+		t.Error("State doesn't contain destinations")
+	}
+}
+
+func TestExportImportStateProtocol(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "tcp-only", internal.TCP, "127.0.0.1", 80)
+	mustAddBinding(t, dp, "udp-only", internal.UDP, "::1", 53)
+	dp.Close()
+
+	mustRoundTripState(t, netns)
+}
+
+// mustRoundTripState exports the state of netns, imports it into a fresh
+// namespace and checks that the bindings match.
+func mustRoundTripState(tb testing.TB, netns ns.NetNS) *stateJSON {
+	tb.Helper()
+
+	dp := mustOpenDispatcher(tb, netns)
+	want, err := dp.Bindings()
+	if err != nil {
+		tb.Fatal("Can't get bindings:", err)
+	}
+	dp.Close()
+
+	var stdout log.Buffer
+	export := tubectlTestCall{
+		NetNS:  netns,
+		Cmd:    "export-state",
+		Stdout: &stdout,
+	}
+	export.MustRun(tb)
+
+	var state stateJSON
+	if err := json.Unmarshal(stdout.Bytes(), &state); err != nil {
+		tb.Fatalf("Can't decode output: %s\n%s", err, stdout.String())
+	}
+
+	path := filepath.Join(tb.TempDir(), "state.json")
+	if err := os.WriteFile(path, stdout.Bytes(), 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	fresh := mustReadyNetNS(tb)
+	mustTestTubectl(tb, fresh, "import-state", path)
+
+	have, err := mustOpenDispatcher(tb, fresh).Bindings()
+	if err != nil {
+		tb.Fatal("Can't get bindings:", err)
+	}
+
+	sort.Sort(want)
+	sort.Sort(have)
+	if diff := cmp.Diff(want, have, testutil.IPPrefixComparer()); diff != "" {
+		tb.Errorf("Bindings don't match (-want +got):\n%s", diff)
+	}
+
+	return &state
+}
+
+func TestImportStateInvalid(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	for name, state := range map[string]string{
+		"unknown field":    `{"foo": []}`,
+		"invalid domain":   `{"destinations": [{"label": "foo", "domain": "ipv5", "protocol": "tcp"}]}`,
+		"invalid binding":  `{"bindings": [{"label": "foo", "protocol": "sctp", "prefix": "127.0.0.1/32", "port": 80}]}`,
+		"invalid protocol": `{"destinations": [{"label": "foo", "domain": "ipv4", "protocol": "sctp"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if err := os.WriteFile(path, []byte(state), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := testTubectl(t, netns, "import-state", path); err == nil {
+				t.Error("import-state accepts invalid state")
+			}
+		})
+	}
+}
@@ -2,18 +2,29 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
 	"github.com/cloudflare/tubular/internal"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 )
 
 func list(e *env, args ...string) error {
@@ -23,16 +34,65 @@ func list(e *env, args ...string) error {
 
 func status(e *env, args ...string) error {
 	set := e.newFlagSet("status", "--", "label")
-	set.Description = "Show current bindings and destinations."
+	set.Description = `
+		Show current bindings and destinations.
+
+		Use -per-cpu to show the counters of each destination for every
+		CPU which has handled traffic, for example to find out whether one
+		CPU handles all lookups.
+
+		Examples:
+		  $ tubectl status
+		  $ tubectl status -watch 2s foo
+		  $ tubectl status -per-cpu`
+	watch := set.Duration("watch", 0, "Redraw the status every `interval` until interrupted.")
+	perCPU := set.Bool("per-cpu", false, "Show counters for each CPU.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
+	if *watch < 0 {
+		return fmt.Errorf("%w: negative watch interval", errBadArg)
+	}
+
+	if *watch == 0 {
+		return printStatus(e, set.Arg(0), *perCPU)
+	}
+
+	stop := e.cancelOnInterrupt()
+	defer stop()
+
+	ticker := time.NewTicker(*watch)
+	defer ticker.Stop()
+
+	for {
+		e.stdout.Logf("--- %s\n", time.Now().Format(time.RFC3339))
+		if err := printStatus(e, set.Arg(0), *perCPU); err != nil {
+			return err
+		}
+
+		select {
+		case <-e.ctx.Done():
+			return nil
+		case <-ticker.C:
+			e.stdout.Log()
+		}
+	}
+}
+
+func printStatus(e *env, label string, perCPU bool) error {
 	var (
 		bindings internal.Bindings
 		dests    []internal.Destination
 		cookies  map[internal.Destination]internal.SocketCookie
+		dead     = make(map[internal.Destination]bool)
 		metrics  *internal.Metrics
+		version  uint32
+
+		runs       uint64
+		avgRuntime time.Duration
+
+		metricsPerCPU map[internal.Destination][]internal.DestinationMetrics
 	)
 	{
 		dp, err := e.openDispatcher(true)
@@ -41,7 +101,11 @@ func status(e *env, args ...string) error {
 		}
 		defer dp.Close()
 
-		bindings, err = dp.Bindings()
+		if label != "" {
+			bindings, err = dp.BindingsForLabel(label)
+		} else {
+			bindings, err = dp.Bindings()
+		}
 		if err != nil {
 			return fmt.Errorf("can't get bindings: %s", err)
 		}
@@ -51,23 +115,56 @@ func status(e *env, args ...string) error {
 			return fmt.Errorf("get destinations: %s", err)
 		}
 
+		deadDests, err := dp.VerifySockets()
+		if err != nil {
+			return fmt.Errorf("verify sockets: %s", err)
+		}
+		for _, dest := range deadDests {
+			dead[dest] = true
+		}
+
 		metrics, err = dp.Metrics()
 		if err != nil {
 			return fmt.Errorf("get metrics: %s", err)
 		}
 
-		dp.Close()
-	}
+		for _, err := range metrics.Errors {
+			e.stderr.Log("Warning:", err)
+		}
 
-	if label := set.Arg(0); label != "" {
-		var filtered internal.Bindings
-		for _, bind := range bindings {
-			if bind.Label == label {
-				filtered = append(filtered, bind)
+		if perCPU {
+			metricsPerCPU, err = dp.MetricsPerCPU()
+			if err != nil {
+				return fmt.Errorf("get per-CPU metrics: %s", err)
 			}
 		}
-		bindings = filtered
 
+		version = dp.StateVersion()
+
+		runs, avgRuntime, err = dp.ProgramStats()
+		if err != nil {
+			e.stderr.Log("Warning: can't get program statistics:", err)
+		}
+
+		// Inspecting sockets in another namespace requires privileges, which
+		// a plain status doesn't otherwise need.
+		conflicts, err := dp.CheckReuseportConsistency()
+		if err != nil && !errors.Is(err, os.ErrPermission) {
+			e.stderr.Log("Warning: can't check reuseport groups:", err)
+		}
+		for _, conflict := range conflicts {
+			var names []string
+			for _, dest := range conflict.Destinations {
+				names = append(names, dest.String())
+			}
+			e.stderr.Logf("Warning: reuseport group %s %s is registered under %s\n",
+				conflict.Protocol, conflict.Addr, strings.Join(names, ", "))
+		}
+
+		dp.Close()
+	}
+
+	if label != "" {
 		var filteredDests []internal.Destination
 		for _, dest := range dests {
 			if dest.Label == label {
@@ -79,6 +176,12 @@ func status(e *env, args ...string) error {
 
 	w := tabwriter.NewWriter(e.stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
 
+	e.stdout.Logf("State version: %d\n", version)
+	if metrics.ProgramStatsEnabled {
+		e.stdout.Logf("Program runs: %d (average %v)\n\n", runs, avgRuntime)
+	} else {
+		e.stdout.Logf("Program runs: unknown, enable BPF statistics with sysctl kernel.bpf_stats_enabled=1\n\n")
+	}
 	e.stdout.Log("Bindings:")
 	if err := printBindings(w, bindings); err != nil {
 		return err
@@ -87,10 +190,16 @@ func status(e *env, args ...string) error {
 	sortDestinations(dests)
 
 	e.stdout.Log("\nDestinations:")
-	fmt.Fprintln(w, "label\tdomain\tprotocol\tsocket\tlookups\tmisses\terrors\t")
+	fmt.Fprintln(w, "label\tdomain\tprotocol\tsocket\tlookups\tmisses\tmiss rate\terrors\twarning\t")
 
 	for _, dest := range dests {
 		destMetrics := metrics.Destinations[dest]
+
+		warning := ""
+		if dead[dest] {
+			warning = "no socket"
+		}
+
 		_, err := fmt.Fprint(w,
 			dest.Label, "\t",
 			dest.Domain, "\t",
@@ -98,7 +207,9 @@ func status(e *env, args ...string) error {
 			cookies[dest], "\t",
 			destMetrics.Lookups, "\t",
 			destMetrics.Misses, "\t",
+			missRate(destMetrics), "\t",
 			destMetrics.TotalErrors(), "\t",
+			warning, "\t",
 			"\n",
 		)
 		if err != nil {
@@ -110,7 +221,47 @@ func status(e *env, args ...string) error {
 		return err
 	}
 
-	return nil
+	if !perCPU {
+		return nil
+	}
+
+	e.stdout.Log("\nPer-CPU counters:")
+	fmt.Fprintln(w, "label\tdomain\tprotocol\tcpu\tlookups\tmisses\terrors\t")
+
+	for _, dest := range dests {
+		for cpu, destMetrics := range metricsPerCPU[dest] {
+			if destMetrics == (internal.DestinationMetrics{}) {
+				// Skip idle CPUs, there may be hundreds of them.
+				continue
+			}
+
+			_, err := fmt.Fprint(w,
+				dest.Label, "\t",
+				dest.Domain, "\t",
+				dest.Protocol, "\t",
+				cpu, "\t",
+				destMetrics.Lookups, "\t",
+				destMetrics.Misses, "\t",
+				destMetrics.TotalErrors(), "\t",
+				"\n",
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return w.Flush()
+}
+
+// missRate formats the fraction of lookups which didn't find a socket as a
+// percentage.
+func missRate(metrics internal.DestinationMetrics) string {
+	if metrics.Lookups == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.0f%%", float64(metrics.Misses)/float64(metrics.Lookups)*100)
 }
 
 func printBindings(w *tabwriter.Writer, bindings internal.Bindings) error {
@@ -145,49 +296,155 @@ func sortDestinations(dests []internal.Destination) {
 }
 
 func metrics(e *env, args ...string) error {
-	set := e.newFlagSet("metrics", "address", "port")
+	set := e.newFlagSet("metrics", "--", "address", "port")
 	set.Description = `
 		Expose metrics in prometheus export format.
 
 		Examples:
 		  $ tubectl metrics 127.0.0.1 8000
 		  THEN
-		  $ curl http://127.0.0.1:8000/metrics`
+		  $ curl http://127.0.0.1:8000/metrics
+
+		The prefix is applied to all tubular metrics, but not to build_info
+		or the runtime metrics of the exporter itself.
+
+		/healthz returns 200 if the dispatcher can be opened, and /readyz
+		returns 200 once metrics were collected at least once. Both return
+		503 otherwise.
+
+		Use -netns-glob to export metrics from the dispatchers in multiple
+		network namespaces. Each metric then carries a netns label with the
+		path of the namespace. Namespaces are discovered on startup.
+
+		Sending SIGHUP rebuilds the exported collectors without closing the
+		listener. This also discovers namespaces created since startup.
+
+		  $ tubectl metrics -netns-glob '/var/run/netns/*' 127.0.0.1 8000
+
+		Use -systemd instead of an address and port to serve metrics on a
+		listening socket passed via systemd socket activation.
+
+		  $ tubectl metrics -systemd
+
+		Use -dump instead of an address and port to write metrics to stdout
+		once, in the format given by -format.
+
+		  $ tubectl metrics -dump -format openmetrics`
 
 	timeout := set.Duration("timeout", 30*time.Second, "Duration to wait for an HTTP metrics request to complete.")
+	prefix := set.String("metric-prefix", "tubular_", "`Prefix` for the name of exported metrics.")
+	netnsGlob := set.String("netns-glob", "", "Export metrics for all network namespaces matching `pattern`.")
+	runtimeMetrics := set.Bool("runtime-metrics", true, "Export Go runtime and process metrics of the exporter.")
+	systemd := set.Bool("systemd", false, "Serve metrics on the socket passed by systemd in LISTEN_FDS.")
+	maxConns := set.Int("max-conns", 0, "Maximum `number` of concurrent connections, or 0 for no limit.")
+	dump := set.Bool("dump", false, "Write metrics to stdout once instead of serving them.")
+	format := set.String("format", "prometheus", "`Format` of -dump: prometheus, openmetrics or json.")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
-	address := set.Arg(0)
-	port := set.Arg(1)
+	if *maxConns < 0 {
+		return fmt.Errorf("%w: negative connection limit", errBadArg)
+	}
+
+	if *systemd && *dump {
+		return fmt.Errorf("%w: -systemd and -dump are mutually exclusive", errBadArg)
+	} else if (*systemd || *dump) && set.NArg() > 0 {
+		return fmt.Errorf("%w: -systemd and -dump don't take an address and port", errBadArg)
+	} else if !*systemd && !*dump && set.NArg() != 2 {
+		return fmt.Errorf("%w: expected address and port", errBadArg)
+	}
+
+	switch *format {
+	case "prometheus", "openmetrics", "json":
+	default:
+		return fmt.Errorf("%w: unknown format %q", errBadArg, *format)
+	}
+
+	if !validMetricPrefix(*prefix) {
+		return fmt.Errorf("%w: invalid metric prefix %q", errBadArg, *prefix)
+	}
 
 	if err := e.setupEnv(); err != nil {
 		return err
 	}
 
 	// Create an instance of the prometheus registry and register all collectors.
-	reg, err := tubularRegistry(e)
+	newRegistry := func() (*prometheus.Registry, []*internal.Collector, error) {
+		var netns []string
+		if *netnsGlob != "" {
+			var err error
+			netns, err = filepath.Glob(*netnsGlob)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: invalid netns glob: %s", errBadArg, err)
+			}
+
+			if len(netns) == 0 {
+				return nil, nil, fmt.Errorf("no network namespaces match %q", *netnsGlob)
+			}
+		}
+
+		return tubularRegistry(e, *prefix, netns, *runtimeMetrics)
+	}
+
+	reg, colls, err := newRegistry()
 	if err != nil {
 		return err
 	}
 
+	if *dump {
+		return dumpMetrics(e.stdout, reg, *format)
+	}
+
 	// Create TCP listener used for metrics endpoint.
-	ln, err := e.listen("tcp", fmt.Sprintf("%s:%s", address, port))
+	var ln net.Listener
+	if *systemd {
+		ln, err = systemdListener(e)
+	} else {
+		ln, err = e.listen("tcp", fmt.Sprintf("%s:%s", set.Arg(0), set.Arg(1)))
+	}
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
 
+	if *maxConns > 0 {
+		ln = newLimitListener(ln, *maxConns)
+	}
+
 	e.stdout.Log("Listening on", ln.Addr().String())
 
 	// Create an instance of the metrics server
-	srv := metricsServer(e.ctx, reg, timeout)
-
-	// Close the http server when the env context is closed.
+	handler := &metricsHandler{bpfFs: e.bpfFs}
+	handler.set(reg, colls, *timeout)
+	stop := e.cancelOnInterrupt()
+	defer stop()
+	srv := metricsServer(e.ctx, handler, timeout)
+
+	reload := make(chan os.Signal, 1)
+	e.notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	// Rebuild the registry on SIGHUP, and close the http server when the env
+	// context is closed.
 	go func() {
-		<-e.ctx.Done()
-		srv.Close()
+		for {
+			select {
+			case <-e.ctx.Done():
+				srv.Close()
+				return
+
+			case <-reload:
+				reg, colls, err := newRegistry()
+				if err != nil {
+					e.stderr.Log("Can't reload metrics:", err)
+					continue
+				}
+
+				handler.set(reg, colls, *timeout)
+				e.stdout.Log("Reloaded metrics")
+			}
+		}
 	}()
 
 	// Block on serving the metrics http server.
@@ -198,13 +455,91 @@ func metrics(e *env, args ...string) error {
 	return nil
 }
 
-func tubularRegistry(e *env) (*prometheus.Registry, error) {
+// dumpMetrics gathers metrics once and writes them to w.
+//
+// The json format is the JSON encoding of the MetricFamily protobuf messages.
+func dumpMetrics(w io.Writer, g prometheus.Gatherer, format string) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return fmt.Errorf("gather metrics: %s", err)
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(mfs)
+	}
+
+	expFormat := expfmt.FmtText
+	if format == "openmetrics" {
+		expFormat = expfmt.FmtOpenMetrics
+	}
+
+	enc := expfmt.NewEncoder(w, expFormat)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("encode metrics: %s", err)
+		}
+	}
+
+	if closer, ok := enc.(expfmt.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// systemdListener returns the first socket passed with the systemd protocol
+// for socket activation. Only LISTEN_FDS is taken into account, like for
+// register.
+func systemdListener(e *env) (net.Listener, error) {
+	listenFds := e.getenv("LISTEN_FDS")
+	nfds, err := strconv.Atoi(listenFds)
+	if err != nil || nfds < 1 {
+		return nil, fmt.Errorf("parse LISTEN_FDS=%q: %w", listenFds, errBadArg)
+	}
+
+	file := e.newFile(uintptr(listenFdsStart), "")
+	if file == nil {
+		return nil, errBadFD
+	}
+	defer file.Close()
+
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("listener from fd %d: %w", listenFdsStart, err)
+	}
+
+	return ln, nil
+}
+
+// tubularRegistry creates a registry with collectors for the dispatcher in
+// e.netns. If netns is not empty, a collector is registered for each of the
+// given namespaces instead, distinguished by a netns label.
+//
+// If runtimeMetrics is true the registry also exports metrics about the Go
+// runtime and the process, without prefix.
+//
+// Returns the registry and the collectors for each namespace.
+func tubularRegistry(e *env, prefix string, netns []string, runtimeMetrics bool) (*prometheus.Registry, []*internal.Collector, error) {
 	reg := prometheus.NewRegistry()
-	tubularReg := prometheus.WrapRegistererWithPrefix("tubular_", reg)
+	tubularReg := prometheus.WrapRegistererWithPrefix(prefix, reg)
+
+	var colls []*internal.Collector
+	if len(netns) == 0 {
+		coll := internal.NewCollector(e.stderr, e.netns, e.bpfFs)
+		if err := tubularReg.Register(coll); err != nil {
+			return nil, nil, fmt.Errorf("register collector: %s", err)
+		}
+		colls = append(colls, coll)
+	}
 
-	coll := internal.NewCollector(e.stderr, e.netns, e.bpfFs)
-	if err := tubularReg.Register(coll); err != nil {
-		return nil, fmt.Errorf("register collector: %s", err)
+	for _, path := range netns {
+		coll := internal.NewCollector(e.stderr, path, e.bpfFs)
+		nsReg := prometheus.WrapRegistererWith(prometheus.Labels{"netns": path}, tubularReg)
+		if err := nsReg.Register(coll); err != nil {
+			return nil, nil, fmt.Errorf("register collector for %s: %s", path, err)
+		}
+		colls = append(colls, coll)
 	}
 
 	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
@@ -217,21 +552,155 @@ func tubularRegistry(e *env) (*prometheus.Registry, error) {
 	})
 	buildInfo.Set(1)
 	if err := reg.Register(buildInfo); err != nil {
-		return nil, fmt.Errorf("register build info: %s", err)
+		return nil, nil, fmt.Errorf("register build info: %s", err)
+	}
+
+	if runtimeMetrics {
+		if err := reg.Register(prometheus.NewGoCollector()); err != nil {
+			return nil, nil, fmt.Errorf("register go collector: %s", err)
+		}
+
+		if err := reg.Register(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{})); err != nil {
+			return nil, nil, fmt.Errorf("register process collector: %s", err)
+		}
+	}
+	return reg, colls, nil
+}
+
+// validMetricPrefix checks that prefix only contains characters allowed at
+// the start of a prometheus metric name.
+func validMetricPrefix(prefix string) bool {
+	for i, r := range prefix {
+		switch {
+		case r == '_' || r == ':':
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9' && i > 0:
+		default:
+			return false
+		}
 	}
-	return reg, nil
+	return true
+}
+
+// metricsHandler serves metrics from a registry which can be swapped out
+// while requests are in flight.
+type metricsHandler struct {
+	bpfFs   string
+	handler atomic.Value
+	colls   atomic.Value
+	// Set to one once any collector was ready, accessed atomically.
+	ready uint32
 }
 
-func metricsServer(ctx context.Context, reg *prometheus.Registry, t *time.Duration) http.Server {
-	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+func (mh *metricsHandler) set(reg *prometheus.Registry, colls []*internal.Collector, timeout time.Duration) {
+	mh.handler.Store(promhttp.HandlerFor(reg, promhttp.HandlerOpts{
 		ErrorHandling:       promhttp.HTTPErrorOnError,
 		MaxRequestsInFlight: 1,
-		Timeout:             *t,
-	})
+		Timeout:             timeout,
+	}))
+	mh.colls.Store(colls)
+}
+
+func (mh *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mh.handler.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// healthz succeeds if the dispatcher of every exported namespace can be
+// opened.
+func (mh *metricsHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	for _, coll := range mh.colls.Load().([]*internal.Collector) {
+		dp, err := internal.OpenDispatcher(coll.NetNS(), mh.bpfFs, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		dp.Close()
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz succeeds once metrics were collected from any dispatcher. It stays
+// ready when the collectors are rebuilt.
+func (mh *metricsHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadUint32(&mh.ready) == 0 {
+		for _, coll := range mh.colls.Load().([]*internal.Collector) {
+			if coll.Ready() {
+				atomic.StoreUint32(&mh.ready, 1)
+				break
+			}
+		}
+	}
+
+	if atomic.LoadUint32(&mh.ready) == 0 {
+		http.Error(w, "no metrics collected yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+func metricsServer(ctx context.Context, handler *metricsHandler, t *time.Duration) http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handler.healthz)
+	mux.HandleFunc("/readyz", handler.readyz)
+	// Serve metrics on all other paths, like before health checks existed.
+	mux.Handle("/", handler)
 
 	return http.Server{
-		Handler:     handler,
+		Handler:     mux,
 		ReadTimeout: *t,
 		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 }
+
+// limitListener accepts at most a fixed number of concurrent connections.
+// Further calls to Accept block until an accepted connection is closed.
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(ln net.Listener, n int) *limitListener {
+	return &limitListener{
+		Listener: ln,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (ll *limitListener) Accept() (net.Conn, error) {
+	select {
+	case ll.sem <- struct{}{}:
+	case <-ll.done:
+		return nil, net.ErrClosed
+	}
+
+	conn, err := ll.Listener.Accept()
+	if err != nil {
+		<-ll.sem
+		return nil, err
+	}
+
+	return &limitListenerConn{Conn: conn, release: func() { <-ll.sem }}, nil
+}
+
+func (ll *limitListener) Close() error {
+	err := ll.Listener.Close()
+	ll.closeOnce.Do(func() { close(ll.done) })
+	return err
+}
+
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (lc *limitListenerConn) Close() error {
+	err := lc.Conn.Close()
+	lc.releaseOnce.Do(lc.release)
+	return err
+}
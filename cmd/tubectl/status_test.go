@@ -1,17 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/log"
 	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/cilium/ebpf"
 )
 
 func TestStatus(t *testing.T) {
@@ -38,6 +48,13 @@ func TestStatus(t *testing.T) {
 		t.Error("Output of status doesn't contain", cookie)
 	}
 
+	// The hint depends on the sysctl, not on whether the program ran yet.
+	sysctl, _ := os.ReadFile("/proc/sys/kernel/bpf_stats_enabled")
+	statsEnabled := strings.TrimSpace(string(sysctl)) == "1"
+	if hint := strings.Contains(outputStr, "enable BPF statistics"); hint == statsEnabled {
+		t.Errorf("Hint about BPF statistics is %v, but the sysctl is %v", hint, statsEnabled)
+	}
+
 	output2, err := testTubectl(t, netns, "status")
 	if err != nil {
 		t.Fatal(err)
@@ -51,6 +68,117 @@ func TestStatus(t *testing.T) {
 	}
 }
 
+func TestStatusPerCPU(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", internal.TCP, "127.0.0.1", 8080)
+	mustRegisterSocket(t, dp, "foo", testutil.ListenAndEchoWithName(t, netns, "tcp4", "127.0.0.1:0", "foo"))
+	dp.Close()
+
+	testutil.CanDialName(t, netns, "tcp4", "127.0.0.1:8080", "foo")
+
+	output := mustTestTubectl(t, netns, "status")
+	if strings.Contains(output.String(), "Per-CPU") {
+		t.Error("Output of status contains per-CPU counters without -per-cpu")
+	}
+
+	output = mustTestTubectl(t, netns, "status", "-per-cpu")
+	i := strings.Index(output.String(), "Per-CPU counters:")
+	if i == -1 {
+		t.Fatalf("Output of status doesn't contain per-CPU counters:\n%s", output)
+	}
+	perCPU := output.String()[i+len("Per-CPU counters:"):]
+
+	// Only the CPU which handled the connection is shown.
+	lines := strings.Split(strings.TrimSpace(perCPU), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a header and one CPU, got:\n%s", perCPU)
+	}
+
+	if fields := strings.Fields(lines[1]); len(fields) != 7 || fields[0] != "foo" || fields[4] != "1" {
+		t.Errorf("Unexpected per-CPU counters for foo: %q", lines[1])
+	}
+}
+
+func TestStatusDeadSocket(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", internal.TCP, "127.0.0.1", 80)
+	ln := testutil.Listen(t, netns, "tcp4", "127.0.0.1:0").(*net.TCPListener)
+	mustRegisterSocket(t, dp, "foo", ln)
+	dp.Close()
+
+	output := mustTestTubectl(t, netns, "status")
+	if strings.Contains(output.String(), "no socket") {
+		t.Error("Output of status contains a warning for a live socket")
+	}
+
+	ln.Close()
+
+	output = mustTestTubectl(t, netns, "status")
+	if !strings.Contains(output.String(), "no socket") {
+		t.Errorf("Output of status doesn't warn about a closed socket:\n%s", output)
+	}
+}
+
+func TestStatusStateVersion(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	output := mustTestTubectl(t, netns, "status")
+	if want := fmt.Sprintf("State version: %d", internal.CurrentStateVersion); !strings.Contains(output.String(), want) {
+		t.Errorf("Output of status doesn't contain %q", want)
+	}
+
+	if strings.Contains(output.String(), "Warning:") {
+		t.Error("Output of status contains a warning")
+	}
+
+	dp := mustOpenDispatcher(t, netns)
+	m, err := ebpf.LoadPinnedMap(filepath.Join(dp.Path, "version"), nil)
+	dp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if err := m.Put(uint32(0), uint32(0)); err != nil {
+		t.Fatal("Can't tamper with state version:", err)
+	}
+
+	output = mustTestTubectl(t, netns, "status")
+	if !strings.Contains(output.String(), "Warning: state version 0") {
+		t.Error("Output of status doesn't warn about outdated state version")
+	}
+}
+
+func TestStatusMissRate(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", internal.TCP, "127.0.0.1", 8080)
+	dp.Close()
+
+	output := mustTestTubectl(t, netns, "status")
+	if !strings.Contains(output.String(), " - ") {
+		t.Error("Output of status doesn't contain a placeholder for the miss rate")
+	}
+
+	testutil.CanDial(t, netns, "tcp4", "127.0.0.1:8080")
+
+	dp = mustOpenDispatcher(t, netns)
+	mustRegisterSocket(t, dp, "foo", testutil.ListenAndEchoWithName(t, netns, "tcp4", "127.0.0.1:0", "foo"))
+	dp.Close()
+
+	testutil.CanDialName(t, netns, "tcp4", "127.0.0.1:8080", "foo")
+
+	output = mustTestTubectl(t, netns, "status")
+	if !strings.Contains(output.String(), "50%") {
+		t.Errorf("Output of status doesn't contain a miss rate of 50%%:\n%s", output)
+	}
+}
+
 func TestStatusFilteredByLabel(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
@@ -79,6 +207,36 @@ func TestStatusFilteredByLabel(t *testing.T) {
 	}
 }
 
+func TestStatusWatch(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", internal.TCP, "::1", 80)
+	dp.Close()
+
+	tc := tubectlTestCall{
+		NetNS: netns,
+		Cmd:   "status",
+		Args:  []string{"-watch", "10ms"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var output log.Buffer
+	if err := tc.run(t, ctx, &output); err != nil {
+		t.Fatal("Watch returns an error:", err)
+	}
+
+	if n := strings.Count(output.String(), "Bindings:"); n < 2 {
+		t.Errorf("Expected at least two iterations, got %d:\n%s", n, output.String())
+	}
+
+	if _, err := testTubectl(t, netns, "status", "-watch", "-1s"); err == nil {
+		t.Error("Accepted negative watch interval")
+	}
+}
+
 func TestMetrics(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
@@ -128,6 +286,455 @@ func TestMetrics(t *testing.T) {
 	}
 }
 
+func TestMetricsHealth(t *testing.T) {
+	get := func(t *testing.T, url string) int {
+		t.Helper()
+
+		client := http.Client{Timeout: 5 * time.Second}
+		res, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for _, test := range []struct {
+		name   string
+		loaded bool
+		want   int
+	}{
+		{"loaded", true, http.StatusOK},
+		{"unloaded", false, http.StatusServiceUnavailable},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			netns := testutil.NewNetNS(t)
+			if test.loaded {
+				mustLoadDispatcher(t, netns)
+			}
+
+			tubectl := tubectlTestCall{
+				NetNS:     netns,
+				Cmd:       "metrics",
+				Args:      []string{"127.0.0.1", "0"},
+				Listeners: make(chan net.Listener, 1),
+			}
+
+			stop := tubectl.Start(t)
+			defer stop()
+
+			var ln net.Listener
+			select {
+			case ln = <-tubectl.Listeners:
+			case <-time.After(time.Second):
+				t.Fatal("tubectl isn't listening after one second")
+			}
+
+			base := fmt.Sprintf("http://%s", ln.Addr().String())
+			if code := get(t, base+"/healthz"); code != test.want {
+				t.Errorf("/healthz returned %d instead of %d", code, test.want)
+			}
+
+			if code := get(t, base+"/readyz"); code != http.StatusServiceUnavailable {
+				t.Errorf("/readyz returned %d before collecting metrics", code)
+			}
+
+			if code := get(t, base+"/metrics"); code != http.StatusOK {
+				t.Fatalf("/metrics returned %d", code)
+			}
+
+			if code := get(t, base+"/readyz"); code != test.want {
+				t.Errorf("/readyz returned %d instead of %d after collecting metrics", code, test.want)
+			}
+		})
+	}
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	tubectl := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "metrics",
+		Args:      []string{"-metric-prefix", "myorg_tubular_", "127.0.0.1", "0"},
+		Listeners: make(chan net.Listener, 1),
+	}
+
+	tubectl.Start(t)
+
+	var ln net.Listener
+	select {
+	case ln = <-tubectl.Listeners:
+	case <-time.After(time.Second):
+		t.Fatal("tubectl isn't listening after one second")
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(fmt.Sprintf("http://%s/metrics", ln.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal("Can't read body:", err)
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		if !strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+
+		name := strings.Fields(line)[2]
+		if name == "build_info" || strings.HasPrefix(name, "go_") || strings.HasPrefix(name, "process_") {
+			// Not tubular specific, exported without prefix.
+			continue
+		}
+
+		if !strings.HasPrefix(name, "myorg_tubular_") {
+			t.Error("Metric doesn't carry custom prefix:", name)
+		}
+	}
+
+	if !bytes.Contains(body, []byte("# TYPE build_info")) {
+		t.Error("Output doesn't contain unprefixed build_info")
+	}
+}
+
+func TestMetricsRuntime(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			netns := mustReadyNetNS(t)
+
+			tubectl := tubectlTestCall{
+				NetNS:     netns,
+				Cmd:       "metrics",
+				Args:      []string{fmt.Sprintf("-runtime-metrics=%t", enabled), "127.0.0.1", "0"},
+				Listeners: make(chan net.Listener, 1),
+			}
+
+			tubectl.Start(t)
+
+			var ln net.Listener
+			select {
+			case ln = <-tubectl.Listeners:
+			case <-time.After(time.Second):
+				t.Fatal("tubectl isn't listening after one second")
+			}
+
+			client := http.Client{Timeout: 5 * time.Second}
+			res, err := client.Get(fmt.Sprintf("http://%s/metrics", ln.Addr().String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal("Can't read body:", err)
+			}
+
+			if have := bytes.Contains(body, []byte("\ngo_goroutines ")); have != enabled {
+				t.Errorf("Expected go_goroutines to be exported: %t, got %t", enabled, have)
+			}
+
+			if bytes.Contains(body, []byte("tubular_go_")) {
+				t.Error("Runtime metrics carry tubular prefix")
+			}
+		})
+	}
+}
+
+func TestMetricsMultipleNetNS(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		netns := mustReadyNetNS(t)
+		dp := mustOpenDispatcher(t, netns)
+		mustAddBinding(t, dp, "foo", internal.TCP, "127.0.0.1", 80)
+		dp.Close()
+
+		if err := os.Symlink(netns.Path(), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tubectl := tubectlTestCall{
+		NetNS:     testutil.CurrentNetNS(t),
+		Cmd:       "metrics",
+		Args:      []string{"-netns-glob", filepath.Join(dir, "*"), "127.0.0.1", "0"},
+		Listeners: make(chan net.Listener, 1),
+	}
+
+	tubectl.Start(t)
+
+	var ln net.Listener
+	select {
+	case ln = <-tubectl.Listeners:
+	case <-time.After(time.Second):
+		t.Fatal("tubectl isn't listening after one second")
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(fmt.Sprintf("http://%s/metrics", ln.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal("Can't read body:", err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		want := fmt.Sprintf(`tubular_bindings{domain="ipv4",label="foo",netns=%q,protocol="tcp"} 1`, filepath.Join(dir, name))
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("Output doesn't contain %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsReload(t *testing.T) {
+	dir := t.TempDir()
+	link := func(name string) string {
+		t.Helper()
+
+		netns := mustReadyNetNS(t)
+		path := filepath.Join(dir, name)
+		if err := os.Symlink(netns.Path(), path); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	a := link("a")
+
+	tubectl := tubectlTestCall{
+		NetNS:     testutil.CurrentNetNS(t),
+		Cmd:       "metrics",
+		Args:      []string{"-netns-glob", filepath.Join(dir, "*"), "127.0.0.1", "0"},
+		Listeners: make(chan net.Listener, 1),
+		Signals:   make(chan chan<- os.Signal, 1),
+	}
+
+	tubectl.Start(t)
+
+	var ln net.Listener
+	select {
+	case ln = <-tubectl.Listeners:
+	case <-time.After(time.Second):
+		t.Fatal("tubectl isn't listening after one second")
+	}
+
+	var reload chan<- os.Signal
+	select {
+	case reload = <-tubectl.Signals:
+	case <-time.After(time.Second):
+		t.Fatal("tubectl doesn't handle signals after one second")
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	scrape := func() string {
+		t.Helper()
+
+		res, err := client.Get(fmt.Sprintf("http://%s/metrics", ln.Addr().String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal("Can't read body:", err)
+		}
+		return string(body)
+	}
+
+	if body := scrape(); !strings.Contains(body, fmt.Sprintf("netns=%q", a)) {
+		t.Fatal("Output doesn't contain first namespace")
+	}
+
+	b := link("b")
+	reload <- syscall.SIGHUP
+
+	for deadline := time.Now().Add(time.Second); ; {
+		body := scrape()
+		if strings.Contains(body, fmt.Sprintf("netns=%q", b)) {
+			if !strings.Contains(body, fmt.Sprintf("netns=%q", a)) {
+				t.Error("Output doesn't contain first namespace after reload")
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Output doesn't contain second namespace after reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetricsSystemd(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tubectl := tubectlTestCall{
+		NetNS:    netns,
+		Cmd:      "metrics",
+		Args:     []string{"-systemd"},
+		Env:      testEnv{"LISTEN_FDS": "1"},
+		ExtraFds: testFds{ln.(syscall.Conn)},
+	}
+
+	stop := tubectl.Start(t)
+	defer stop()
+
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(fmt.Sprintf("http://%s/metrics", ln.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal("Can't read body:", err)
+	}
+
+	if !bytes.Contains(body, []byte("# TYPE tubular_")) {
+		t.Error("Output doesn't contain tubular metrics")
+	}
+}
+
+func TestMetricsMaxConns(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	tubectl := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "metrics",
+		Args:      []string{"-max-conns", "1", "127.0.0.1", "0"},
+		Listeners: make(chan net.Listener, 1),
+	}
+
+	tubectl.Start(t)
+
+	var ln net.Listener
+	select {
+	case ln = <-tubectl.Listeners:
+	case <-time.After(time.Second):
+		t.Fatal("tubectl isn't listening after one second")
+	}
+
+	scrape := func(conn net.Conn, timeout time.Duration) error {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := io.WriteString(conn, "GET /metrics HTTP/1.1\r\nHost: tubectl\r\n\r\n"); err != nil {
+			return err
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	if err := scrape(first, 5*time.Second); err != nil {
+		t.Fatal("Can't scrape on first connection:", err)
+	}
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if err := scrape(second, 100*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("Expected second connection to block, got", err)
+	}
+
+	first.Close()
+
+	if err := scrape(second, 5*time.Second); err != nil {
+		t.Fatal("Can't scrape on second connection after closing the first:", err)
+	}
+}
+
+func TestMetricsDump(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dump := func(t *testing.T, format string) string {
+		t.Helper()
+
+		tc := tubectlTestCall{
+			NetNS:  netns,
+			Cmd:    "metrics",
+			Args:   []string{"-dump", "-format", format},
+			Stdout: new(log.Buffer),
+		}
+		tc.MustRun(t)
+		return tc.Stdout.String()
+	}
+
+	t.Run("prometheus", func(t *testing.T) {
+		output := dump(t, "prometheus")
+		if !strings.Contains(output, "\ntubular_dispatcher_loaded 1\n") {
+			t.Error("Output doesn't contain tubular metrics:\n", output)
+		}
+		if strings.Contains(output, "# EOF") {
+			t.Error("Output is in OpenMetrics format")
+		}
+	})
+
+	t.Run("openmetrics", func(t *testing.T) {
+		output := dump(t, "openmetrics")
+		if !strings.Contains(output, "\ntubular_dispatcher_loaded 1.0\n") {
+			t.Error("Output doesn't contain tubular metrics:\n", output)
+		}
+		if !strings.HasSuffix(output, "# EOF\n") {
+			t.Error("OpenMetrics output isn't terminated by # EOF")
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var families []struct {
+			Name   string `json:"name"`
+			Metric []struct {
+				Gauge struct {
+					Value float64 `json:"value"`
+				} `json:"gauge"`
+			} `json:"metric"`
+		}
+
+		output := dump(t, "json")
+		if err := json.Unmarshal([]byte(output), &families); err != nil {
+			t.Fatal("Invalid JSON:", err)
+		}
+
+		for _, family := range families {
+			if family.Name != "tubular_dispatcher_loaded" {
+				continue
+			}
+
+			if len(family.Metric) != 1 || family.Metric[0].Gauge.Value != 1 {
+				t.Errorf("Unexpected value for %s: %+v", family.Name, family.Metric)
+			}
+			return
+		}
+		t.Error("Output doesn't contain tubular metrics:\n", output)
+	})
+}
+
 func TestMetricsInvalidArgs(t *testing.T) {
 	netns := testutil.CurrentNetNS(t)
 
@@ -140,4 +747,61 @@ func TestMetricsInvalidArgs(t *testing.T) {
 	if err == nil {
 		t.Error("metrics command accepts missing port")
 	}
+
+	_, err = testTubectl(t, netns, "metrics", "-max-conns", "-1", "127.0.0.1", "0")
+	if err == nil {
+		t.Error("metrics command accepts negative connection limit")
+	}
+
+	_, err = testTubectl(t, netns, "metrics", "-systemd", "127.0.0.1", "0")
+	if err == nil {
+		t.Error("metrics command accepts -systemd with an address")
+	}
+
+	_, err = testTubectl(t, netns, "metrics", "-dump", "127.0.0.1", "0")
+	if err == nil {
+		t.Error("metrics command accepts -dump with an address")
+	}
+
+	_, err = testTubectl(t, netns, "metrics", "-dump", "-systemd")
+	if err == nil {
+		t.Error("metrics command accepts -dump with -systemd")
+	}
+
+	_, err = testTubectl(t, netns, "metrics", "-dump", "-format", "xml")
+	if err == nil {
+		t.Error("metrics command accepts unknown format")
+	}
+
+	_, err = testTubectl(t, netns, "metrics", "-metric-prefix", "my-org_", "127.0.0.1", "0")
+	if err == nil {
+		t.Error("metrics command accepts invalid prefix")
+	}
+
+	_, err = testTubectl(t, netns, "metrics", "-netns-glob", filepath.Join(t.TempDir(), "*"), "127.0.0.1", "0")
+	if err == nil {
+		t.Error("metrics command accepts glob without matches")
+	}
+}
+
+func TestStatusReuseportConflict(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	group := testutil.ReuseportGroup(t, netns, "tcp4", 2)
+	mustRegisterSocket(t, dp, "foo", group[0])
+	mustRegisterSocket(t, dp, "bar", group[1])
+	dp.Close()
+
+	// Execute in the namespace, since inspecting sockets of another
+	// namespace requires privileges.
+	tc := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "status",
+	}
+	output := tc.MustRun(t)
+	if !strings.Contains(output.String(), "Warning: reuseport group tcp 127.0.0.1:") {
+		t.Errorf("Output of status doesn't warn about a reuseport group spanning labels:\n%s", output)
+	}
 }
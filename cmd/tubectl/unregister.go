@@ -36,7 +36,8 @@ func unregister(e *env, args ...string) error {
 	}
 	defer dp.Close()
 
-	if err := dp.UnregisterSocket(label, domain, proto); err != nil {
+	dest := &internal.Destination{Label: label, Domain: domain, Protocol: proto}
+	if err := dp.RemoveSocket(dest); err != nil {
 		return err
 	}
 
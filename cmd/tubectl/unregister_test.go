@@ -26,7 +26,7 @@ func TestUnregister(t *testing.T) {
 	{
 		dp := mustOpenDispatcher(t, netns)
 
-		dests := destinations(t, dp)
+		dests := destinationsByCookie(t, dp)
 		if len(dests) != len(fds) {
 			t.Fatalf("expected %v registered destination(s), have %v", len(fds), len(dests))
 		}
@@ -52,7 +52,7 @@ func TestUnregister(t *testing.T) {
 	dp := mustOpenDispatcher(t, netns)
 
 	// Verify the numer of destinations, should only be 1 left
-	dests := destinations(t, dp)
+	dests := destinationsByCookie(t, dp)
 	if len(dests) != 1 {
 		t.Fatalf("unexpected number of sockets, wanted 1, got %v", len(dests))
 	}
@@ -1,19 +1,88 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"runtime"
+
+	"github.com/cloudflare/tubular/internal"
+)
+
+// Version and Commit are replaced by the Makefile.
+var (
+	Version = "git"
+	Commit  = "unknown"
 )
 
-// Version is replaced by the Makefile.
-var Version = "git"
+type versionJSON struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Commit    string `json:"commit"`
+	// Only present if a dispatcher is loaded.
+	ProgramID  uint32 `json:"program_id,omitempty"`
+	ProgramTag string `json:"program_tag,omitempty"`
+}
 
 func version(e *env, args ...string) error {
 	set := e.newFlagSet("version")
-	set.Description = "Show version information."
+	set.Description = `
+		Show version information.
+
+		With -json, also includes the program of the dispatcher loaded
+		into the network namespace, if any.`
+	asJSON := set.Bool("json", false, "Output JSON")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
-	e.stdout.Logf("tubectl version: %s (go runtime %s)\n", Version, runtime.Version())
-	return nil
+	if !*asJSON {
+		e.stdout.Logf("tubectl version: %s (go runtime %s)\n", Version, runtime.Version())
+		return nil
+	}
+
+	out := versionJSON{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		Commit:    Commit,
+	}
+
+	id, tag, err := dispatcherProgram(e)
+	if errors.Is(err, internal.ErrNotLoaded) {
+		// Nothing to report.
+	} else if err != nil {
+		e.stderr.Log("Warning: can't get dispatcher program:", err)
+	} else {
+		out.ProgramID, out.ProgramTag = id, tag
+	}
+
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&out)
+}
+
+func dispatcherProgram(e *env) (uint32, string, error) {
+	dp, err := e.openDispatcher(true)
+	if err != nil {
+		return 0, "", err
+	}
+	defer dp.Close()
+
+	prog, err := dp.Program()
+	if err != nil {
+		return 0, "", fmt.Errorf("load program: %s", err)
+	}
+	defer prog.Close()
+
+	info, err := prog.Info()
+	if err != nil {
+		return 0, "", fmt.Errorf("get program info: %s", err)
+	}
+
+	id, ok := info.ID()
+	if !ok {
+		return 0, "", fmt.Errorf("program ID is not available")
+	}
+
+	return uint32(id), info.Tag, nil
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal/log"
+	"github.com/cloudflare/tubular/internal/testutil"
+)
+
+func TestVersionJSON(t *testing.T) {
+	versionJSONFor := func(t *testing.T, tc tubectlTestCall) versionJSON {
+		t.Helper()
+
+		var stdout log.Buffer
+		tc.Cmd = "version"
+		tc.Args = []string{"-json"}
+		tc.Stdout = &stdout
+		tc.MustRun(t)
+
+		var out versionJSON
+		if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+			t.Fatalf("Can't decode output: %s\n%s", err, stdout.String())
+		}
+		return out
+	}
+
+	netns := testutil.NewNetNS(t)
+
+	out := versionJSONFor(t, tubectlTestCall{NetNS: netns})
+	if out.Version != Version {
+		t.Errorf("Expected version %q, got %q", Version, out.Version)
+	}
+	if !strings.HasPrefix(out.GoVersion, "go") {
+		t.Errorf("Invalid Go version %q", out.GoVersion)
+	}
+	if out.ProgramID != 0 {
+		t.Error("Expected no program ID without a dispatcher, got", out.ProgramID)
+	}
+
+	mustLoadDispatcher(t, netns)
+
+	out = versionJSONFor(t, tubectlTestCall{NetNS: netns})
+	if out.ProgramID == 0 {
+		t.Error("Expected a program ID once the dispatcher is loaded")
+	}
+	if out.ProgramTag == "" {
+		t.Error("Expected a program tag once the dispatcher is loaded")
+	}
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// Operations recorded in an AuditRecord.
+const (
+	AuditAddBinding       = "add-binding"
+	AuditRemoveBinding    = "remove-binding"
+	AuditRegisterSocket   = "register-socket"
+	AuditUnregisterSocket = "unregister-socket"
+	AuditUpgrade          = "upgrade"
+)
+
+// AuditRecord describes a change made to the state of a Dispatcher.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	// Label and Protocol aren't set for upgrades.
+	Label    string `json:"label,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	// Prefix and Port are only set for changes to bindings.
+	Prefix string  `json:"prefix,omitempty"`
+	Port   *uint16 `json:"port,omitempty"`
+	// Domain is only set for changes to sockets.
+	Domain string `json:"domain,omitempty"`
+	// PreviousProgramID and ProgramID are only set for upgrades.
+	PreviousProgramID ebpf.ProgramID `json:"previous_program_id,omitempty"`
+	ProgramID         ebpf.ProgramID `json:"program_id,omitempty"`
+}
+
+func (d *Dispatcher) auditBinding(op string, bind *Binding) {
+	if d.Audit == nil {
+		return
+	}
+
+	port := bind.Port
+	d.Audit(&AuditRecord{
+		Time:      time.Now(),
+		Operation: op,
+		Label:     bind.Label,
+		Protocol:  bind.Protocol.String(),
+		Prefix:    bind.Prefix.String(),
+		Port:      &port,
+	})
+}
+
+func (d *Dispatcher) auditDestination(op string, dest *Destination) {
+	if d.Audit == nil {
+		return
+	}
+
+	d.Audit(&AuditRecord{
+		Time:      time.Now(),
+		Operation: op,
+		Label:     dest.Label,
+		Protocol:  dest.Protocol.String(),
+		Domain:    dest.Domain.String(),
+	})
+}
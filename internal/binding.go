@@ -36,6 +36,22 @@ func NewBinding(label string, proto Protocol, prefix string, port uint16) (*Bind
 	}, nil
 }
 
+// UnmapPrefix converts a v4-mapped v6 prefix like ::ffff:127.0.0.1/104 into
+// the equivalent ipv4 prefix 127.0.0.0/8. Other prefixes are returned as is.
+//
+// Bindings for v4-mapped prefixes are rejected by the Dispatcher, since the
+// data plane never sees such addresses.
+func UnmapPrefix(prefix netaddr.IPPrefix) netaddr.IPPrefix {
+	prefix = prefix.Masked()
+	if !prefix.IP().Is4in6() {
+		return prefix
+	}
+
+	// Masking removes the ::ffff: marker from prefixes shorter than 96 bits,
+	// so the prefix is at least that long here.
+	return netaddr.IPPrefixFrom(prefix.IP().Unmap(), prefix.Bits()-96)
+}
+
 func newBindingFromBPF(label string, key *bindingKey) *Binding {
 	ones := uint8(key.PrefixLen) - bindingKeyHeaderBits
 	ip := netaddr.IPFrom16(key.IP)
@@ -55,6 +71,20 @@ func newBindingFromBPF(label string, key *bindingKey) *Binding {
 	}
 }
 
+// Contains returns true if b matches all traffic matched by other, regardless
+// of labels.
+func (b *Binding) Contains(other *Binding) bool {
+	if b.Protocol != other.Protocol {
+		return false
+	}
+
+	if b.Port != 0 && b.Port != other.Port {
+		return false
+	}
+
+	return b.Prefix.Bits() <= other.Prefix.Bits() && b.Prefix.Contains(other.Prefix.IP())
+}
+
 func (b *Binding) String() string {
 	return fmt.Sprintf("%s#%v:[%s]:%d", b.Label, b.Protocol, b.Prefix, b.Port)
 }
@@ -173,8 +203,17 @@ func diffBindings(have, want map[bindingKey]string) (added, removed Bindings) {
 
 // ParsePrefix parses a prefix with an optional mask into an IPPrefix.
 //
-// A missing prefix is interpreted as a /128 or /32.
+// A missing prefix is interpreted as a /128 or /32. Addresses with a zone
+// like fe80::1%eth0 are rejected, since bindings apply to all interfaces.
 func ParsePrefix(prefix string) (netaddr.IPPrefix, error) {
+	if i := strings.IndexByte(prefix, '%'); i != -1 {
+		zone := prefix[i+1:]
+		if j := strings.IndexByte(zone, '/'); j != -1 {
+			zone = zone[:j]
+		}
+		return netaddr.IPPrefix{}, fmt.Errorf("prefix %s: zone %q isn't supported since bindings apply to all interfaces", prefix, zone)
+	}
+
 	if strings.ContainsRune(prefix, '/') {
 		return netaddr.ParseIPPrefix(prefix)
 	}
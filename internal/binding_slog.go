@@ -0,0 +1,17 @@
+//go:build go1.21
+
+package internal
+
+import "log/slog"
+
+var _ slog.LogValuer = (*Binding)(nil)
+
+// LogValue implements slog.LogValuer.
+func (b *Binding) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("label", b.Label),
+		slog.String("protocol", b.Protocol.String()),
+		slog.String("prefix", b.Prefix.String()),
+		slog.Int("port", int(b.Port)),
+	)
+}
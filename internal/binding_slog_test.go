@@ -0,0 +1,38 @@
+//go:build go1.21
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBindingLogValue(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	log.Fields(l, "added", "binding", mustNewBinding(t, "foo", TCP, "127.0.0.0/8", 80))
+
+	var record struct {
+		Binding map[string]interface{}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal("Can't decode record:", err)
+	}
+
+	want := map[string]interface{}{
+		"label":    "foo",
+		"protocol": "tcp",
+		"prefix":   "127.0.0.0/8",
+		"port":     float64(80),
+	}
+
+	if diff := cmp.Diff(want, record.Binding); diff != "" {
+		t.Errorf("Fields don't match (-want +got):\n%s", diff)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -248,6 +249,79 @@ func TestParseCIDR(t *testing.T) {
 	}
 }
 
+func TestParsePrefixWithZone(t *testing.T) {
+	for _, input := range []string{"fe80::1%eth0", "fe80::1%eth0/64"} {
+		_, err := ParsePrefix(input)
+		if err == nil {
+			t.Errorf("Accepted prefix %s with zone", input)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), `zone "eth0"`) {
+			t.Errorf("Error for %s doesn't mention the zone: %s", input, err)
+		}
+	}
+}
+
+func TestUnmapPrefix(t *testing.T) {
+	for _, test := range []struct {
+		input, want string
+	}{
+		{"::ffff:127.0.0.1/128", "127.0.0.1/32"},
+		{"::ffff:127.0.0.1/104", "127.0.0.0/8"},
+		{"::ffff:7f00:1/96", "0.0.0.0/0"},
+		{"::ffff:127.0.0.1/64", "::/64"},
+		{"127.0.0.1/32", "127.0.0.1/32"},
+		{"2001:db8::1/64", "2001:db8::/64"},
+	} {
+		have := UnmapPrefix(netaddr.MustParseIPPrefix(test.input))
+		if have.String() != test.want {
+			t.Errorf("UnmapPrefix(%s) returned %s instead of %s", test.input, have, test.want)
+		}
+	}
+}
+
+func TestBindingContains(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want bool
+	}{
+		{"tcp 127.0.0.0/24 80", "tcp 127.0.0.1 80", true},
+		{"tcp 127.0.0.1 80", "tcp 127.0.0.0/24 80", false},
+		{"tcp 127.0.0.0/24 0", "tcp 127.0.0.1 80", true},
+		{"tcp 127.0.0.0/24 80", "tcp 127.0.0.1 0", false},
+		{"tcp 127.0.0.0/24 80", "tcp 127.0.0.0/24 80", true},
+		{"tcp 127.0.0.0/24 80", "udp 127.0.0.1 80", false},
+		{"tcp 127.0.0.0/24 80", "tcp 127.0.1.1 80", false},
+		{"tcp ::/0 80", "tcp 127.0.0.1 80", false},
+	} {
+		a, b := mustParseBinding(t, test.a), mustParseBinding(t, test.b)
+		if have := a.Contains(b); have != test.want {
+			t.Errorf("%s contains %s: got %t, want %t", a, b, have, test.want)
+		}
+	}
+}
+
+func mustParseBinding(tb testing.TB, spec string) *Binding {
+	tb.Helper()
+
+	var (
+		proto  Protocol
+		prefix string
+		port   uint16
+	)
+	fields := strings.Fields(spec)
+	if err := proto.UnmarshalText([]byte(fields[0])); err != nil {
+		tb.Fatal(err)
+	}
+	prefix = fields[1]
+	if _, err := fmt.Sscan(fields[2], &port); err != nil {
+		tb.Fatal(err)
+	}
+
+	return mustNewBinding(tb, "foo", proto, prefix, port)
+}
+
 func copyAndShuffleBindings(bind Bindings, rng *rand.Rand) Bindings {
 	cpy := make(Bindings, 0, len(bind))
 	for _, b := range bind {
@@ -1,7 +1,11 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudflare/tubular/internal/log"
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,25 +16,61 @@ type Collector struct {
 	logger             log.Logger
 	netnsPath          string
 	bpffsPath          string
+	metrics            func() (*Metrics, error)
 	collectionErrors   prometheus.Counter
+	lockWait           prometheus.Counter
 	lookups            *prometheus.Desc
 	misses             *prometheus.Desc
 	errors             *prometheus.Desc
 	bindings           *prometheus.Desc
 	destinationSockets *prometheus.Desc
+	destinationsUsed   *prometheus.Desc
+	destinationsCap    *prometheus.Desc
+	destinationsUtil   *prometheus.Desc
+	programRuns        *prometheus.Desc
+	programRuntime     *prometheus.Desc
+	programStats       *prometheus.Desc
+	dispatcherLoaded   *prometheus.Desc
+	lastUpgrade        *prometheus.Desc
+	lastUpgradeInfo    *prometheus.Desc
+	aggregateByLabel   bool
+	lookupsByLabel     *prometheus.Desc
+	missesByLabel      *prometheus.Desc
+	errorsByLabel      *prometheus.Desc
+	// Set to one once metrics were read successfully, accessed atomically.
+	succeeded uint32
+}
+
+// CollectorOptions control the behaviour of NewCollectorWithOptions.
+type CollectorOptions struct {
+	// Export lookups, misses and errors summed per label, instead of per
+	// label, domain and protocol. Reduces the number of series for labels
+	// that span multiple domains and protocols.
+	AggregateByLabel bool
 }
 
 var _ prometheus.Collector = (*Collector)(nil)
 
 func NewCollector(logger log.Logger, netnsPath, bpfFsPath string) *Collector {
-	return &Collector{
+	return NewCollectorWithOptions(logger, netnsPath, bpfFsPath, CollectorOptions{})
+}
+
+// NewCollectorWithOptions is like NewCollector, but allows changing which
+// metrics are exported.
+func NewCollectorWithOptions(logger log.Logger, netnsPath, bpfFsPath string, opts CollectorOptions) *Collector {
+	c := &Collector{
 		logger,
 		netnsPath,
 		bpfFsPath,
+		nil,
 		prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "collection_errors_total",
 			Help: "The number of times metrics collection encountered an error.",
 		}),
+		prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lock_wait_seconds_total",
+			Help: "Total time spent waiting for the lock on the dispatcher state.",
+		}),
 		prometheus.NewDesc(
 			"lookups_total",
 			"Total number of times traffic matched a destination.",
@@ -61,32 +101,250 @@ func NewCollector(logger log.Logger, netnsPath, bpfFsPath string) *Collector {
 			[]string{"label", "domain", "protocol"},
 			nil,
 		),
+		prometheus.NewDesc(
+			"destinations_used",
+			"The number of destinations referenced by a binding or socket.",
+			nil,
+			nil,
+		),
+		prometheus.NewDesc(
+			"destinations_capacity",
+			"The maximum number of destinations.",
+			nil,
+			nil,
+		),
+		prometheus.NewDesc(
+			"destinations_utilization_ratio",
+			"The fraction of destinations which are allocated.",
+			nil,
+			nil,
+		),
+		prometheus.NewDesc(
+			"program_run_count_total",
+			"Total number of times the dispatcher program ran. Only counted while BPF statistics are enabled.",
+			nil,
+			nil,
+		),
+		prometheus.NewDesc(
+			"program_run_seconds_total",
+			"Total runtime of the dispatcher program. Only counted while BPF statistics are enabled.",
+			nil,
+			nil,
+		),
+		prometheus.NewDesc(
+			"program_stats_enabled",
+			"Whether BPF statistics are enabled via the kernel.bpf_stats_enabled sysctl.",
+			nil,
+			nil,
+		),
+		prometheus.NewDesc(
+			"dispatcher_loaded",
+			"Whether or not the dispatcher is loaded.",
+			nil,
+			nil,
+		),
+		prometheus.NewDesc(
+			"last_upgrade_timestamp_seconds",
+			"The time of the most recent upgrade of the dispatcher program.",
+			nil,
+			nil,
+		),
+		prometheus.NewDesc(
+			"last_upgrade_info",
+			"The program IDs before and after the most recent upgrade of the dispatcher program.",
+			[]string{"previous_program_id", "program_id"},
+			nil,
+		),
+		opts.AggregateByLabel,
+		prometheus.NewDesc(
+			"lookups_by_label_total",
+			"Total number of times traffic matched a destination with a label.",
+			[]string{"label"},
+			nil,
+		),
+		prometheus.NewDesc(
+			"misses_by_label_total",
+			"Total number of failed lookups for a label since no socket was registered.",
+			[]string{"label"},
+			nil,
+		),
+		prometheus.NewDesc(
+			"errors_by_label_total",
+			"Total number of failed lookups for a label due to an error.",
+			[]string{"label", "reason"},
+			nil,
+		),
+		0,
 	}
+	c.metrics = c.dispatcherMetrics
+	return c
+}
+
+// NetNS returns the path to the network namespace of the dispatcher.
+func (c *Collector) NetNS() string {
+	return c.netnsPath
+}
+
+// Ready returns true once metrics were collected from a loaded dispatcher.
+func (c *Collector) Ready() bool {
+	return atomic.LoadUint32(&c.succeeded) == 1
 }
 
 // Describe implements prometheus.Collector.
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	c.collectionErrors.Describe(ch)
-	ch <- c.lookups
-	ch <- c.misses
-	ch <- c.errors
+	c.lockWait.Describe(ch)
+	if c.aggregateByLabel {
+		ch <- c.lookupsByLabel
+		ch <- c.missesByLabel
+		ch <- c.errorsByLabel
+	} else {
+		ch <- c.lookups
+		ch <- c.misses
+		ch <- c.errors
+	}
 	ch <- c.bindings
 	ch <- c.destinationSockets
+	ch <- c.destinationsUsed
+	ch <- c.destinationsCap
+	ch <- c.destinationsUtil
+	ch <- c.programRuns
+	ch <- c.programRuntime
+	ch <- c.programStats
+	ch <- c.dispatcherLoaded
+	ch <- c.lastUpgrade
+	ch <- c.lastUpgradeInfo
 }
 
 // Collect implements prometheus.Collector.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	// Collect last, so that errors during this collection are reflected.
 	defer c.collectionErrors.Collect(ch)
+	defer c.lockWait.Collect(ch)
 
 	metrics, err := c.metrics()
-	if err != nil {
+	if errors.Is(err, ErrNotLoaded) {
+		// Not loaded isn't an error, the dispatcher may be unloaded during
+		// maintenance.
+		ch <- prometheus.MustNewConstMetric(c.dispatcherLoaded, prometheus.GaugeValue, 0)
+		return
+	} else if err != nil {
 		c.logger.Log("Failed to collect metrics:", err)
 		c.collectionErrors.Inc()
 		return
 	}
 
-	for dest, destMetrics := range metrics.Destinations {
+	ch <- prometheus.MustNewConstMetric(c.dispatcherLoaded, prometheus.GaugeValue, 1)
+	atomic.StoreUint32(&c.succeeded, 1)
+
+	// Export whatever could be read, a single bad destination shouldn't
+	// fail the whole scrape.
+	for _, err := range metrics.Errors {
+		c.logger.Log("Failed to collect metrics:", err)
+		c.collectionErrors.Inc()
+	}
+
+	if c.aggregateByLabel {
+		c.collectByLabel(ch, metrics.Destinations)
+	} else {
+		c.collectByDestination(ch, metrics.Destinations)
+	}
+
+	for binding, count := range metrics.Bindings {
+		commonLabels := []string{
+			binding.Label,
+			binding.Domain.String(),
+			binding.Protocol.String(),
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			c.bindings,
+			prometheus.GaugeValue,
+			float64(count),
+			commonLabels...,
+		)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destinationsUsed,
+		prometheus.GaugeValue,
+		float64(metrics.DestinationsUsed),
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destinationsCap,
+		prometheus.GaugeValue,
+		float64(metrics.DestinationsCapacity),
+	)
+
+	utilization := float64(0)
+	if metrics.DestinationsCapacity > 0 {
+		utilization = float64(metrics.DestinationsUsed) / float64(metrics.DestinationsCapacity)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		c.destinationsUtil,
+		prometheus.GaugeValue,
+		utilization,
+	)
+
+	statsEnabled := float64(0)
+	if metrics.ProgramStatsEnabled {
+		statsEnabled = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		c.programRuns,
+		prometheus.CounterValue,
+		float64(metrics.ProgramRuns),
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.programRuntime,
+		prometheus.CounterValue,
+		metrics.ProgramRuntime.Seconds(),
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		c.programStats,
+		prometheus.GaugeValue,
+		statsEnabled,
+	)
+
+	if upgrade := metrics.LastUpgrade; upgrade != nil {
+		ch <- prometheus.MustNewConstMetric(
+			c.lastUpgrade,
+			prometheus.GaugeValue,
+			float64(upgrade.Time.UnixNano())/float64(time.Second),
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			c.lastUpgradeInfo,
+			prometheus.GaugeValue,
+			1,
+			strconv.FormatUint(uint64(upgrade.PreviousProgramID), 10),
+			strconv.FormatUint(uint64(upgrade.ProgramID), 10),
+		)
+	}
+
+	for dest, present := range metrics.Sockets {
+		commonLabels := []string{
+			dest.Label,
+			dest.Domain.String(),
+			dest.Protocol.String(),
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			c.destinationSockets,
+			prometheus.GaugeValue,
+			float64(present),
+			commonLabels...,
+		)
+	}
+}
+
+func (c *Collector) collectByDestination(ch chan<- prometheus.Metric, dests map[Destination]DestinationMetrics) {
+	for dest, destMetrics := range dests {
 		commonLabels := []string{
 			dest.Label,
 			dest.Domain.String(),
@@ -114,44 +372,47 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 			append(commonLabels, "bad-socket")...,
 		)
 	}
+}
 
-	for binding, count := range metrics.Bindings {
-		commonLabels := []string{
-			binding.Label,
-			binding.Domain.String(),
-			binding.Protocol.String(),
-		}
+func (c *Collector) collectByLabel(ch chan<- prometheus.Metric, dests map[Destination]DestinationMetrics) {
+	byLabel := make(map[string][]DestinationMetrics)
+	for dest, destMetrics := range dests {
+		byLabel[dest.Label] = append(byLabel[dest.Label], destMetrics)
+	}
+
+	for label, metrics := range byLabel {
+		sum := sumDestinationMetrics(metrics)
 
 		ch <- prometheus.MustNewConstMetric(
-			c.bindings,
-			prometheus.GaugeValue,
-			float64(count),
-			commonLabels...,
+			c.lookupsByLabel,
+			prometheus.CounterValue,
+			float64(sum.Lookups),
+			label,
 		)
-	}
 
-	for dest, present := range metrics.Sockets {
-		commonLabels := []string{
-			dest.Label,
-			dest.Domain.String(),
-			dest.Protocol.String(),
-		}
+		ch <- prometheus.MustNewConstMetric(
+			c.missesByLabel,
+			prometheus.CounterValue,
+			float64(sum.Misses),
+			label,
+		)
 
 		ch <- prometheus.MustNewConstMetric(
-			c.destinationSockets,
-			prometheus.GaugeValue,
-			float64(present),
-			commonLabels...,
+			c.errorsByLabel,
+			prometheus.CounterValue,
+			float64(sum.ErrorBadSocket),
+			label, "bad-socket",
 		)
 	}
 }
 
-func (c *Collector) metrics() (*Metrics, error) {
+func (c *Collector) dispatcherMetrics() (*Metrics, error) {
 	dp, err := OpenDispatcher(c.netnsPath, c.bpffsPath, true)
 	if err != nil {
-		return nil, fmt.Errorf("open dispatcher: %s", err)
+		return nil, fmt.Errorf("open dispatcher: %w", err)
 	}
 	defer dp.Close()
 
+	c.lockWait.Add(dp.LockWait().Seconds())
 	return dp.Metrics()
 }
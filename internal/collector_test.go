@@ -1,15 +1,23 @@
 package internal
 
 import (
+	"errors"
+	"io"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/tubular/internal/log"
 	"github.com/cloudflare/tubular/internal/testutil"
 
+	"github.com/cilium/ebpf"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/prometheus/client_golang/prometheus"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
 func TestCollector(t *testing.T) {
@@ -27,11 +35,24 @@ func TestCollector(t *testing.T) {
 		t.Fatal("Can't register:", err)
 	}
 
+	if c.Ready() {
+		t.Error("Collector is ready before collecting")
+	}
+
 	metrics := testutil.FlattenMetrics(t, reg)
 	if len(metrics) == 0 {
 		t.Error("Expected metrics after bindings are added")
 	}
 
+	if !c.Ready() {
+		t.Error("Collector isn't ready after collecting")
+	}
+
+	capacity := metrics["destinations_capacity"]
+	if capacity == 0 {
+		t.Fatal("Destination capacity is zero")
+	}
+
 	// Register an unconnected UDP socket and connect it afterwards to
 	// trigger bad-socket.
 	dp = mustOpenDispatcher(t, nil, netns)
@@ -45,7 +66,11 @@ func TestCollector(t *testing.T) {
 			testutil.CanDial(t, netns, "tcp6", "[::1]:8080")
 
 			want := map[string]float64{
-				"collection_errors_total": 0,
+				"collection_errors_total":        0,
+				"dispatcher_loaded":              1,
+				"destinations_used":              2,
+				"destinations_capacity":          capacity,
+				"destinations_utilization_ratio": 2 / capacity,
 				`errors_total{domain="ipv4", label="bar", protocol="udp", reason="bad-socket"}`: 0,
 				`errors_total{domain="ipv6", label="foo", protocol="tcp", reason="bad-socket"}`: 0,
 				`lookups_total{domain="ipv4", label="bar", protocol="udp"}`:                     0,
@@ -58,7 +83,7 @@ func TestCollector(t *testing.T) {
 				`destination_has_socket{domain="ipv6", label="foo", protocol="tcp"}`:            0,
 			}
 
-			if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg)); diff != "" {
+			if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg), ignoreProgramStats, ignoreLockWait); diff != "" {
 				t.Errorf("Metrics don't match (-want +got):\n%s", diff)
 			}
 		}
@@ -69,7 +94,11 @@ func TestCollector(t *testing.T) {
 			testutil.CanDial(t, netns, "udp4", "127.0.0.1:443")
 
 			want := map[string]float64{
-				"collection_errors_total": 0,
+				"collection_errors_total":        0,
+				"dispatcher_loaded":              1,
+				"destinations_used":              2,
+				"destinations_capacity":          capacity,
+				"destinations_utilization_ratio": 2 / capacity,
 				`errors_total{domain="ipv4", label="bar", protocol="udp", reason="bad-socket"}`: i + 1,
 				`errors_total{domain="ipv6", label="foo", protocol="tcp", reason="bad-socket"}`: 0,
 				`lookups_total{domain="ipv4", label="bar", protocol="udp"}`:                     i + 1,
@@ -82,13 +111,283 @@ func TestCollector(t *testing.T) {
 				`destination_has_socket{domain="ipv6", label="foo", protocol="tcp"}`:            0,
 			}
 
-			if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg)); diff != "" {
+			if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg), ignoreProgramStats, ignoreLockWait); diff != "" {
 				t.Errorf("Metrics don't match (-want +got):\n%s", diff)
 			}
 		}
 	})
 }
 
+func TestCollectorAggregateByLabel(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "127.0.0.1", 8080))
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "::1", 8080))
+	dp.Close()
+
+	testutil.CanDial(t, netns, "tcp4", "127.0.0.1:8080")
+	testutil.CanDial(t, netns, "tcp6", "[::1]:8080")
+	testutil.CanDial(t, netns, "tcp6", "[::1]:8080")
+
+	granular := prometheus.NewPedanticRegistry()
+	if err := granular.Register(NewCollector(log.Discard, netns.Path(), "/sys/fs/bpf")); err != nil {
+		t.Fatal("Can't register:", err)
+	}
+
+	aggregated := prometheus.NewPedanticRegistry()
+	c := NewCollectorWithOptions(log.Discard, netns.Path(), "/sys/fs/bpf", CollectorOptions{AggregateByLabel: true})
+	if err := aggregated.Register(c); err != nil {
+		t.Fatal("Can't register:", err)
+	}
+
+	lints, err := promtest.CollectAndLint(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lint := range lints {
+		t.Errorf("%s: %s", lint.Metric, lint.Text)
+	}
+
+	sums := make(map[string]float64)
+	for name, value := range testutil.FlattenMetrics(t, granular) {
+		for _, prefix := range []string{"lookups_total{", "misses_total{", "errors_total{"} {
+			if strings.HasPrefix(name, prefix) {
+				sums[strings.TrimSuffix(prefix, "_total{")] += value
+			}
+		}
+	}
+
+	metrics := testutil.FlattenMetrics(t, aggregated)
+	have := map[string]float64{
+		"lookups": metrics[`lookups_by_label_total{label="foo"}`],
+		"misses":  metrics[`misses_by_label_total{label="foo"}`],
+		"errors":  metrics[`errors_by_label_total{label="foo", reason="bad-socket"}`],
+	}
+
+	if diff := cmp.Diff(sums, have); diff != "" {
+		t.Errorf("Aggregated metrics don't match sum of granular ones (-want +got):\n%s", diff)
+	}
+
+	if have["lookups"] != 3 {
+		t.Errorf("Expected three lookups, got %v", have["lookups"])
+	}
+
+	for name := range metrics {
+		if strings.HasPrefix(name, "lookups_total") {
+			t.Error("Aggregated collector exports granular metric", name)
+		}
+	}
+}
+
+// Lock wait depends on timing, see TestCollectorLockWait.
+var ignoreLockWait = cmpopts.IgnoreMapEntries(func(k string, _ float64) bool {
+	return k == "lock_wait_seconds_total"
+})
+
+// Program statistics depend on whether BPF statistics are enabled, see
+// TestCollectorProgramStats.
+var ignoreProgramStats = cmpopts.IgnoreMapEntries(func(k string, _ float64) bool {
+	return strings.HasPrefix(k, "program_")
+})
+
+func TestCollectorProgramStats(t *testing.T) {
+	var stats io.Closer
+	err := testutil.WithCapabilities(func() (err error) {
+		stats, err = ebpf.EnableStats(uint32(unix.BPF_STATS_RUN_TIME))
+		return
+	}, cap.SYS_ADMIN)
+	if err != nil {
+		t.Fatal("Enable stats:", err)
+	}
+	defer stats.Close()
+
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "127.0.0.1", 8080))
+	mustRegisterSocket(t, dp, "foo", testutil.ListenAndEcho(t, netns, "tcp4", "127.0.0.1:0"))
+	dp.Close()
+
+	c := NewCollector(log.Discard, netns.Path(), "/sys/fs/bpf")
+	lints, err := promtest.CollectAndLint(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lint := range lints {
+		t.Errorf("%s: %s", lint.Metric, lint.Text)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal("Can't register:", err)
+	}
+
+	var runs float64
+	for i := 0; i < 2; i++ {
+		testutil.CanDial(t, netns, "tcp4", "127.0.0.1:8080")
+
+		metrics := testutil.FlattenMetrics(t, reg)
+
+		// EnableStats isn't reflected in the sysctl.
+		if enabled := metrics["program_stats_enabled"] == 1; enabled != bpfStatsEnabled() {
+			t.Errorf("program_stats_enabled is %v, sysctl is %v", enabled, bpfStatsEnabled())
+		}
+
+		if metrics["program_run_count_total"] <= runs {
+			t.Errorf("Run count didn't increase from %v", runs)
+		}
+		runs = metrics["program_run_count_total"]
+
+		if metrics["program_run_seconds_total"] == 0 {
+			t.Error("Runtime is zero")
+		}
+	}
+}
+
+func TestCollectorLockWait(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	c := NewCollector(log.Discard, netns.Path(), "/sys/fs/bpf")
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal("Can't register:", err)
+	}
+
+	// The writable dispatcher holds the lock until it is closed.
+	const hold = 50 * time.Millisecond
+	go func() {
+		time.Sleep(hold)
+		dp.Close()
+	}()
+
+	metrics := testutil.FlattenMetrics(t, reg)
+	if wait := metrics["lock_wait_seconds_total"]; wait < hold.Seconds()/2 {
+		t.Errorf("Expected a wait of at least %v, got %vs", hold/2, wait)
+	}
+}
+
+func TestCollectorDestinationUtilization(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	defer dp.Close()
+
+	for _, label := range []string{"foo", "bar", "baz"} {
+		conn := testutil.Listen(t, netns, "tcp4", "127.0.0.1:0")
+		mustRegisterSocket(t, dp, label, conn)
+	}
+
+	capacity := float64(dp.destinations.sockets.MaxEntries())
+
+	c := NewCollector(log.Discard, netns.Path(), "/sys/fs/bpf")
+	c.metrics = dp.Metrics
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal("Can't register:", err)
+	}
+
+	metrics := testutil.FlattenMetrics(t, reg)
+	want := map[string]float64{
+		"destinations_used":              3,
+		"destinations_capacity":          capacity,
+		"destinations_utilization_ratio": 3 / capacity,
+	}
+	for name, value := range want {
+		if metrics[name] != value {
+			t.Errorf("Expected %s to be %v, got %v", name, value, metrics[name])
+		}
+	}
+}
+
+func TestCollectorNotLoaded(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	c := NewCollector(log.Discard, netns.Path(), "/sys/fs/bpf")
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal("Can't register:", err)
+	}
+
+	want := map[string]float64{
+		"collection_errors_total": 0,
+		"dispatcher_loaded":       0,
+		"lock_wait_seconds_total": 0,
+	}
+
+	if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg)); diff != "" {
+		t.Errorf("Metrics don't match (-want +got):\n%s", diff)
+	}
+
+	if c.Ready() {
+		t.Error("Collector is ready without a dispatcher")
+	}
+}
+
+func TestCollectorPartialMetrics(t *testing.T) {
+	foo := Destination{"foo", AF_INET, TCP}
+
+	c := NewCollector(log.Discard, "", "")
+	c.metrics = func() (*Metrics, error) {
+		return &Metrics{
+			Destinations: map[Destination]DestinationMetrics{
+				foo: {Lookups: 1},
+			},
+			Errors: []error{errors.New("bar: lookup failed")},
+		}, nil
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal("Can't register:", err)
+	}
+
+	for i := float64(1); i <= 2; i++ {
+		want := map[string]float64{
+			"collection_errors_total": i,
+			"lock_wait_seconds_total": 0,
+			`errors_total{domain="ipv4", label="foo", protocol="tcp", reason="bad-socket"}`: 0,
+			`lookups_total{domain="ipv4", label="foo", protocol="tcp"}`:                     1,
+			`misses_total{domain="ipv4", label="foo", protocol="tcp"}`:                      0,
+			"dispatcher_loaded":              1,
+			"destinations_used":              0,
+			"destinations_capacity":          0,
+			"destinations_utilization_ratio": 0,
+			"program_run_count_total":        0,
+			"program_run_seconds_total":      0,
+			"program_stats_enabled":          0,
+		}
+
+		if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg)); diff != "" {
+			t.Errorf("Metrics don't match (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestCollectorLastUpgrade(t *testing.T) {
+	c := NewCollector(log.Discard, "", "")
+	c.metrics = func() (*Metrics, error) {
+		return &Metrics{
+			LastUpgrade: &Upgrade{time.Unix(42, 0), 1, 2},
+		}, nil
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal("Can't register:", err)
+	}
+
+	metrics := testutil.FlattenMetrics(t, reg)
+	want := map[string]float64{
+		"last_upgrade_timestamp_seconds":                             42,
+		`last_upgrade_info{previous_program_id="1", program_id="2"}`: 1,
+	}
+	for name, value := range want {
+		if metrics[name] != value {
+			t.Errorf("Expected %s to be %v, got %v", name, value, metrics[name])
+		}
+	}
+}
+
 func TestLintCollector(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
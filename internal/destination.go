@@ -82,6 +82,66 @@ func newDestinationFromBinding(bind *Binding) *Destination {
 	return &Destination{bind.Label, domain, bind.Protocol}
 }
 
+// RegisterError is returned when a socket can't be registered since it is of
+// an unsupported kind or in the wrong state.
+type RegisterError struct {
+	// Domain, Type and Protocol of the socket.
+	Domain, Type, Protocol int
+	Listening              bool
+	Connected              bool
+	// DualStack is true for AF_INET6 sockets without IPV6_V6ONLY.
+	DualStack bool
+	// One of ErrBadSocketDomain, ErrBadSocketType, ErrBadSocketProtocol,
+	// ErrBadSocketState or ErrUnsupportedSocket.
+	Err error
+}
+
+func (re *RegisterError) Error() string {
+	kind := re.kind()
+	switch {
+	case re.Err == ErrUnsupportedSocket:
+		return fmt.Sprintf("rejected %s socket: %s", kind, re.Err)
+	case re.Err != ErrBadSocketState:
+		return fmt.Sprintf("rejected unsupported %s socket", kind)
+	case re.DualStack:
+		return fmt.Sprintf("rejected %s dual-stack socket", kind)
+	case re.Type == unix.SOCK_STREAM && !re.Listening:
+		return fmt.Sprintf("rejected %s socket which isn't listening", kind)
+	case re.Type == unix.SOCK_DGRAM && re.Connected:
+		return fmt.Sprintf("rejected connected %s socket", kind)
+	default:
+		return fmt.Sprintf("rejected %s socket: %s", kind, re.Err)
+	}
+}
+
+func (re *RegisterError) Unwrap() error {
+	return re.Err
+}
+
+// kind returns a description like "tcp4" or "udp6".
+func (re *RegisterError) kind() string {
+	var name string
+	switch {
+	case re.Type == unix.SOCK_STREAM && re.Protocol == unix.IPPROTO_TCP:
+		name = "tcp"
+	case re.Type == unix.SOCK_DGRAM && re.Protocol == unix.IPPROTO_UDP:
+		name = "udp"
+	case re.Protocol == unix.IPPROTO_SCTP:
+		name = "sctp"
+	case re.Type == unix.SOCK_RAW:
+		name = "raw"
+	}
+
+	switch {
+	case name != "" && re.Domain == unix.AF_INET:
+		return name + "4"
+	case name != "" && re.Domain == unix.AF_INET6:
+		return name + "6"
+	default:
+		return fmt.Sprintf("(domain %d, type %d, protocol %d)", re.Domain, re.Type, re.Protocol)
+	}
+}
+
 func newDestinationFromFd(label string, fd uintptr) (*Destination, error) {
 	var stat unix.Stat_t
 	err := unix.Fstat(int(fd), &stat)
@@ -121,23 +181,38 @@ func newDestinationFromFd(label string, fd uintptr) (*Destination, error) {
 		unconnected = true
 	}
 
+	regErr := &RegisterError{
+		Domain:    domain,
+		Type:      sotype,
+		Protocol:  proto,
+		Listening: listening,
+		Connected: !unconnected,
+	}
+	reject := func(err error) (*Destination, error) {
+		regErr.Err = err
+		return nil, regErr
+	}
+
 	if domain != unix.AF_INET && domain != unix.AF_INET6 {
-		return nil, fmt.Errorf("unsupported socket domain %v: %w", domain, ErrBadSocketDomain)
+		return reject(ErrBadSocketDomain)
+	}
+	if sotype == unix.SOCK_RAW || proto == unix.IPPROTO_SCTP {
+		return reject(ErrUnsupportedSocket)
 	}
 	if sotype != unix.SOCK_STREAM && sotype != unix.SOCK_DGRAM {
-		return nil, fmt.Errorf("unsupported socket type %v: %w", sotype, ErrBadSocketType)
+		return reject(ErrBadSocketType)
 	}
 	if sotype == unix.SOCK_STREAM && proto != unix.IPPROTO_TCP {
-		return nil, fmt.Errorf("unsupported stream socket protocol %v: %w", proto, ErrBadSocketProtocol)
+		return reject(ErrBadSocketProtocol)
 	}
 	if sotype == unix.SOCK_DGRAM && proto != unix.IPPROTO_UDP {
-		return nil, fmt.Errorf("unsupported packet socket protocol %v: %w", proto, ErrBadSocketDomain)
+		return reject(ErrBadSocketDomain)
 	}
 	if sotype == unix.SOCK_STREAM && !listening {
-		return nil, fmt.Errorf("stream socket not listening: %w", ErrBadSocketState)
+		return reject(ErrBadSocketState)
 	}
 	if sotype == unix.SOCK_DGRAM && !unconnected {
-		return nil, fmt.Errorf("packet socket is connected: %w", ErrBadSocketState)
+		return reject(ErrBadSocketState)
 	}
 
 	// Reject dual-stack sockets
@@ -147,7 +222,8 @@ func newDestinationFromFd(label string, fd uintptr) (*Destination, error) {
 			return nil, fmt.Errorf("getsockopt(IPV6_V6ONLY): %w", err)
 		}
 		if v6only != 1 {
-			return nil, fmt.Errorf("unsupported dual-stack ipv6 socket (not v6only): %w", ErrBadSocketState)
+			regErr.DualStack = true
+			return reject(ErrBadSocketState)
 		}
 	}
 
@@ -181,6 +257,9 @@ type destinations struct {
 	sockets *ebpf.Map
 	metrics *ebpf.Map
 	maxID   destinationID
+	// Reverse index of allocs, built on first use. allocs remains the
+	// source of truth: entries are checked against it before use.
+	ids map[destinationID]destinationKey
 }
 
 // newDestinations creates destinations from BPF maps.
@@ -192,6 +271,7 @@ func newDestinations(maps dispatcherMaps) *destinations {
 		maps.Sockets,
 		maps.DestinationMetrics,
 		destinationID(maps.Sockets.MaxEntries()),
+		nil,
 	}
 }
 
@@ -250,6 +330,7 @@ func (dests *destinations) RemoveSocket(dest *Destination) error {
 		if err := dests.allocs.Delete(key); err != nil {
 			return err
 		}
+		delete(dests.ids, alloc.ID)
 	}
 
 	return nil
@@ -281,7 +362,7 @@ func (dests *destinations) Acquire(dest *Destination) (destinationID, error) {
 
 	alloc, err := dests.getAllocation(key)
 	if err != nil {
-		return 0, fmt.Errorf("get allocation for %v: %s", key, err)
+		return 0, fmt.Errorf("get allocation for %v: %w", key, err)
 	}
 
 	alloc.Count++
@@ -344,54 +425,153 @@ func (dests *destinations) getAllocation(key *destinationKey) (*destinationAlloc
 
 			id = allocatedID + 1
 			if id == 0 || id >= dests.maxID {
-				return nil, fmt.Errorf("allocate destination: ran out of ids")
+				return nil, fmt.Errorf("allocate destination: %w", ErrNoDestinationIDs)
 			}
 		}
 	}
 
+	if err := dests.resetMetrics(id); err != nil {
+		return nil, err
+	}
+
+	alloc = &destinationAlloc{ID: id}
+
+	// This may replace an unused-but-not-deleted allocation.
+	if err := dests.allocs.Update(key, alloc, ebpf.UpdateAny); err != nil {
+		return nil, fmt.Errorf("allocate destination: %s", err)
+	}
+
+	if dests.ids != nil {
+		dests.ids[id] = *key
+	}
+
+	return alloc, nil
+}
+
+func (dests *destinations) resetMetrics(id destinationID) error {
 	// Reset metrics to zero. There is currently no more straighforward way to
 	// do this.
 	var perCPUMetrics []DestinationMetrics
 	if err := dests.metrics.Lookup(id, &perCPUMetrics); err != nil {
-		return nil, fmt.Errorf("lookup metrics for id %d: %s", id, err)
+		return fmt.Errorf("lookup metrics for id %d: %s", id, err)
 	}
 
 	zero := make([]DestinationMetrics, len(perCPUMetrics))
 	if err := dests.metrics.Put(id, zero); err != nil {
-		return nil, fmt.Errorf("zero metrics for id %d: %s", id, err)
+		return fmt.Errorf("zero metrics for id %d: %s", id, err)
 	}
 
-	alloc = &destinationAlloc{ID: id}
+	return nil
+}
 
-	// This may replace an unused-but-not-deleted allocation.
-	if err := dests.allocs.Update(key, alloc, ebpf.UpdateAny); err != nil {
-		return nil, fmt.Errorf("allocate destination: %s", err)
+// GC deletes allocations which have no references and no socket.
+//
+// Such allocations are left behind when a registered socket is closed
+// without being unregistered first.
+func (dests *destinations) GC() (removed int, _ error) {
+	var (
+		key    destinationKey
+		alloc  destinationAlloc
+		unused = make(map[destinationKey]destinationID)
+		iter   = dests.allocs.Iterate()
+	)
+	for iter.Next(&key, &alloc) {
+		if !dests.allocationInUse(&alloc) {
+			unused[key] = alloc.ID
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, fmt.Errorf("iterate allocations: %s", err)
 	}
 
-	return alloc, nil
+	for key, id := range unused {
+		key := key
+		if err := dests.allocs.Delete(&key); err != nil {
+			return removed, fmt.Errorf("delete allocation %s: %s", &key, err)
+		}
+		delete(dests.ids, id)
+		removed++
+
+		if err := dests.resetMetrics(id); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
 }
 
 // ReleaseByID releases a reference on a destination by its ID.
-//
-// This function is linear to the number of destinations and should be avoided
-// if possible.
 func (dests *destinations) ReleaseByID(id destinationID) error {
+	key, alloc, err := dests.allocationByID(id)
+	if err != nil {
+		return fmt.Errorf("release reference: %s", err)
+	}
+
+	return dests.releaseAllocation(key, *alloc)
+}
+
+// ByID returns the destination with the given id.
+func (dests *destinations) ByID(id destinationID) (*Destination, error) {
+	key, _, err := dests.allocationByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Destination{key.Label.String(), key.Domain, key.Protocol}, nil
+}
+
+// allocationByID finds the allocation for id via the reverse index.
+//
+// The index is rebuilt from allocs if it is cold or out of date, which is
+// linear to the number of destinations.
+func (dests *destinations) allocationByID(id destinationID) (*destinationKey, *destinationAlloc, error) {
+	if key, ok := dests.ids[id]; ok {
+		var alloc destinationAlloc
+		if err := dests.allocs.Lookup(&key, &alloc); err == nil && alloc.ID == id {
+			return &key, &alloc, nil
+		}
+	}
+
+	if err := dests.rebuildIndex(); err != nil {
+		return nil, nil, err
+	}
+
+	key, ok := dests.ids[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("no allocation for id %d", id)
+	}
+
+	var alloc destinationAlloc
+	if err := dests.allocs.Lookup(&key, &alloc); err != nil {
+		return nil, nil, fmt.Errorf("lookup allocation for id %d: %s", id, err)
+	}
+	return &key, &alloc, nil
+}
+
+func (dests *destinations) rebuildIndex() error {
 	var (
 		key   destinationKey
 		alloc destinationAlloc
+		ids   = make(map[destinationID]destinationKey)
+		inUse = make(map[destinationID]bool)
 		iter  = dests.allocs.Iterate()
 	)
 	for iter.Next(&key, &alloc) {
-		if alloc.ID != id {
+		// An unused allocation may share its ID with the one that replaced
+		// it, prefer the latter.
+		if inUse[alloc.ID] {
 			continue
 		}
 
-		return dests.releaseAllocation(&key, alloc)
+		ids[alloc.ID] = key
+		inUse[alloc.ID] = alloc.Count > 0
 	}
 	if err := iter.Err(); err != nil {
-		return err
+		return fmt.Errorf("iterate allocations: %s", err)
 	}
-	return fmt.Errorf("release reference: no allocation for id %d", id)
+
+	dests.ids = ids
+	return nil
 }
 
 // Release a reference on a destination.
@@ -427,6 +607,7 @@ func (dests *destinations) releaseAllocation(key *destinationKey, alloc destinat
 	if err := dests.allocs.Delete(key); err != nil {
 		return fmt.Errorf("delete allocation: %s", err)
 	}
+	delete(dests.ids, alloc.ID)
 	return nil
 }
 
@@ -463,6 +644,63 @@ func (dests *destinations) List() (map[destinationID]*Destination, error) {
 	return result, nil
 }
 
+// InUse returns how many IDs can't be reused, since they are referenced by a
+// binding or a socket.
+//
+// Allocations left behind by a closed socket aren't counted.
+func (dests *destinations) InUse() (int, error) {
+	var (
+		key   destinationKey
+		alloc destinationAlloc
+		ids   = make(map[destinationID]bool)
+		iter  = dests.allocs.Iterate()
+	)
+	for iter.Next(&key, &alloc) {
+		if dests.allocationInUse(&alloc) {
+			ids[alloc.ID] = true
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, fmt.Errorf("iterate allocations: %s", err)
+	}
+	return len(ids), nil
+}
+
+// Unserved returns destinations which are referenced by bindings, but which
+// don't have a socket.
+func (dests *destinations) Unserved() (map[destinationID]*Destination, error) {
+	var (
+		key    destinationKey
+		alloc  destinationAlloc
+		result = make(map[destinationID]*Destination)
+		iter   = dests.allocs.Iterate()
+	)
+	for iter.Next(&key, &alloc) {
+		if alloc.Count == 0 {
+			continue
+		}
+
+		var cookie SocketCookie
+		err := dests.sockets.Lookup(alloc.ID, &cookie)
+		if err == nil && cookie != 0 {
+			continue
+		}
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, fmt.Errorf("lookup socket for id %d: %s", alloc.ID, err)
+		}
+
+		result[alloc.ID] = &Destination{
+			key.Label.String(),
+			key.Domain,
+			key.Protocol,
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("can't iterate allocations: %s", err)
+	}
+	return result, nil
+}
+
 func (dests *destinations) Sockets() (map[destinationID]SocketCookie, error) {
 	var (
 		id      destinationID
@@ -481,18 +719,37 @@ func (dests *destinations) Sockets() (map[destinationID]SocketCookie, error) {
 	return sockets, nil
 }
 
-func (dests *destinations) Metrics(destIDs map[destinationID]*Destination) (map[destinationID]DestinationMetrics, error) {
+// Metrics returns the counters for the given destinations.
+//
+// Destinations for which the counters can't be read are omitted from the
+// result, and an error is returned for each of them instead.
+func (dests *destinations) Metrics(destIDs map[destinationID]*Destination) (map[destinationID]DestinationMetrics, []error) {
+	perCPU, errs := dests.MetricsPerCPU(destIDs)
+
 	metrics := make(map[destinationID]DestinationMetrics)
+	for id, perCPUMetrics := range perCPU {
+		metrics[id] = sumDestinationMetrics(perCPUMetrics)
+	}
+
+	return metrics, errs
+}
+
+// MetricsPerCPU is like Metrics, but returns the counters of each possible
+// CPU instead of their sum.
+func (dests *destinations) MetricsPerCPU(destIDs map[destinationID]*Destination) (map[destinationID][]DestinationMetrics, []error) {
+	var errs []error
+	metrics := make(map[destinationID][]DestinationMetrics)
 	for id, dest := range destIDs {
 		var perCPUMetrics []DestinationMetrics
 		if err := dests.metrics.Lookup(id, &perCPUMetrics); err != nil {
-			return nil, fmt.Errorf("metrics for destination %s: %s", dest, err)
+			errs = append(errs, fmt.Errorf("metrics for destination %s: %s", dest, err))
+			continue
 		}
 
-		metrics[id] = sumDestinationMetrics(perCPUMetrics)
+		metrics[id] = perCPUMetrics
 	}
 
-	return metrics, nil
+	return metrics, errs
 }
 
 type DestinationMetrics struct {
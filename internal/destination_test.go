@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -105,6 +108,22 @@ func TestDestinationIDAllocation(t *testing.T) {
 		checkDestinations(t, dests, baz, bingo, quux, frood)
 	})
 
+	t.Run("exhausted", func(t *testing.T) {
+		dests := mustNewDestinations(t)
+		for id := destinationID(0); id < dests.maxID; id++ {
+			dest := &Destination{fmt.Sprint("label-", id), AF_INET, TCP}
+			acquire(t, dests, dest, id)
+		}
+
+		_, err := dests.Acquire(foo)
+		if !errors.Is(err, ErrNoDestinationIDs) {
+			t.Fatal("Expected ErrNoDestinationIDs, got", err)
+		}
+		if !strings.Contains(err.Error(), "allocate destination") {
+			t.Error("Error doesn't contain context:", err)
+		}
+	})
+
 	t.Run("release by id", func(t *testing.T) {
 		dests := mustNewDestinations(t)
 		acquire(t, dests, foo, 0)
@@ -121,6 +140,85 @@ func TestDestinationIDAllocation(t *testing.T) {
 	})
 }
 
+func TestDestinationsIndex(t *testing.T) {
+	dests := mustNewDestinations(t)
+
+	checkIndex := func(t *testing.T) {
+		t.Helper()
+
+		list, err := dests.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for id, want := range list {
+			have, err := dests.ByID(id)
+			if err != nil {
+				t.Fatalf("ByID(%d): %s", id, err)
+			}
+			if *have != *want {
+				t.Errorf("ByID(%d) returns %s instead of %s", id, have, want)
+			}
+		}
+
+		for id, key := range dests.ids {
+			var alloc destinationAlloc
+			if err := dests.allocs.Lookup(&key, &alloc); err != nil {
+				t.Errorf("Index contains %d for missing allocation %s", id, &key)
+			} else if alloc.ID != id {
+				t.Errorf("Index contains %d for %s, which has id %d", id, &key, alloc.ID)
+			}
+		}
+	}
+
+	var all []*Destination
+	for i := 0; i < 10; i++ {
+		dest := &Destination{fmt.Sprint("label-", i), AF_INET, TCP}
+		if _, err := dests.Acquire(dest); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, dest)
+	}
+
+	// Builds the index.
+	checkIndex(t)
+
+	for round := 0; round < 3; round++ {
+		for i, dest := range all {
+			if i%2 != round%2 {
+				continue
+			}
+
+			id, err := dests.Acquire(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Drop both references, which deletes the allocation.
+			if err := dests.ReleaseByID(id); err != nil {
+				t.Fatal("Can't release by id:", err)
+			}
+			if err := dests.ReleaseByID(id); err != nil {
+				t.Fatal("Can't release by id:", err)
+			}
+		}
+		checkIndex(t)
+
+		for i, dest := range all {
+			if i%2 == round%2 {
+				if _, err := dests.Acquire(dest); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		checkIndex(t)
+	}
+
+	if _, err := dests.ByID(dests.maxID - 1); err == nil {
+		t.Error("ByID returns a destination for an unallocated id")
+	}
+}
+
 func TestDestinationsAddSocket(t *testing.T) {
 	dests := mustNewDestinations(t)
 
@@ -166,13 +264,96 @@ func TestDestinationsAddSocket(t *testing.T) {
 		t.Fatal("Expected one sockets, got", len(sockets))
 	}
 
-	// TODO: Remove socket
+	if err := dests.RemoveSocket(dest); err != nil {
+		t.Fatal("Can't remove socket:", err)
+	}
+
+	sockets, err = dests.Sockets()
+	if err != nil {
+		t.Fatal("Can't get sockets:", err)
+	}
+	if len(sockets) != 0 {
+		t.Fatal("Expected no sockets after removal, got", len(sockets))
+	}
+
+	// Without bindings the destination is released as well.
+	checkDestinations(t, dests)
+
+	if err := dests.RemoveSocket(dest); !errors.Is(err, ebpf.ErrKeyNotExist) {
+		t.Error("Removing a socket twice doesn't return ErrKeyNotExist:", err)
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Go creates dual-stack sockets for wildcard addresses only.
+	dual, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dual.Close()
+
+	_, err = newDestinationFromConn("foo", dual.(syscall.Conn))
+	if !errors.Is(err, ErrBadSocketState) {
+		t.Fatal("Expected ErrBadSocketState, got", err)
+	}
+
+	var regErr *RegisterError
+	if !errors.As(err, &regErr) {
+		t.Fatal("Error isn't a RegisterError:", err)
+	}
+
+	if !regErr.DualStack {
+		t.Error("DualStack isn't set")
+	}
+
+	if have, want := err.Error(), "rejected udp6 dual-stack socket"; have != want {
+		t.Errorf("Expected message %q, got %q", want, have)
+	}
+
+	if _, err := newDestinationFromConn("foo", conn.(syscall.Conn)); err != nil {
+		t.Error("Can't create destination from v6only socket:", err)
+	}
+}
+
+func TestDestinationsPartialMetrics(t *testing.T) {
+	dests := mustNewDestinations(t)
+	foo := &Destination{"foo", AF_INET, TCP}
+	bar := &Destination{"bar", AF_INET, UDP}
+
+	id, err := dests.Acquire(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An ID outside of the metrics map can't be looked up.
+	metrics, errs := dests.Metrics(map[destinationID]*Destination{
+		id:              foo,
+		dests.maxID + 1: bar,
+	})
+
+	if len(errs) != 1 {
+		t.Error("Expected one error, got", errs)
+	}
+
+	if _, ok := metrics[id]; !ok {
+		t.Error("Missing metrics for", foo)
+	}
+
+	if n := len(metrics); n != 1 {
+		t.Error("Expected metrics for one destination, got", n)
+	}
 }
 
 func mustNewDestinations(tb testing.TB) *destinations {
 	tb.Helper()
 
-	spec, err := loadPatchedDispatcher(nil, nil)
+	spec, err := loadPatchedDispatcher(nil, nil, 0, nil)
 	if err != nil {
 		tb.Fatal(err)
 	}
@@ -220,3 +401,26 @@ func checkDestinations(tb testing.TB, dests *destinations, want ...*Destination)
 		tb.Error("Missing destination:", &dest)
 	}
 }
+
+func BenchmarkDestinationsReleaseByID(b *testing.B) {
+	dests := mustNewDestinations(b)
+	for i := 0; i < 512; i++ {
+		if _, err := dests.Acquire(&Destination{fmt.Sprint("label-", i), AF_INET, TCP}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	dest := &Destination{"label-256", AF_INET, TCP}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id, err := dests.Acquire(dest)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if err := dests.ReleaseByID(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,15 +9,21 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
 	"kernel.org/pub/linux/libs/security/libcap/cap"
 
 	"github.com/cloudflare/tubular/internal/lock"
+	"github.com/cloudflare/tubular/internal/log"
 )
 
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc "$CLANG" -strip "$STRIP" -makebase "$MAKEDIR" dispatcher ../ebpf/inet-kern.c -- -mcpu=v2 -nostdinc -Wall -Werror -I../ebpf/include
@@ -25,28 +32,115 @@ import (
 var (
 	ErrLoaded            = errors.New("dispatcher already loaded")
 	ErrNotLoaded         = errors.New("dispatcher not loaded")
+	ErrNetNSGone         = errors.New("network namespace is gone")
+	ErrNotNetNS          = errors.New("not a network namespace")
+	ErrLocked            = errors.New("dispatcher is locked")
+	ErrInUse             = errors.New("dispatcher is in use")
+	ErrWrongFamily       = errors.New("label only has a socket for the other address family")
 	ErrNotSocket         = syscall.ENOTSOCK
 	ErrBadSocketDomain   = syscall.EPFNOSUPPORT
 	ErrBadSocketType     = syscall.ESOCKTNOSUPPORT
 	ErrBadSocketProtocol = syscall.EPROTONOSUPPORT
 	ErrBadSocketState    = syscall.EBADFD
+	ErrUnsupportedSocket = errors.New("sk_lookup only supports TCP and UDP sockets")
+	ErrNoDestinationIDs  = errors.New("ran out of destination ids")
+	ErrNotBPFFS          = errors.New("not a BPF filesystem")
+	// Returned if the kernel can't run the dispatcher.
+	ErrMissingKernelFeature = errors.New("missing kernel feature")
 )
 
 // CreateCapabilities are required to create a new dispatcher.
 var CreateCapabilities = []cap.Value{cap.SYS_ADMIN, cap.NET_ADMIN}
 
+// CurrentStateVersion is the version of the state layout created by this
+// package. It is stamped into the state directory when creating or upgrading
+// a dispatcher.
+const CurrentStateVersion uint32 = 1
+
 // Dispatcher manipulates the socket dispatch data plane.
 type Dispatcher struct {
 	stateDir     *lock.File
 	Path         string
 	bindings     *ebpf.Map
 	destinations *destinations
+	stateVersion uint32
+	netnsPath    string
+	readOnly     bool
+	lockWait     time.Duration
+	// Audit is invoked after each successful change to bindings or
+	// sockets, if it is not nil.
+	Audit func(*AuditRecord)
+}
+
+// Permissions control access to the state of a dispatcher.
+type Permissions struct {
+	// Mode of the state directory. Being able to open the directory implies
+	// being able to flock it.
+	DirMode os.FileMode
+	// Mode of the pinned maps, program and link.
+	ObjectMode os.FileMode
+	// Group which owns the state, or -1 to keep the group of the caller.
+	GID int
+}
+
+// DefaultPermissions allow the group read-only access to state.
+var DefaultPermissions = Permissions{
+	// Only let group list and open the directory. This is important since
+	// being able to open a directory implies being able to flock it.
+	DirMode:    0750,
+	ObjectMode: 0640,
+	GID:        -1,
 }
 
 // CreateDispatcher loads the dispatcher into a network namespace.
 //
 // Returns ErrLoaded if the namespace already has the dispatcher enabled.
-func CreateDispatcher(netnsPath, bpfFsPath string) (_ *Dispatcher, err error) {
+func CreateDispatcher(netnsPath, bpfFsPath string) (*Dispatcher, error) {
+	return CreateDispatcherWithPermissions(netnsPath, bpfFsPath, DefaultPermissions)
+}
+
+// MountBPFFS mounts a BPF filesystem at path unless there already is one.
+// Requires CAP_SYS_ADMIN.
+//
+// Returns true if a filesystem was mounted.
+func MountBPFFS(path string) (bool, error) {
+	err := checkBPFFS(path)
+	if err == nil {
+		return false, nil
+	} else if !errors.Is(err, ErrNotBPFFS) {
+		return false, err
+	}
+
+	if err := unix.Mount("bpf", path, "bpf", 0, ""); err != nil {
+		return false, fmt.Errorf("mount BPF filesystem at %s: %w", path, err)
+	}
+
+	return true, nil
+}
+
+// CreateDispatcherWithPermissions is like CreateDispatcher, but applies
+// perms to the state of the dispatcher.
+func CreateDispatcherWithPermissions(netnsPath, bpfFsPath string, perms Permissions) (*Dispatcher, error) {
+	return CreateDispatcherWithOptions(netnsPath, bpfFsPath, CreateOptions{
+		Permissions: perms,
+	})
+}
+
+// CreateOptions control the behaviour of CreateDispatcherWithOptions.
+type CreateOptions struct {
+	// Permissions to apply to the state of the dispatcher.
+	Permissions Permissions
+	// The maximum number of destinations, or zero to use the default. The
+	// limit can't be changed once the dispatcher is created.
+	MaxDestinations uint32
+	// An alternate BPF object to load instead of the embedded one, see
+	// UpgradeOptions.Object.
+	Object io.ReaderAt
+}
+
+// CreateDispatcherWithOptions is like CreateDispatcher, but allows changing
+// permissions and the size of the dispatcher.
+func CreateDispatcherWithOptions(netnsPath, bpfFsPath string, opts CreateOptions) (_ *Dispatcher, err error) {
 	closeOnError := func(c io.Closer) {
 		if err != nil {
 			c.Close()
@@ -74,9 +168,13 @@ func CreateDispatcher(netnsPath, bpfFsPath string) (_ *Dispatcher, err error) {
 	var objs dispatcherObjects
 	_, err = loadPatchedDispatcher(&objs, &ebpf.CollectionOptions{
 		Maps: ebpf.MapOptions{PinPath: tempDir},
-	})
+	}, opts.MaxDestinations, opts.Object)
 	if err != nil {
-		return nil, fmt.Errorf("load BPF: %s", err)
+		// Explain the failure if it is due to an old kernel.
+		if ferr := CheckKernelFeatures(); errors.Is(ferr, ErrMissingKernelFeature) {
+			return nil, fmt.Errorf("load BPF: %w", ferr)
+		}
+		return nil, fmt.Errorf("load BPF: %w", err)
 	}
 	defer objs.dispatcherPrograms.Close()
 	defer closeOnError(&objs.dispatcherMaps)
@@ -96,7 +194,11 @@ func CreateDispatcher(netnsPath, bpfFsPath string) (_ *Dispatcher, err error) {
 		return nil, fmt.Errorf("can't pin link: %s", err)
 	}
 
-	if err := adjustPermissions(tempDir); err != nil {
+	if err := writeStateVersion(tempDir); err != nil {
+		return nil, err
+	}
+
+	if err := adjustPermissions(tempDir, opts.Permissions); err != nil {
 		return nil, fmt.Errorf("adjust permissions: %s", err)
 	}
 
@@ -110,19 +212,23 @@ func CreateDispatcher(netnsPath, bpfFsPath string) (_ *Dispatcher, err error) {
 	}
 
 	dests := newDestinations(objs.dispatcherMaps)
-	return &Dispatcher{dir, pinPath, objs.Bindings, dests}, nil
+	return &Dispatcher{dir, pinPath, objs.Bindings, dests, CurrentStateVersion, netnsPath, false, 0, nil}, nil
 }
 
-func adjustPermissions(path string) error {
-	const (
-		// Only let group list and open the directory. This is important since
-		// being able to open a directory implies being able to flock it.
-		dirMode os.FileMode = 0750
-		// Allow group read-only access to state.
-		objMode os.FileMode = 0640
-	)
+func adjustPermissions(path string, perms Permissions) error {
+	if perms.DirMode&0700 != 0700 {
+		return fmt.Errorf("directory mode %v doesn't give owner full access", perms.DirMode)
+	}
+
+	if perms.ObjectMode&0600 != 0600 {
+		return fmt.Errorf("object mode %v doesn't give owner read-write access", perms.ObjectMode)
+	}
+
+	if err := os.Chmod(path, perms.DirMode); err != nil {
+		return err
+	}
 
-	if err := os.Chmod(path, dirMode); err != nil {
+	if err := os.Lchown(path, -1, perms.GID); err != nil {
 		return err
 	}
 
@@ -137,7 +243,11 @@ func adjustPermissions(path string) error {
 		}
 
 		path := filepath.Join(path, entry.Name())
-		if err := os.Chmod(path, objMode); err != nil {
+		if err := os.Chmod(path, perms.ObjectMode); err != nil {
+			return err
+		}
+
+		if err := os.Lchown(path, -1, perms.GID); err != nil {
 			return err
 		}
 	}
@@ -145,10 +255,54 @@ func adjustPermissions(path string) error {
 	return nil
 }
 
+// statePermissions returns the permissions of existing state.
+func statePermissions(path string) (Permissions, error) {
+	var dir, obj unix.Stat_t
+	if err := unix.Stat(path, &dir); err != nil {
+		return Permissions{}, fmt.Errorf("stat state directory: %s", err)
+	}
+
+	if err := unix.Stat(linkPath(path), &obj); err != nil {
+		return Permissions{}, fmt.Errorf("stat link: %s", err)
+	}
+
+	return Permissions{
+		DirMode:    os.FileMode(dir.Mode) & os.ModePerm,
+		ObjectMode: os.FileMode(obj.Mode) & os.ModePerm,
+		GID:        int(dir.Gid),
+	}, nil
+}
+
 // OpenDispatcher loads an existing dispatcher from a namespace.
 //
 // Returns ErrNotLoaded if the dispatcher is not loaded yet.
-func OpenDispatcher(netnsPath, bpfFsPath string, readOnly bool) (_ *Dispatcher, err error) {
+func OpenDispatcher(netnsPath, bpfFsPath string, readOnly bool) (*Dispatcher, error) {
+	return openDispatcher(netnsPath, bpfFsPath, readOnly, -1)
+}
+
+// OpenDispatcherWithTimeout is like OpenDispatcher, but gives up waiting for
+// other users of the dispatcher after timeout.
+//
+// Returns an error wrapping context.DeadlineExceeded if the timeout expires.
+func OpenDispatcherWithTimeout(netnsPath, bpfFsPath string, readOnly bool, timeout time.Duration) (*Dispatcher, error) {
+	if timeout < 0 {
+		return nil, fmt.Errorf("negative timeout %v", timeout)
+	}
+
+	return openDispatcher(netnsPath, bpfFsPath, readOnly, timeout)
+}
+
+// TryOpenDispatcher is like OpenDispatcher, but doesn't wait for other users
+// of the dispatcher.
+//
+// Returns ErrLocked if the dispatcher is opened by a writer, or if readOnly
+// is false and the dispatcher is opened by anyone else.
+func TryOpenDispatcher(netnsPath, bpfFsPath string, readOnly bool) (*Dispatcher, error) {
+	return openDispatcher(netnsPath, bpfFsPath, readOnly, 0)
+}
+
+// openDispatcher blocks on the state directory lock if timeout is negative.
+func openDispatcher(netnsPath, bpfFsPath string, readOnly bool, timeout time.Duration) (_ *Dispatcher, err error) {
 	closeOnError := func(c io.Closer) {
 		if err != nil {
 			c.Close()
@@ -162,19 +316,40 @@ func OpenDispatcher(netnsPath, bpfFsPath string, readOnly bool) (_ *Dispatcher,
 	defer netns.Close()
 
 	var dir *lock.File
-	if readOnly {
+	start := time.Now()
+	switch {
+	case timeout >= 0:
+		dir, err = openLockedWithTimeout(pinPath, readOnly, timeout)
+	case readOnly:
 		dir, err = lock.OpenLockedShared(pinPath)
-	} else {
+	default:
 		dir, err = lock.OpenLockedExclusive(pinPath)
 	}
+	lockWait := time.Since(start)
 	if os.IsNotExist(err) {
 		return nil, fmt.Errorf("%s: %w", bpfFsPath, ErrNotLoaded)
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrLocked) {
+		return nil, fmt.Errorf("%s: %w", bpfFsPath, err)
 	} else if err != nil {
 		return nil, fmt.Errorf("%s: %s", bpfFsPath, err)
 	}
 	defer closeOnError(dir)
 
-	spec, err := loadPatchedDispatcher(nil, nil)
+	version, err := readStateVersion(pinPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !readOnly && version > CurrentStateVersion {
+		return nil, fmt.Errorf("state version %d is newer than %d, refusing to modify it", version, CurrentStateVersion)
+	}
+
+	maxDestinations, err := pinnedMaxDestinations(pinPath)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := loadPatchedDispatcher(nil, nil, maxDestinations, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -223,11 +398,238 @@ func OpenDispatcher(netnsPath, bpfFsPath string, readOnly bool) (_ *Dispatcher,
 	defer closeOnError(&maps)
 
 	dests := newDestinations(maps)
-	return &Dispatcher{dir, pinPath, maps.Bindings, dests}, nil
+	return &Dispatcher{dir, pinPath, maps.Bindings, dests, version, netnsPath, readOnly, lockWait, nil}, nil
 }
 
-func loadPatchedDispatcher(to interface{}, opts *ebpf.CollectionOptions) (*ebpf.CollectionSpec, error) {
-	spec, err := loadDispatcher()
+// pruneState removes everything from the state at path which isn't used by
+// the link, the program, the state version, the last upgrade or the maps in
+// spec.
+//
+// The caller must hold the exclusive lock on path.
+func pruneState(path string, spec *ebpf.CollectionSpec) error {
+	keep := map[string]bool{
+		linkPath(path):        true,
+		programPath(path):     true,
+		versionPath(path):     true,
+		lastUpgradePath(path): true,
+	}
+	for name := range spec.Maps {
+		keep[filepath.Join(path, name)] = true
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("read state entries: %s", err)
+	}
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		if keep[entryPath] {
+			continue
+		}
+
+		if err := os.RemoveAll(entryPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PinnedMap describes a map in the state of a dispatcher.
+type PinnedMap struct {
+	Name       string
+	Type       ebpf.MapType
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	// The number of keys which have a value.
+	Entries uint32
+}
+
+// PinnedMaps lists the maps in the state of the dispatcher, ordered by name.
+func (d *Dispatcher) PinnedMaps() ([]PinnedMap, error) {
+	skip := map[string]bool{
+		linkPath(d.Path):           true,
+		programPath(d.Path):        true,
+		programUpgradePath(d.Path): true,
+	}
+
+	entries, err := os.ReadDir(d.Path)
+	if err != nil {
+		return nil, fmt.Errorf("read state entries: %s", err)
+	}
+
+	var maps []PinnedMap
+	for _, entry := range entries {
+		path := filepath.Join(d.Path, entry.Name())
+		if skip[path] {
+			continue
+		}
+
+		m, err := ebpf.LoadPinnedMap(path, &ebpf.LoadPinOptions{ReadOnly: true})
+		if err != nil {
+			return nil, fmt.Errorf("load map %s: %s", entry.Name(), err)
+		}
+
+		n, err := countEntries(m)
+		pinned := PinnedMap{entry.Name(), m.Type(), m.KeySize(), m.ValueSize(), m.MaxEntries(), n}
+		m.Close()
+		if err != nil {
+			return nil, fmt.Errorf("map %s: %s", entry.Name(), err)
+		}
+
+		maps = append(maps, pinned)
+	}
+
+	return maps, nil
+}
+
+// countEntries returns the number of keys in m which have a value.
+func countEntries(m *ebpf.Map) (uint32, error) {
+	var (
+		key     interface{}
+		next    = make([]byte, m.KeySize())
+		value   = make([]byte, m.ValueSize())
+		entries uint32
+	)
+
+	for {
+		err := m.NextKey(key, &next)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return entries, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("next key: %s", err)
+		}
+
+		switch m.Type() {
+		case ebpf.PerCPUHash, ebpf.PerCPUArray, ebpf.LRUCPUHash:
+			// Keys of per-CPU maps always have a value.
+			entries++
+
+		default:
+			// Some maps, like sockmaps, have keys without a value.
+			err := m.Lookup(next, &value)
+			if err == nil {
+				entries++
+			} else if !errors.Is(err, ebpf.ErrKeyNotExist) {
+				return 0, fmt.Errorf("lookup: %s", err)
+			}
+		}
+
+		key = append([]byte(nil), next...)
+	}
+}
+
+// writeStateVersion stamps CurrentStateVersion into the state at path.
+//
+// bpffs doesn't allow regular files, so the version is stored in a pinned
+// array map.
+func writeStateVersion(path string) error {
+	m, err := ebpf.LoadPinnedMap(versionPath(path), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		m, err = ebpf.NewMap(&ebpf.MapSpec{
+			Name:       "version",
+			Type:       ebpf.Array,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 1,
+		})
+		if err != nil {
+			return fmt.Errorf("create version map: %s", err)
+		}
+		defer m.Close()
+
+		if err := m.Pin(versionPath(path)); err != nil {
+			return fmt.Errorf("pin version map: %s", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("load version map: %s", err)
+	} else {
+		defer m.Close()
+	}
+
+	if err := m.Put(uint32(0), CurrentStateVersion); err != nil {
+		return fmt.Errorf("write state version: %s", err)
+	}
+	return nil
+}
+
+// readStateVersion returns the version stamped into the state at path.
+//
+// Returns zero if the state predates versioning.
+func readStateVersion(path string) (uint32, error) {
+	m, err := ebpf.LoadPinnedMap(versionPath(path), &ebpf.LoadPinOptions{ReadOnly: true})
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("load version map: %s", err)
+	}
+	defer m.Close()
+
+	var version uint32
+	if err := m.Lookup(uint32(0), &version); err != nil {
+		return 0, fmt.Errorf("read state version: %s", err)
+	}
+	return version, nil
+}
+
+// StateVersion returns the version of the state layout the dispatcher was
+// opened with, see CurrentStateVersion.
+//
+// Returns zero if the state predates versioning.
+func (d *Dispatcher) StateVersion() uint32 {
+	return d.stateVersion
+}
+
+// LockWait returns how long opening the dispatcher waited for the lock on
+// the state directory. Always zero for a newly created dispatcher.
+func (d *Dispatcher) LockWait() time.Duration {
+	return d.lockWait
+}
+
+// openLockedWithTimeout polls the lock on path with exponential backoff until
+// it is acquired or timeout expires.
+//
+// A zero timeout tries to acquire the lock once and returns ErrLocked on
+// failure.
+func openLockedWithTimeout(path string, shared bool, timeout time.Duration) (*lock.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := lock.Exclusive(file)
+	if shared {
+		dir = lock.Shared(file)
+	}
+
+	if timeout == 0 {
+		if !dir.TryLock() {
+			file.Close()
+			return nil, ErrLocked
+		}
+		return dir, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := dir.LockContext(ctx); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("acquire lock: %w", err)
+	}
+
+	return dir, nil
+}
+
+// loadPatchedDispatcher sizes the maps holding destinations according to
+// maxDestinations, unless it is zero.
+//
+// Loads object instead of the embedded dispatcher if it isn't nil.
+func loadPatchedDispatcher(to interface{}, opts *ebpf.CollectionOptions, maxDestinations uint32, object io.ReaderAt) (*ebpf.CollectionSpec, error) {
+	spec, err := loadDispatcherSpec(object)
 	if err != nil {
 		return nil, err
 	}
@@ -247,6 +649,16 @@ func loadPatchedDispatcher(to interface{}, opts *ebpf.CollectionOptions) (*ebpf.
 		}
 	}
 
+	if maxDestinations != 0 {
+		for _, m := range []*ebpf.MapSpec{
+			specs.Sockets,
+			specs.Destinations,
+			specs.DestinationMetrics,
+		} {
+			m.MaxEntries = maxDestinations
+		}
+	}
+
 	specs.Destinations.KeySize = uint32(binary.Size(destinationKey{}))
 	specs.Destinations.ValueSize = uint32(binary.Size(destinationAlloc{}))
 
@@ -257,16 +669,102 @@ func loadPatchedDispatcher(to interface{}, opts *ebpf.CollectionOptions) (*ebpf.
 	return spec, nil
 }
 
+func loadDispatcherSpec(object io.ReaderAt) (*ebpf.CollectionSpec, error) {
+	if object == nil {
+		return loadDispatcher()
+	}
+
+	spec, err := ebpf.LoadCollectionSpecFromReader(object)
+	if err != nil {
+		return nil, fmt.Errorf("load alternate object: %s", err)
+	}
+
+	if err := isSpecCompatible(spec); err != nil {
+		return nil, fmt.Errorf("alternate object: %s", err)
+	}
+
+	return spec, nil
+}
+
+// isSpecCompatible checks that spec declares the same program and maps as the
+// embedded dispatcher.
+func isSpecCompatible(spec *ebpf.CollectionSpec) error {
+	embedded, err := loadDispatcher()
+	if err != nil {
+		return err
+	}
+
+	var want, have dispatcherSpecs
+	if err := embedded.Assign(&want); err != nil {
+		return err
+	}
+	if err := spec.Assign(&have); err != nil {
+		return err
+	}
+
+	if have.Dispatcher.Type != want.Dispatcher.Type {
+		return fmt.Errorf("program %q has type %s instead of %s", have.Dispatcher.Name, have.Dispatcher.Type, want.Dispatcher.Type)
+	}
+
+	for _, maps := range [][2]*ebpf.MapSpec{
+		{have.Bindings, want.Bindings},
+		{have.Sockets, want.Sockets},
+		{have.Destinations, want.Destinations},
+		{have.DestinationMetrics, want.DestinationMetrics},
+	} {
+		have, want := maps[0], maps[1]
+		switch {
+		case have.Type != want.Type:
+			return fmt.Errorf("map %q has type %s instead of %s", want.Name, have.Type, want.Type)
+		case have.KeySize != want.KeySize:
+			return fmt.Errorf("map %q has key size %d instead of %d", want.Name, have.KeySize, want.KeySize)
+		case have.ValueSize != want.ValueSize:
+			return fmt.Errorf("map %q has value size %d instead of %d", want.Name, have.ValueSize, want.ValueSize)
+		}
+	}
+
+	return nil
+}
+
+// UpgradeOptions control the behaviour of UpgradeDispatcherWithOptions.
+type UpgradeOptions struct {
+	// Permissions to apply to the state of the dispatcher. The zero value
+	// keeps the current permissions.
+	Permissions Permissions
+	// Remove pinned objects which aren't used by the dispatcher.
+	Prune bool
+	// An alternate BPF object to load instead of the embedded one, or nil.
+	// It must declare the same maps as the embedded object.
+	//
+	// Writable OpenDispatcher calls refuse to modify a dispatcher running an
+	// alternate program, since it doesn't match the embedded one. Upgrade
+	// without Object to go back.
+	Object io.ReaderAt
+	// Audit is invoked after a successful upgrade, if it is not nil.
+	Audit func(*AuditRecord)
+	// Logger receives warnings which don't fail the upgrade, if it is not
+	// nil.
+	Logger log.Logger
+}
+
 // UpgradeDispatcher updates the datapath program for the given dispatcher.
 //
 // It doesn't remove old unused state.
 //
 // Returns the program ID of the new dispatcher or an error.
 func UpgradeDispatcher(netnsPath, bpfFsPath string) (ebpf.ProgramID, error) {
-	return upgradeDispatcher(netnsPath, bpfFsPath, (*link.NetNsLink).Update)
+	return UpgradeDispatcherWithOptions(netnsPath, bpfFsPath, UpgradeOptions{
+		Permissions: DefaultPermissions,
+	})
+}
+
+// UpgradeDispatcherWithOptions is like UpgradeDispatcher, but allows
+// changing permissions and removing old unused state.
+func UpgradeDispatcherWithOptions(netnsPath, bpfFsPath string, opts UpgradeOptions) (ebpf.ProgramID, error) {
+	return upgradeDispatcher(netnsPath, bpfFsPath, opts, (*link.NetNsLink).Update)
 }
 
-func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsLink, *ebpf.Program) error) (ebpf.ProgramID, error) {
+func upgradeDispatcher(netnsPath, bpfFsPath string, opts UpgradeOptions, linkUpdate func(*link.NetNsLink, *ebpf.Program) error) (ebpf.ProgramID, error) {
 	netns, pinPath, err := openNetNS(netnsPath, bpfFsPath)
 	if err != nil {
 		return 0, err
@@ -279,10 +777,15 @@ func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsL
 	}
 	defer dir.Close()
 
+	maxDestinations, err := pinnedMaxDestinations(pinPath)
+	if err != nil {
+		return 0, err
+	}
+
 	var objs dispatcherObjects
-	_, err = loadPatchedDispatcher(&objs, &ebpf.CollectionOptions{
+	spec, err := loadPatchedDispatcher(&objs, &ebpf.CollectionOptions{
 		Maps: ebpf.MapOptions{PinPath: pinPath},
-	})
+	}, maxDestinations, opts.Object)
 	if err != nil {
 		// We will fail here if the pinned maps are not compatible. This is
 		// something we might have to solve in the future.
@@ -290,6 +793,12 @@ func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsL
 	}
 	defer objs.Close()
 
+	if opts.Prune {
+		if err := pruneState(pinPath, spec); err != nil {
+			return 0, fmt.Errorf("prune state: %s", err)
+		}
+	}
+
 	progInfo, err := objs.Dispatcher.Info()
 	if err != nil {
 		return 0, fmt.Errorf("get program info: %s", err)
@@ -302,6 +811,26 @@ func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsL
 	}
 	defer nslink.Close()
 
+	linkInfo, err := nslink.Info()
+	if err != nil {
+		return 0, fmt.Errorf("link info: %s", err)
+	}
+	prevID := linkInfo.Program
+
+	perms := opts.Permissions
+	if perms == (Permissions{}) {
+		perms, err = statePermissions(pinPath)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	lastUpgrade, err := openLastUpgrade(pinPath)
+	if err != nil {
+		return 0, err
+	}
+	defer lastUpgrade.Close()
+
 	progPath := programPath(pinPath)
 	tmpPath := programUpgradePath(pinPath)
 	if err := objs.Dispatcher.Pin(tmpPath); err != nil {
@@ -310,10 +839,14 @@ func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsL
 	// Remove the temporary program pin if the update fails.
 	defer os.Remove(tmpPath)
 
+	if err := writeStateVersion(pinPath); err != nil {
+		return 0, err
+	}
+
 	// Adjust permissions, since the mode we want may have changed.
 	// There is a risk here that we change permissions to something that an
 	// old version of the binary can't deal with.
-	if err := adjustPermissions(pinPath); err != nil {
+	if err := adjustPermissions(pinPath, perms); err != nil {
 		return 0, fmt.Errorf("adjust permissions: %s", err)
 	}
 
@@ -329,9 +862,109 @@ func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsL
 		return 0, fmt.Errorf("rename program: %s", err)
 	}
 
+	now := time.Now()
+	record := lastUpgradeValue{uint64(now.UnixNano()), uint32(prevID), uint32(progID)}
+	if err := lastUpgrade.Put(uint32(0), &record); err != nil && opts.Logger != nil {
+		// The new program is live, so the upgrade succeeded regardless.
+		opts.Logger.Logf("Warning: upgraded to program #%d, but can't record upgrade: %s\n", progID, err)
+	}
+
+	if opts.Audit != nil {
+		opts.Audit(&AuditRecord{
+			Time:              now,
+			Operation:         AuditUpgrade,
+			PreviousProgramID: prevID,
+			ProgramID:         progID,
+		})
+	}
+
 	return progID, nil
 }
 
+// Upgrade describes the most recent upgrade of a dispatcher.
+type Upgrade struct {
+	Time              time.Time
+	PreviousProgramID ebpf.ProgramID
+	ProgramID         ebpf.ProgramID
+}
+
+// lastUpgradeValue is the value stored in the last-upgrade map.
+type lastUpgradeValue struct {
+	// Unix time in nanoseconds.
+	Time              uint64
+	PreviousProgramID uint32
+	ProgramID         uint32
+}
+
+// openLastUpgrade loads the last-upgrade map from the state at path, and
+// creates it if necessary.
+func openLastUpgrade(path string) (*ebpf.Map, error) {
+	m, err := ebpf.LoadPinnedMap(lastUpgradePath(path), nil)
+	if err == nil {
+		return m, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("load last-upgrade map: %s", err)
+	}
+
+	m, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "last_upgrade",
+		Type:       ebpf.Array,
+		KeySize:    4,
+		ValueSize:  uint32(binary.Size(lastUpgradeValue{})),
+		MaxEntries: 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create last-upgrade map: %s", err)
+	}
+
+	if err := m.Pin(lastUpgradePath(path)); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("pin last-upgrade map: %s", err)
+	}
+
+	return m, nil
+}
+
+// LastUpgrade returns the most recent upgrade of the dispatcher.
+//
+// Returns nil if the dispatcher was never upgraded.
+func (d *Dispatcher) LastUpgrade() (*Upgrade, error) {
+	m, err := ebpf.LoadPinnedMap(lastUpgradePath(d.Path), &ebpf.LoadPinOptions{ReadOnly: true})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load last-upgrade map: %s", err)
+	}
+	defer m.Close()
+
+	var value lastUpgradeValue
+	if err := m.Lookup(uint32(0), &value); err != nil {
+		return nil, fmt.Errorf("read last upgrade: %s", err)
+	}
+
+	if value.Time == 0 {
+		return nil, nil
+	}
+
+	return &Upgrade{
+		time.Unix(0, int64(value.Time)),
+		ebpf.ProgramID(value.PreviousProgramID),
+		ebpf.ProgramID(value.ProgramID),
+	}, nil
+}
+
+// pinnedMaxDestinations returns the size of existing state, which may differ
+// from the default.
+func pinnedMaxDestinations(pinPath string) (uint32, error) {
+	sockets, err := ebpf.LoadPinnedMap(filepath.Join(pinPath, "sockets"), &ebpf.LoadPinOptions{ReadOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("load sockets: %s", err)
+	}
+	defer sockets.Close()
+
+	return sockets.MaxEntries(), nil
+}
+
 // Close frees associated resources.
 //
 // It does not remove the dispatcher, see UnloadDispatcher.
@@ -346,39 +979,163 @@ func (d *Dispatcher) Close() error {
 	if err := d.stateDir.Close(); err != nil {
 		return fmt.Errorf("can't close state directory handle: %s", err)
 	}
-	return nil
+	return nil
+}
+
+// UnloadDispatcher removes a dispatcher and its associated state.
+//
+// Returns ErrNotLoaded if the dispatcher state directory doesn't exist.
+func UnloadDispatcher(netnsPath, bpfFsPath string) error {
+	return UnloadDispatcherWithOptions(netnsPath, bpfFsPath, UnloadOptions{})
+}
+
+// UnloadOptions control the behaviour of UnloadDispatcherWithOptions.
+type UnloadOptions struct {
+	// Refuse to unload a dispatcher which has bindings or registered
+	// sockets. The check is done while holding the exclusive lock, so a
+	// concurrent writer can't add any before the state is removed.
+	IfUnused bool
+}
+
+// UnloadDispatcherWithOptions is like UnloadDispatcher, but allows
+// refusing to unload a dispatcher that is in use.
+//
+// Returns an error wrapping ErrInUse if opts.IfUnused is true and the
+// dispatcher has bindings or registered sockets.
+func UnloadDispatcherWithOptions(netnsPath, bpfFsPath string, opts UnloadOptions) error {
+	netns, pinPath, err := openNetNS(netnsPath, bpfFsPath)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	dir, err := lock.OpenLockedExclusive(pinPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", bpfFsPath, ErrNotLoaded)
+	} else if err != nil {
+		return fmt.Errorf("%s: %s", bpfFsPath, err)
+	}
+	defer dir.Close()
+
+	if opts.IfUnused {
+		bindings, sockets, err := countUsers(pinPath)
+		if err != nil {
+			return err
+		}
+
+		if bindings > 0 || sockets > 0 {
+			return fmt.Errorf("%d bindings and %d registered sockets: %w", bindings, sockets, ErrInUse)
+		}
+	}
+
+	if err := os.RemoveAll(pinPath); err != nil {
+		return fmt.Errorf("remove pinned state: %s", err)
+	}
+
+	return nil
+}
+
+// countUsers returns the number of bindings and registered sockets in the
+// state at path.
+//
+// The caller must hold the lock on path.
+func countUsers(path string) (bindings, sockets int, _ error) {
+	opts := &ebpf.LoadPinOptions{ReadOnly: true}
+
+	bindingsMap, err := ebpf.LoadPinnedMap(filepath.Join(path, "bindings"), opts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("load bindings: %s", err)
+	}
+	defer bindingsMap.Close()
+
+	var (
+		key   bindingKey
+		value bindingValue
+		iter  = bindingsMap.Iterate()
+	)
+	for iter.Next(&key, &value) {
+		bindings++
+	}
+	if err := iter.Err(); err != nil {
+		return 0, 0, fmt.Errorf("iterate bindings: %s", err)
+	}
+
+	socketsMap, err := ebpf.LoadPinnedMap(filepath.Join(path, "sockets"), opts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("load sockets: %s", err)
+	}
+	defer socketsMap.Close()
+
+	var (
+		id     destinationID
+		cookie SocketCookie
+	)
+	iter = socketsMap.Iterate()
+	for iter.Next(&id, &cookie) {
+		if cookie != 0 {
+			sockets++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, 0, fmt.Errorf("iterate sockets: %s", err)
+	}
+
+	return bindings, sockets, nil
+}
+
+// Program returns the active dispatcher program.
+//
+// The caller must call Program.Close().
+func (dp *Dispatcher) Program() (*ebpf.Program, error) {
+	return ebpf.LoadPinnedProgram(programPath(dp.Path), nil)
+}
+
+// ProgramStats returns how often the active dispatcher program ran, and how
+// long it took on average.
+//
+// The kernel only collects these statistics while they are enabled, either
+// via the kernel.bpf_stats_enabled sysctl or ebpf.EnableStats. Otherwise
+// runs is zero.
+func (dp *Dispatcher) ProgramStats() (runs uint64, avgRuntime time.Duration, err error) {
+	runs, runtime, err := dp.programStats()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if runs > 0 {
+		avgRuntime = runtime / time.Duration(runs)
+	}
+
+	return runs, avgRuntime, nil
 }
 
-// UnloadDispatcher removes a dispatcher and its associated state.
-//
-// Returns ErrNotLoaded if the dispatcher state directory doesn't exist.
-func UnloadDispatcher(netnsPath, bpfFsPath string) error {
-	netns, pinPath, err := openNetNS(netnsPath, bpfFsPath)
+func (dp *Dispatcher) programStats() (runs uint64, runtime time.Duration, err error) {
+	prog, err := dp.Program()
 	if err != nil {
-		return err
+		return 0, 0, fmt.Errorf("load program: %s", err)
 	}
-	defer netns.Close()
+	defer prog.Close()
 
-	dir, err := lock.OpenLockedExclusive(pinPath)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("%s: %w", bpfFsPath, ErrNotLoaded)
-	} else if err != nil {
-		return fmt.Errorf("%s: %s", bpfFsPath, err)
+	info, err := prog.Info()
+	if err != nil {
+		return 0, 0, fmt.Errorf("get program info: %s", err)
 	}
-	defer dir.Close()
 
-	if err := os.RemoveAll(pinPath); err != nil {
-		return fmt.Errorf("remove pinned state: %s", err)
+	runs, ok := info.RunCount()
+	if !ok {
+		return 0, 0, fmt.Errorf("program statistics: %w", ebpf.ErrNotSupported)
 	}
 
-	return nil
+	runtime, _ = info.Runtime()
+	return runs, runtime, nil
 }
 
-// Program returns the active dispatcher program.
+// bpfStatsEnabled returns true if the kernel.bpf_stats_enabled sysctl is set.
 //
-// The caller must call Program.Close().
-func (dp *Dispatcher) Program() (*ebpf.Program, error) {
-	return ebpf.LoadPinnedProgram(programPath(dp.Path), nil)
+// Statistics enabled via ebpf.EnableStats aren't reflected in the sysctl.
+func bpfStatsEnabled() bool {
+	contents, err := os.ReadFile("/proc/sys/kernel/bpf_stats_enabled")
+	return err == nil && strings.TrimSpace(string(contents)) == "1"
 }
 
 type Domain uint8
@@ -446,11 +1203,24 @@ func (p Protocol) String() string {
 //
 // Traffic for the binding is dropped by the data plane if no matching
 // destination exists.
-func (d *Dispatcher) AddBinding(bind *Binding) error {
+//
+// Returns the binding with the same protocol, prefix and port that was
+// overwritten, or nil if there was none.
+func (d *Dispatcher) AddBinding(bind *Binding) (replaced *Binding, err error) {
+	return d.AddBindingContext(context.Background(), bind)
+}
+
+// AddBindingContext is like AddBinding, but doesn't make any changes if ctx
+// is cancelled.
+func (d *Dispatcher) AddBindingContext(ctx context.Context, bind *Binding) (replaced *Binding, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	dest := newDestinationFromBinding(bind)
 
 	if bind.Prefix.IP().Is4in6() {
-		return fmt.Errorf("prefix cannot be v4-mapped v6: %v", bind.Prefix)
+		return nil, fmt.Errorf("prefix cannot be v4-mapped v6: %v", bind.Prefix)
 	}
 
 	key := newBindingKey(bind)
@@ -463,26 +1233,36 @@ func (d *Dispatcher) AddBinding(bind *Binding) error {
 		// not just installing a more specific one.
 		releaseOldID = old.PrefixLen == key.PrefixLen
 	} else if !errors.Is(err, ebpf.ErrKeyNotExist) {
-		return fmt.Errorf("lookup binding: %s", err)
+		return nil, fmt.Errorf("lookup binding: %s", err)
+	}
+
+	if releaseOldID {
+		oldDest, err := d.destinations.ByID(old.ID)
+		if err != nil {
+			return nil, fmt.Errorf("lookup replaced binding: %s", err)
+		}
+
+		replaced = &Binding{oldDest.Label, bind.Protocol, bind.Prefix, bind.Port}
 	}
 
 	id, err := d.destinations.Acquire(dest)
 	if err != nil {
-		return fmt.Errorf("acquire destination: %s", err)
+		return nil, fmt.Errorf("acquire destination: %w", err)
 	}
 
 	new := bindingValue{id, key.PrefixLen}
 	err = d.bindings.Update(key, &new, 0)
 	if err != nil {
 		_ = d.destinations.Release(dest)
-		return fmt.Errorf("create binding: %s", err)
+		return nil, fmt.Errorf("create binding: %s", err)
 	}
 
 	if releaseOldID {
 		_ = d.destinations.ReleaseByID(old.ID)
 	}
 
-	return nil
+	d.auditBinding(AuditAddBinding, bind)
+	return replaced, nil
 }
 
 // RemoveBinding stops redirecting traffic for a given protocol, prefix and port.
@@ -511,6 +1291,7 @@ func (d *Dispatcher) RemoveBinding(bind *Binding) error {
 		return fmt.Errorf("remove binding: %s", err)
 	}
 
+	d.auditBinding(AuditRemoveBinding, bind)
 	return nil
 }
 
@@ -519,12 +1300,112 @@ func (d *Dispatcher) RemoveBinding(bind *Binding) error {
 // It is conceptually identical to repeatedly calling AddBinding and RemoveBinding
 // and therefore not atomic: the function may return without applying all changes.
 //
-// Returns a boolean indicating whether any changes were made.
+// If adding or removing a binding fails, the changes already made by the call
+// are undone before returning. The rollback is best-effort: changes which
+// can't be undone are included in the returned error.
+//
+// Returns the bindings which were added and removed. On error, these are the
+// changes that remain applied.
 func (d *Dispatcher) ReplaceBindings(bindings Bindings) (added, removed Bindings, _ error) {
-	return d.replaceBindings(bindings, d.AddBinding, d.RemoveBinding)
+	return d.ReplaceBindingsContext(context.Background(), bindings)
+}
+
+// ReplaceBindingsContext is like ReplaceBindings, but stops making changes
+// once ctx is cancelled. The returned error then wraps ctx.Err().
+func (d *Dispatcher) ReplaceBindingsContext(ctx context.Context, bindings Bindings) (added, removed Bindings, _ error) {
+	add := func(bind *Binding) error {
+		_, err := d.AddBindingContext(ctx, bind)
+		return err
+	}
+
+	return d.replaceBindings(ctx, bindings, add, d.RemoveBinding)
+}
+
+func (d *Dispatcher) replaceBindings(ctx context.Context, bindings Bindings, add, remove func(*Binding) error) (added, removed Bindings, _ error) {
+	toAdd, toRemove, err := d.DiffBindings(bindings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previous, err := d.Bindings()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, bind := range toAdd {
+		if err := ctx.Err(); err != nil {
+			return added, removed, fmt.Errorf("replace bindings: %w", err)
+		}
+
+		if err := add(bind); err != nil {
+			err = fmt.Errorf("add binding %s: %w", bind, err)
+			return d.rollbackBindings(previous, added, removed, err)
+		}
+		added = append(added, bind)
+	}
+
+	for _, bind := range toRemove {
+		if err := ctx.Err(); err != nil {
+			return added, removed, fmt.Errorf("replace bindings: %w", err)
+		}
+
+		if err := remove(bind); err != nil {
+			err = fmt.Errorf("remove binding %s: %w", bind, err)
+			return d.rollbackBindings(previous, added, removed, err)
+		}
+		removed = append(removed, bind)
+	}
+
+	return added, removed, nil
+}
+
+// rollbackBindings undoes changes made by replaceBindings, in reverse order.
+//
+// previous are the bindings before any changes were made. Returns the changes
+// which couldn't be undone, and cause annotated with any rollback errors.
+func (d *Dispatcher) rollbackBindings(previous, added, removed Bindings, cause error) (Bindings, Bindings, error) {
+	replaced := make(map[bindingKey]*Binding)
+	for _, bind := range previous {
+		replaced[*newBindingKey(bind)] = bind
+	}
+
+	var (
+		failed                 []string
+		addedKept, removedKept Bindings
+	)
+	for i := len(removed) - 1; i >= 0; i-- {
+		if _, err := d.AddBinding(removed[i]); err != nil {
+			failed = append(failed, fmt.Sprintf("restore %s: %s", removed[i], err))
+			removedKept = append(Bindings{removed[i]}, removedKept...)
+		}
+	}
+
+	for i := len(added) - 1; i >= 0; i-- {
+		var err error
+		if old := replaced[*newBindingKey(added[i])]; old != nil {
+			// The binding changed labels, restore the old label.
+			_, err = d.AddBinding(old)
+		} else {
+			err = d.RemoveBinding(added[i])
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("undo %s: %s", added[i], err))
+			addedKept = append(Bindings{added[i]}, addedKept...)
+		}
+	}
+
+	if len(failed) > 0 {
+		return addedKept, removedKept, fmt.Errorf("%w (rollback failed: %s)", cause, strings.Join(failed, ", "))
+	}
+	return nil, nil, cause
 }
 
-func (d *Dispatcher) replaceBindings(bindings Bindings, add, remove func(*Binding) error) (added, removed Bindings, _ error) {
+// DiffBindings computes the changes ReplaceBindings would make without
+// applying them.
+//
+// Bindings are returned in the order in which ReplaceBindings adds and
+// removes them.
+func (d *Dispatcher) DiffBindings(bindings Bindings) (added, removed Bindings, _ error) {
 	want := make(map[bindingKey]string)
 	for _, bind := range bindings {
 		key := newBindingKey(bind)
@@ -556,18 +1437,6 @@ func (d *Dispatcher) replaceBindings(bindings Bindings, add, remove func(*Bindin
 	sort.Sort(added)
 	sort.Sort(sort.Reverse(removed))
 
-	for _, bind := range added {
-		if err := add(bind); err != nil {
-			return nil, nil, fmt.Errorf("add binding %s: %s", bind, err)
-		}
-	}
-
-	for _, bind := range removed {
-		if err := remove(bind); err != nil {
-			return nil, nil, fmt.Errorf("remove binding %s: %s", bind, err)
-		}
-	}
-
 	return added, removed, nil
 }
 
@@ -599,7 +1468,7 @@ func (d *Dispatcher) iterBindings(fn func(bindingKey, string)) error {
 	return nil
 }
 
-// Bindings lists known bindings.
+// Bindings lists known bindings, sorted from most to least specific.
 func (d *Dispatcher) Bindings() (Bindings, error) {
 	var bindings Bindings
 	err := d.iterBindings(func(key bindingKey, label string) {
@@ -609,6 +1478,109 @@ func (d *Dispatcher) Bindings() (Bindings, error) {
 		return nil, err
 	}
 
+	sort.Sort(bindings)
+	return bindings, nil
+}
+
+// OverlappingBindings returns existing bindings for the same protocol as bind
+// whose prefix overlaps with it, sorted from most to least specific. Bindings
+// for different ports don't overlap, unless one of them uses port zero.
+//
+// The binding doesn't need to exist. It is part of the result if it does.
+func (d *Dispatcher) OverlappingBindings(bind *Binding) (Bindings, error) {
+	bindings, err := d.Bindings()
+	if err != nil {
+		return nil, err
+	}
+
+	var overlapping Bindings
+	for _, b := range bindings {
+		if b.Protocol != bind.Protocol || !b.Prefix.Overlaps(bind.Prefix) {
+			continue
+		}
+
+		if b.Port != 0 && bind.Port != 0 && b.Port != bind.Port {
+			continue
+		}
+
+		overlapping = append(overlapping, b)
+	}
+	return overlapping, nil
+}
+
+// CheckBinding returns an error wrapping ErrWrongFamily if traffic for bind
+// can't be delivered because its label only has a socket registered for the
+// other address family.
+//
+// The binding doesn't need to exist.
+func (d *Dispatcher) CheckBinding(bind *Binding) error {
+	want := newDestinationFromBinding(bind)
+
+	dests, err := d.destinations.List()
+	if err != nil {
+		return fmt.Errorf("list destinations: %s", err)
+	}
+
+	sockets, err := d.destinations.Sockets()
+	if err != nil {
+		return fmt.Errorf("list sockets: %s", err)
+	}
+
+	otherFamily := false
+	for id, dest := range dests {
+		if dest.Label != want.Label || dest.Protocol != want.Protocol || sockets[id] == 0 {
+			continue
+		}
+
+		if dest.Domain == want.Domain {
+			return nil
+		}
+
+		otherFamily = true
+	}
+
+	if otherFamily {
+		return fmt.Errorf("%s: %w", want, ErrWrongFamily)
+	}
+
+	return nil
+}
+
+// BindingsForLabel lists bindings which redirect traffic to label, sorted
+// from most to least specific.
+func (d *Dispatcher) BindingsForLabel(label string) (Bindings, error) {
+	dests, err := d.destinations.List()
+	if err != nil {
+		return nil, fmt.Errorf("list destination IDs: %s", err)
+	}
+
+	ids := make(map[destinationID]bool)
+	for id, dest := range dests {
+		if dest.Label == label {
+			ids[id] = true
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var (
+		bindings Bindings
+		key      bindingKey
+		value    bindingValue
+		iter     = d.bindings.Iterate()
+	)
+	for iter.Next(&key, &value) {
+		if ids[value.ID] {
+			bindings = append(bindings, newBindingFromBPF(label, &key))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate bindings: %s", err)
+	}
+
+	sort.Sort(bindings)
 	return bindings, nil
 }
 
@@ -627,7 +1599,10 @@ func (c SocketCookie) String() string {
 // The socket receives traffic for all Bindings that share the same label,
 // L3 and L4 protocol.
 //
-
+// An existing socket for the destination is replaced in place, so traffic
+// is never dropped while a service swaps its socket, for example during a
+// restart.
+//
 // Returns the Destination with which the socket was registered, and a boolean
 // indicating whether the Destination was created or updated, or an error.
 func (d *Dispatcher) RegisterSocket(label string, conn syscall.Conn) (dest *Destination, created bool, _ error) {
@@ -638,19 +1613,143 @@ func (d *Dispatcher) RegisterSocket(label string, conn syscall.Conn) (dest *Dest
 
 	created, err = d.destinations.AddSocket(dest, conn)
 	if err != nil {
-		return nil, false, fmt.Errorf("add socket: %s", err)
+		return nil, false, fmt.Errorf("add socket: %w", err)
 	}
 
+	d.auditDestination(AuditRegisterSocket, dest)
 	return
 }
 
+// RegisterDualStackSocket is like RegisterSocket, but also accepts AF_INET6
+// sockets which don't have IPV6_V6ONLY set.
+//
+// Such a socket is registered for both the ipv4 and the ipv6 destination of
+// the label. The same socket then receives traffic for both families.
+//
+// Returns the Destinations with which the socket was registered, and for each
+// of them whether it was created or updated, or an error.
+func (d *Dispatcher) RegisterDualStackSocket(label string, conn syscall.Conn) (dests []*Destination, created []bool, _ error) {
+	dests, err := socketDestinations(label, conn, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	created, err = d.addSocket(dests, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dests, created, nil
+}
+
+// RegisterSockets registers each conn with the corresponding label, like
+// RegisterSocket or RegisterDualStackSocket if dualStack is true.
+//
+// The sockets are inspected concurrently, which is faster than registering
+// them one by one. Otherwise it behaves as if they were registered one by
+// one: it stops at the first socket which causes an error, and the sockets
+// preceding it remain registered and are included in the returned slices.
+// A socket which maps to the same destination as a preceding one is
+// registered in its place before the error is returned, and is included as
+// well.
+func (d *Dispatcher) RegisterSockets(labels []string, conns []syscall.Conn, dualStack bool) (dests [][]*Destination, created [][]bool, _ error) {
+	if len(labels) != len(conns) {
+		return nil, nil, fmt.Errorf("%d labels for %d sockets", len(labels), len(conns))
+	}
+
+	dests = make([][]*Destination, len(conns))
+	errs := make([]error, len(conns))
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(conns) {
+		workers = len(conns)
+	}
+
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				dests[i], errs[i] = socketDestinations(labels[i], conns[i], dualStack)
+			}
+		}()
+	}
+
+	for i := range conns {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	registered := make(map[Destination]bool)
+	for i, conn := range conns {
+		if errs[i] != nil {
+			return dests[:i], created, errs[i]
+		}
+
+		c, err := d.addSocket(dests[i], conn)
+		if err != nil {
+			return dests[:i], created, err
+		}
+		created = append(created, c)
+
+		for _, dest := range dests[i] {
+			if registered[*dest] {
+				return dests[:i+1], created, fmt.Errorf("found multiple sockets for destination %s", dest)
+			}
+			registered[*dest] = true
+		}
+	}
+
+	return dests, created, nil
+}
+
+// socketDestinations returns the destinations conn can be registered for.
+func socketDestinations(label string, conn syscall.Conn, dualStack bool) ([]*Destination, error) {
+	dest, err := newDestinationFromConn(label, conn)
+
+	var regErr *RegisterError
+	if dualStack && errors.As(err, &regErr) && regErr.DualStack {
+		proto := Protocol(regErr.Protocol)
+		return []*Destination{
+			{label, AF_INET, proto},
+			{label, AF_INET6, proto},
+		}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return []*Destination{dest}, nil
+}
+
+func (d *Dispatcher) addSocket(dests []*Destination, conn syscall.Conn) (created []bool, _ error) {
+	for _, dest := range dests {
+		c, err := d.destinations.AddSocket(dest, conn)
+		if err != nil {
+			return nil, fmt.Errorf("add socket for %s: %w", dest, err)
+		}
+		created = append(created, c)
+		d.auditDestination(AuditRegisterSocket, dest)
+	}
+
+	return created, nil
+}
+
+// UnregisterSocket is like RemoveSocket, but takes the components of a
+// destination.
 func (d *Dispatcher) UnregisterSocket(label string, domain Domain, proto Protocol) error {
-	dest := &Destination{
+	return d.RemoveSocket(&Destination{
 		Label:    label,
 		Domain:   domain,
 		Protocol: proto,
-	}
+	})
+}
 
+// RemoveSocket stops serving dest from its socket. Bindings for dest are
+// kept, so traffic for them is dropped until another socket is registered.
+func (d *Dispatcher) RemoveSocket(dest *Destination) error {
 	err := d.destinations.RemoveSocket(dest)
 	if errors.Is(err, ebpf.ErrKeyNotExist) {
 		return fmt.Errorf("socket %s doesn't exist", dest)
@@ -659,18 +1758,149 @@ func (d *Dispatcher) UnregisterSocket(label string, domain Domain, proto Protoco
 		return fmt.Errorf("remove socket %s: %s", dest, err)
 	}
 
+	d.auditDestination(AuditUnregisterSocket, dest)
 	return nil
 }
 
+// GCDestinations removes destinations which have neither bindings nor a
+// registered socket, for example because a process exited without
+// unregistering its socket.
+//
+// Returns the number of removed destinations.
+func (d *Dispatcher) GCDestinations() (removed int, _ error) {
+	removed, err := d.destinations.GC()
+	if err != nil {
+		return removed, fmt.Errorf("gc destinations: %s", err)
+	}
+	return removed, nil
+}
+
+// VerifySockets returns destinations which have bindings but no live socket.
+//
+// The kernel removes a socket from the dispatcher once it is closed, so a
+// destination whose socket went away is left with bindings that match traffic
+// but nowhere to send it. Such traffic is dropped until a new socket is
+// registered.
+func (d *Dispatcher) VerifySockets() (dead []Destination, _ error) {
+	unserved, err := d.destinations.Unserved()
+	if err != nil {
+		return nil, fmt.Errorf("verify sockets: %s", err)
+	}
+
+	for _, dest := range unserved {
+		dead = append(dead, *dest)
+	}
+	return dead, nil
+}
+
+// ReuseportConflict is a reuseport group whose sockets are registered under
+// more than one label.
+type ReuseportConflict struct {
+	Protocol     Protocol
+	Addr         netaddr.IPPort
+	Destinations []Destination
+}
+
+// CheckReuseportConsistency finds reuseport groups whose sockets are
+// registered under different labels.
+//
+// The kernel picks a socket from the whole group when redirecting traffic,
+// so such a label may receive traffic meant for another one.
+//
+// sock_diag doesn't expose SO_REUSEPORT, so a socket is assumed to be part of
+// a reuseport group if another socket is bound to the same address. Apart
+// from SO_REUSEPORT only SO_REUSEADDR on UDP sockets allows this.
+func (d *Dispatcher) CheckReuseportConsistency() ([]ReuseportConflict, error) {
+	dests, err := d.destinations.List()
+	if err != nil {
+		return nil, fmt.Errorf("check reuseport: %s", err)
+	}
+
+	cookies, err := d.destinations.Sockets()
+	if err != nil {
+		return nil, fmt.Errorf("check reuseport: %s", err)
+	}
+
+	var sockets map[SocketCookie]reuseportKey
+	err = doInNetNS(d.netnsPath, func() (err error) {
+		sockets, err = listeningSockets()
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("check reuseport: %w", err)
+	}
+
+	members := make(map[reuseportKey]int)
+	for _, key := range sockets {
+		members[key]++
+	}
+
+	groups := make(map[reuseportKey][]Destination)
+	labels := make(map[reuseportKey]map[string]bool)
+	for id, cookie := range cookies {
+		key, ok := sockets[cookie]
+		if !ok || dests[id] == nil || members[key] < 2 {
+			continue
+		}
+
+		groups[key] = append(groups[key], *dests[id])
+		if labels[key] == nil {
+			labels[key] = make(map[string]bool)
+		}
+		labels[key][dests[id].Label] = true
+	}
+
+	var conflicts []ReuseportConflict
+	for key, groupDests := range groups {
+		if len(labels[key]) < 2 {
+			continue
+		}
+
+		sort.Slice(groupDests, func(i, j int) bool {
+			return groupDests[i].String() < groupDests[j].String()
+		})
+		conflicts = append(conflicts, ReuseportConflict{key.Protocol, key.Addr, groupDests})
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Addr.String() < conflicts[j].Addr.String()
+	})
+	return conflicts, nil
+}
+
 // Metrics contain counters generated by the data plane.
 type Metrics struct {
 	Destinations map[Destination]DestinationMetrics
 	Bindings     map[Destination]uint64
 	Sockets      map[Destination]uint8
+	// Errors encountered while reading counters for individual destinations.
+	// Such destinations are missing from Destinations.
+	Errors []error
+	// Number of destinations referenced by a binding or socket, and how many
+	// can be allocated at most.
+	DestinationsUsed     uint64
+	DestinationsCapacity uint64
+	// Statistics of the dispatcher program, see ProgramStats.
+	ProgramRuns    uint64
+	ProgramRuntime time.Duration
+	// Whether the kernel.bpf_stats_enabled sysctl is set.
+	ProgramStatsEnabled bool
+	// The most recent upgrade, or nil if the dispatcher was never upgraded.
+	LastUpgrade *Upgrade
 }
 
 // Metrics returns current counters from the data plane.
+//
+// A read-only Dispatcher releases its lock while reading counters, so that
+// writers aren't blocked by a scan of many destinations. Counters of a
+// destination which is removed and reused concurrently may then be reported
+// as reset to zero.
 func (d *Dispatcher) Metrics() (*Metrics, error) {
+	return d.metrics(func() {})
+}
+
+// metrics invokes unlocked once counters are read without holding the lock.
+func (d *Dispatcher) metrics(unlocked func()) (*Metrics, error) {
 	bindings, err := d.Bindings()
 	if err != nil {
 		return nil, fmt.Errorf("bindings metrics: %s", err)
@@ -684,16 +1914,28 @@ func (d *Dispatcher) Metrics() (*Metrics, error) {
 		return nil, fmt.Errorf("list destinations: %s", err)
 	}
 
-	destCounters, err := d.destinations.Metrics(destsByID)
+	sockets, err := d.destinations.Sockets()
 	if err != nil {
-		return nil, fmt.Errorf("destination metrics: %s", err)
+		return nil, fmt.Errorf("socket metrics: %s", err)
 	}
 
-	sockets, err := d.destinations.Sockets()
+	inUse, err := d.destinations.InUse()
 	if err != nil {
-		return nil, fmt.Errorf("socket metrics: %s", err)
+		return nil, fmt.Errorf("destination metrics: %s", err)
+	}
+
+	lastUpgrade, upgradeErr := d.LastUpgrade()
+
+	if d.readOnly {
+		// Only the mapping of IDs to destinations needs to be consistent,
+		// counters are read one destination at a time anyway.
+		d.stateDir.Unlock()
+		defer d.stateDir.Lock()
+		unlocked()
 	}
 
+	destCounters, errs := d.destinations.Metrics(destsByID)
+
 	destMetrics := make(map[Destination]DestinationMetrics)
 	socketsPresent := make(map[Destination]uint8)
 	for id, dest := range destsByID {
@@ -711,7 +1953,49 @@ func (d *Dispatcher) Metrics() (*Metrics, error) {
 
 	}
 
-	return &Metrics{destMetrics, bindingMetrics, socketsPresent}, nil
+	runs, runtime, err := d.programStats()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if upgradeErr != nil {
+		errs = append(errs, upgradeErr)
+	}
+
+	return &Metrics{
+		Destinations:         destMetrics,
+		Bindings:             bindingMetrics,
+		Sockets:              socketsPresent,
+		Errors:               errs,
+		DestinationsUsed:     uint64(inUse),
+		DestinationsCapacity: uint64(d.destinations.maxID),
+		ProgramRuns:          runs,
+		ProgramRuntime:       runtime,
+		ProgramStatsEnabled:  bpfStatsEnabled(),
+		LastUpgrade:          lastUpgrade,
+	}, nil
+}
+
+// MetricsPerCPU returns the counters of each destination for every possible
+// CPU, without summing them up like Metrics does.
+//
+// Returns an error if the counters of any destination can't be read.
+func (d *Dispatcher) MetricsPerCPU() (map[Destination][]DestinationMetrics, error) {
+	destsByID, err := d.destinations.List()
+	if err != nil {
+		return nil, fmt.Errorf("list destinations: %s", err)
+	}
+
+	perCPU, errs := d.destinations.MetricsPerCPU(destsByID)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	metrics := make(map[Destination][]DestinationMetrics)
+	for id, dest := range destsByID {
+		metrics[*dest] = perCPU[id]
+	}
+	return metrics, nil
 }
 
 // Destinations returns a set of existing destinations, i.e. sockets and labels.
@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -29,6 +31,7 @@ import (
 	"github.com/cilium/ebpf/link"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
@@ -105,6 +108,74 @@ func TestUnloadDispatcherNotLoaded(t *testing.T) {
 	}
 }
 
+func TestUnloadDispatcherInUse(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	mustRegisterSocket(t, dp, "foo", testutil.Listen(t, netns, "tcp4", "127.0.0.1:0"))
+	dp.Close()
+
+	opts := UnloadOptions{IfUnused: true}
+	err := UnloadDispatcherWithOptions(netns.Path(), "/sys/fs/bpf", opts)
+	if !errors.Is(err, ErrInUse) {
+		t.Fatal("Expected ErrInUse, got", err)
+	}
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	if err := dp.UnregisterSocket("foo", AF_INET, TCP); err != nil {
+		t.Fatal("Can't unregister socket:", err)
+	}
+	dp.Close()
+
+	if err := UnloadDispatcherWithOptions(netns.Path(), "/sys/fs/bpf", opts); err != nil {
+		t.Fatal("Can't unload unused dispatcher:", err)
+	}
+}
+
+func TestDispatcherNetNSGone(t *testing.T) {
+	var netnsPath string
+	t.Run("setup", func(t *testing.T) {
+		// The namespace is destroyed when the subtest finishes.
+		netnsPath = testutil.NewNetNS(t).Path()
+	})
+
+	// The thread owning the namespace exits asynchronously.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(netnsPath); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Network namespace still exists after one second")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err := OpenDispatcher(netnsPath, "/sys/fs/bpf", true)
+	if !errors.Is(err, ErrNetNSGone) {
+		t.Error("OpenDispatcher doesn't return ErrNetNSGone:", err)
+	}
+
+	err = UnloadDispatcher(netnsPath, "/sys/fs/bpf")
+	if !errors.Is(err, ErrNetNSGone) {
+		t.Error("UnloadDispatcher doesn't return ErrNetNSGone:", err)
+	}
+}
+
+func TestDispatcherNotNetNS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netns")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := OpenDispatcher(path, "/sys/fs/bpf", true)
+	if !errors.Is(err, ErrNotNetNS) {
+		t.Error("OpenDispatcher doesn't return ErrNotNetNS:", err)
+	}
+	if errors.Is(err, ErrNetNSGone) {
+		t.Error("OpenDispatcher returns ErrNetNSGone for a regular file")
+	}
+}
+
 func TestDispatcherConcurrentAccess(t *testing.T) {
 	procs := runtime.GOMAXPROCS(0)
 	if procs < 2 {
@@ -160,6 +231,129 @@ func TestDispatcherConcurrentAccess(t *testing.T) {
 	}
 }
 
+func TestOpenDispatcherWithTimeout(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	const timeout = 50 * time.Millisecond
+	for _, readOnly := range []bool{true, false} {
+		start := time.Now()
+		_, err := OpenDispatcherWithTimeout(netns.Path(), "/sys/fs/bpf", readOnly, timeout)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected DeadlineExceeded with readOnly=%t, got %v", readOnly, err)
+		}
+
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("Returned after %v, before the timeout expired", elapsed)
+		}
+	}
+
+	dp.Close()
+
+	dp, err := OpenDispatcherWithTimeout(netns.Path(), "/sys/fs/bpf", false, timeout)
+	if err != nil {
+		t.Fatal("Can't open unlocked dispatcher:", err)
+	}
+	dp.Close()
+}
+
+func TestTryOpenDispatcher(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	dp.Close()
+
+	reader, err := TryOpenDispatcher(netns.Path(), "/sys/fs/bpf", true)
+	if err != nil {
+		t.Fatal("Can't open unlocked dispatcher read-only:", err)
+	}
+	defer reader.Close()
+
+	if dp, err := TryOpenDispatcher(netns.Path(), "/sys/fs/bpf", true); err != nil {
+		t.Error("Shared lock prevents another reader:", err)
+	} else {
+		dp.Close()
+	}
+
+	if _, err := TryOpenDispatcher(netns.Path(), "/sys/fs/bpf", false); !errors.Is(err, ErrLocked) {
+		t.Error("Expected ErrLocked for writer while a reader is active, got", err)
+	}
+	reader.Close()
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	defer dp.Close()
+
+	for _, readOnly := range []bool{true, false} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := TryOpenDispatcher(netns.Path(), "/sys/fs/bpf", readOnly)
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrLocked) {
+				t.Errorf("Expected ErrLocked with readOnly=%t, got %v", readOnly, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("TryOpenDispatcher with readOnly=%t blocks", readOnly)
+		}
+	}
+}
+
+func TestDispatcherStateVersion(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	if v := dp.StateVersion(); v != CurrentStateVersion {
+		t.Fatalf("Created dispatcher has state version %d instead of %d", v, CurrentStateVersion)
+	}
+	path := dp.Path
+	dp.Close()
+
+	mustWriteStateVersion(t, path, CurrentStateVersion+1)
+
+	dp, err := OpenDispatcher(netns.Path(), "/sys/fs/bpf", true)
+	if err != nil {
+		t.Fatal("Can't open dispatcher with newer state version read-only:", err)
+	}
+	if v := dp.StateVersion(); v != CurrentStateVersion+1 {
+		t.Errorf("Expected state version %d, got %d", CurrentStateVersion+1, v)
+	}
+	dp.Close()
+
+	if _, err := OpenDispatcher(netns.Path(), "/sys/fs/bpf", false); err == nil {
+		t.Fatal("Opened dispatcher with newer state version for writing")
+	}
+
+	mustWriteStateVersion(t, path, 0)
+
+	err = testutil.WithCapabilities(func() error {
+		_, err := UpgradeDispatcher(netns.Path(), "/sys/fs/bpf")
+		return err
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	if v := dp.StateVersion(); v != CurrentStateVersion {
+		t.Errorf("Upgrade didn't stamp state version %d, got %d", CurrentStateVersion, v)
+	}
+}
+
+func mustWriteStateVersion(tb testing.TB, path string, version uint32) {
+	tb.Helper()
+
+	m, err := ebpf.LoadPinnedMap(versionPath(path), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer m.Close()
+
+	if err := m.Put(uint32(0), version); err != nil {
+		tb.Fatal("Can't write state version:", err)
+	}
+}
+
 func TestDispatcherUpgrade(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
@@ -183,6 +377,69 @@ func TestDispatcherUpgrade(t *testing.T) {
 	check(dp)
 }
 
+func TestDispatcherUpgradeRecord(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	if upgrade, err := dp.LastUpgrade(); err != nil {
+		t.Fatal(err)
+	} else if upgrade != nil {
+		t.Fatal("New dispatcher has an upgrade:", upgrade)
+	}
+
+	prog, err := dp.Program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := prog.Info()
+	prog.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, _ := info.ID()
+	dp.Close()
+
+	var records []*AuditRecord
+	var newID ebpf.ProgramID
+	err = testutil.WithCapabilities(func() (err error) {
+		newID, err = UpgradeDispatcherWithOptions(netns.Path(), "/sys/fs/bpf", UpgradeOptions{
+			Permissions: DefaultPermissions,
+			Audit:       func(r *AuditRecord) { records = append(records, r) },
+		})
+		return
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Can't upgrade:", err)
+	}
+
+	if len(records) != 1 {
+		t.Fatal("Expected one audit record, got", len(records))
+	}
+	if r := records[0]; r.Operation != AuditUpgrade || r.PreviousProgramID != oldID || r.ProgramID != newID {
+		t.Errorf("Expected upgrade from #%d to #%d, got %+v", oldID, newID, r)
+	}
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	metrics, err := dp.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgrade := metrics.LastUpgrade
+	if upgrade == nil {
+		t.Fatal("Metrics don't include the upgrade")
+	}
+	if upgrade.PreviousProgramID != oldID {
+		t.Errorf("Expected previous program #%d, got #%d", oldID, upgrade.PreviousProgramID)
+	}
+	if upgrade.ProgramID != newID {
+		t.Errorf("Expected program #%d, got #%d", newID, upgrade.ProgramID)
+	}
+	if !upgrade.Time.Equal(records[0].Time) {
+		t.Errorf("Expected upgrade time %v, got %v", records[0].Time, upgrade.Time)
+	}
+}
+
 func TestDispatcherUpgradeFailedLinkUpdate(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
@@ -195,7 +452,7 @@ func TestDispatcherUpgradeFailedLinkUpdate(t *testing.T) {
 		return errors.New("aborted")
 	}
 
-	_, err := upgradeDispatcher(netns.Path(), "/sys/fs/bpf", updateLink)
+	_, err := upgradeDispatcher(netns.Path(), "/sys/fs/bpf", UpgradeOptions{Permissions: DefaultPermissions}, updateLink)
 	if err == nil {
 		t.Fatal("Upgrade didn't fail")
 	}
@@ -234,6 +491,10 @@ func filesInDirectory(tb testing.TB, path string) []fileInfo {
 	return infos
 }
 
+var ignoreLastUpgradeFile = cmpopts.IgnoreSliceElements(func(fi fileInfo) bool {
+	return fi.Name == "last-upgrade"
+})
+
 func assertDispatcherState(tb testing.TB, dp *Dispatcher, netns ns.NetNS) func(*Dispatcher) {
 	tb.Helper()
 
@@ -276,19 +537,73 @@ func assertDispatcherState(tb testing.TB, dp *Dispatcher, netns ns.NetNS) func(*
 			tb.Fatal(err)
 		}
 
-		if diff := cmp.Diff(metrics, haveMetrics); diff != "" {
+		// Upgrades are recorded, so they are expected to change LastUpgrade.
+		if diff := cmp.Diff(metrics, haveMetrics, cmpopts.IgnoreFields(Metrics{}, "LastUpgrade")); diff != "" {
 			tb.Errorf("Metrics don't match (+y -x):\n%s", diff)
 		}
 
 		testutil.CanDialName(tb, netns, "tcp", "127.0.0.1:443", "service")
 
 		filesAfter := filesInDirectory(tb, dp.Path)
-		if diff := cmp.Diff(filesBefore, filesAfter); diff != "" {
+		if diff := cmp.Diff(filesBefore, filesAfter, ignoreLastUpgradeFile); diff != "" {
 			tb.Fatal("Filesystem state before and after doesn't match:\n", diff)
 		}
 	}
 }
 
+func TestDispatcherUpgradePrune(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	check := assertDispatcherState(t, dp, netns)
+	path := dp.Path
+	want := filesInDirectory(t, path)
+	dp.Close()
+
+	stray, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Array,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stray.Close()
+
+	if err := stray.Pin(filepath.Join(path, "stray")); err != nil {
+		t.Fatal(err)
+	}
+
+	upgrade := func(prune bool) {
+		t.Helper()
+
+		err := testutil.WithCapabilities(func() error {
+			_, err := UpgradeDispatcherWithOptions(netns.Path(), "/sys/fs/bpf", UpgradeOptions{
+				Permissions: DefaultPermissions,
+				Prune:       prune,
+			})
+			return err
+		}, CreateCapabilities...)
+		if err != nil {
+			t.Fatal("Upgrade failed:", err)
+		}
+	}
+
+	upgrade(false)
+	if _, err := os.Stat(filepath.Join(path, "stray")); err != nil {
+		t.Fatal("Upgrade without prune removed stray map:", err)
+	}
+
+	upgrade(true)
+	if diff := cmp.Diff(want, filesInDirectory(t, path), ignoreLastUpgradeFile); diff != "" {
+		t.Errorf("State doesn't match after prune (-want +got):\n%s", diff)
+	}
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	defer dp.Close()
+	check(dp)
+}
+
 func TestDispatcherUpgradeWithIncompatibleMap(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
@@ -306,7 +621,7 @@ func TestDispatcherUpgradeWithIncompatibleMap(t *testing.T) {
 	}
 	defer hash.Close()
 
-	spec, err := loadPatchedDispatcher(nil, nil)
+	spec, err := loadPatchedDispatcher(nil, nil, 0, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -330,6 +645,49 @@ func TestDispatcherUpgradeWithIncompatibleMap(t *testing.T) {
 	}
 }
 
+func TestDispatcherPermissions(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	perms := Permissions{DirMode: 0770, ObjectMode: 0660, GID: os.Getgid()}
+
+	var dp *Dispatcher
+	err := testutil.WithCapabilities(func() (err error) {
+		dp, err = CreateDispatcherWithPermissions(netns.Path(), "/sys/fs/bpf", perms)
+		return
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Can't create dispatcher:", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dp.Path)
+		dp.Close()
+	})
+
+	info, err := os.Stat(dp.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mode := info.Mode().Perm(); mode != perms.DirMode {
+		t.Errorf("State directory has mode %v instead of %v", mode, perms.DirMode)
+	}
+
+	for _, file := range filesInDirectory(t, dp.Path) {
+		if mode := file.Mode.Perm(); mode != perms.ObjectMode {
+			t.Errorf("%s has mode %v instead of %v", file.Name, mode, perms.ObjectMode)
+		}
+	}
+
+	invalid := Permissions{DirMode: 0070, ObjectMode: 0660, GID: -1}
+	err = testutil.WithCapabilities(func() (err error) {
+		_, err = CreateDispatcherWithPermissions(testutil.NewNetNS(t).Path(), "/sys/fs/bpf", invalid)
+		return
+	}, CreateCapabilities...)
+	if err == nil {
+		t.Error("Accepted directory mode without owner access")
+	}
+}
+
 func TestDispatcherAccess(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
@@ -403,7 +761,7 @@ func TestDispatcherAccess(t *testing.T) {
 		}
 		defer dp.Close()
 
-		if err := dp.AddBinding(bind); err == nil {
+		if _, err := dp.AddBinding(bind); err == nil {
 			t.Fatal("Group is able to add binding")
 		}
 
@@ -462,7 +820,7 @@ func TestAddAndRemoveBindings(t *testing.T) {
 				t.Fatal("Can't dial before creating the binding")
 			}
 
-			err := dp.AddBinding(tc.Binding)
+			_, err := dp.AddBinding(tc.Binding)
 			if err != nil {
 				t.Fatal("Can't create binding:", err)
 			}
@@ -499,7 +857,7 @@ func TestAddInvalidBinding(t *testing.T) {
 	for _, tc := range testCases {
 		name := fmt.Sprintf("%v %s", tc.Protocol, tc.Prefix)
 		t.Run(name, func(t *testing.T) {
-			if err := dp.AddBinding(tc.Binding); err == nil {
+			if _, err := dp.AddBinding(tc.Binding); err == nil {
 				t.Fatal("Created/added an invalid binding:", tc.Binding.Prefix)
 			}
 		})
@@ -510,7 +868,7 @@ func TestBindingWithEmptyLabel(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
 
-	if err := dp.AddBinding(mustNewBinding(t, "", TCP, "::1", 80)); err == nil {
+	if _, err := dp.AddBinding(mustNewBinding(t, "", TCP, "::1", 80)); err == nil {
 		t.Fatal("AddBinding accepts empty label")
 	}
 
@@ -530,10 +888,11 @@ func TestUpdateBinding(t *testing.T) {
 		name          string
 		first, second *Binding
 		result        []*Destination
+		replaced      *Binding
 	}{
-		{"overwrite", foo, bar, []*Destination{barDest}},
-		{"more specific", foo, bar32, []*Destination{fooDest, barDest}},
-		{"less specific", bar32, foo, []*Destination{fooDest, barDest}},
+		{"overwrite", foo, bar, []*Destination{barDest}, foo},
+		{"more specific", foo, bar32, []*Destination{fooDest, barDest}, nil},
+		{"less specific", bar32, foo, []*Destination{fooDest, barDest}, nil},
 	}
 
 	for _, test := range testcases {
@@ -541,14 +900,19 @@ func TestUpdateBinding(t *testing.T) {
 			netns := testutil.NewNetNS(t)
 			dp := mustCreateDispatcher(t, netns)
 
-			if err := dp.AddBinding(test.first); err != nil {
+			if _, err := dp.AddBinding(test.first); err != nil {
 				t.Fatal(err)
 			}
 
-			if err := dp.AddBinding(test.second); err != nil {
+			replaced, err := dp.AddBinding(test.second)
+			if err != nil {
 				t.Fatal(err)
 			}
 
+			if diff := cmp.Diff(test.replaced, replaced, testutil.IPPrefixComparer()); diff != "" {
+				t.Errorf("Replaced binding doesn't match (-want +got):\n%s", diff)
+			}
+
 			checkDestinations(t, dp.destinations, test.result...)
 		})
 	}
@@ -564,7 +928,7 @@ func TestRemoveBinding(t *testing.T) {
 		t.Error("Removing a non-existing binding doesn't return an error")
 	}
 
-	if err := dp.AddBinding(bindA); err != nil {
+	if _, err := dp.AddBinding(bindA); err != nil {
 		t.Fatal(err)
 	}
 
@@ -628,7 +992,7 @@ func TestReplaceBindings(t *testing.T) {
 			dp := mustCreateDispatcher(t, netns)
 
 			for _, bind := range test.initial {
-				if err := dp.AddBinding(bind); err != nil {
+				if _, err := dp.AddBinding(bind); err != nil {
 					t.Fatal(err)
 				}
 			}
@@ -664,62 +1028,185 @@ func TestReplaceBindings(t *testing.T) {
 	}
 }
 
-func TestReplaceBindingsOverlapping(t *testing.T) {
-	netns := testutil.NewNetNS(t, "2001:db8::/32")
+func TestReplaceBindingsCancel(t *testing.T) {
+	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
-	mustRegisterSocket(t, dp, "foo", testutil.ListenAndEchoWithName(t, netns, "tcp6", "", "foo"))
-	mustRegisterSocket(t, dp, "bar", testutil.ListenAndEchoWithName(t, netns, "tcp6", "", "bar"))
 
-	foo := mustNewBinding(t, "foo", TCP, "2001:db8::1", 0)
-	bar := mustNewBinding(t, "bar", TCP, "2001:db8::1", 80)
+	stale := mustNewBinding(t, "foo", TCP, "127.0.0.1", 1)
+	mustAddBinding(t, dp, stale)
 
-	next := make(chan struct{}, 1)
-	applied := make(chan struct{}, 1)
-	t.Cleanup(func() { close(next) })
+	var replacement Bindings
+	for i := 0; i < 5; i++ {
+		replacement = append(replacement, mustNewBinding(t, "foo", TCP, "127.0.0.2", uint16(i+1)))
+	}
 
-	add := func(b *Binding) error {
-		<-next
-		t.Log("adding", b)
-		err := dp.AddBinding(b)
-		select {
-		case applied <- struct{}{}:
-		default:
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var n int
+	add := func(bind *Binding) error {
+		if n++; n == 2 {
+			cancel()
 		}
+		_, err := dp.AddBinding(bind)
 		return err
 	}
 
-	go func() {
-		_, _, err := dp.replaceBindings(Bindings{foo, bar}, add, nil)
-		if err != nil {
-			t.Error("Failed to replace bindings:", err)
-		}
-	}()
+	added, removed, err := dp.replaceBindings(ctx, replacement, add, dp.RemoveBinding)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("Expected context.Canceled, got", err)
+	}
+	if len(added) != 2 {
+		t.Error("Expected two added bindings, got", added)
+	}
+	if len(removed) != 0 {
+		t.Error("Expected no removed bindings, got", removed)
+	}
 
-	next <- struct{}{}
-	<-applied
-	testutil.CanDialName(t, netns, "tcp6", "[2001:db8::1]:80", "bar")
+	have, err := dp.Bindings()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	next <- struct{}{}
-	<-applied
-	testutil.CanDialName(t, netns, "tcp6", "[2001:db8::1]:81", "foo")
+	want := append(Bindings{stale}, added...)
+	sort.Sort(want)
+	sort.Sort(have)
+	if diff := cmp.Diff(want, have, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("bindings don't match (-want +got):\n%s", diff)
+	}
 
-	remove := func(b *Binding) error {
-		<-next
-		t.Log("removing", b)
-		err := dp.RemoveBinding(b)
-		select {
-		case applied <- struct{}{}:
-		default:
-		}
-		return err
+	if _, err := dp.AddBindingContext(ctx, replacement[4]); !errors.Is(err, context.Canceled) {
+		t.Error("AddBindingContext doesn't return context.Canceled:", err)
 	}
+}
 
-	go func() {
-		_, _, err := dp.replaceBindings(nil, nil, remove)
-		if err != nil {
-			t.Error("Failed to replace bindings:", err)
-		}
-	}()
+func TestReplaceBindingsRollback(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	previous := Bindings{
+		mustNewBinding(t, "foo", TCP, "127.0.0.1", 1),
+		mustNewBinding(t, "foo", TCP, "127.0.0.1", 2),
+		mustNewBinding(t, "bar", TCP, "127.0.0.1", 3),
+	}
+	for _, bind := range previous {
+		mustAddBinding(t, dp, bind)
+	}
+	sort.Sort(previous)
+
+	replacement := Bindings{
+		// Unchanged
+		previous[0],
+		// Relabeled
+		mustNewBinding(t, "baz", TCP, "127.0.0.1", 2),
+		// New
+		mustNewBinding(t, "baz", TCP, "127.0.0.1", 4),
+		mustNewBinding(t, "baz", TCP, "127.0.0.1", 5),
+	}
+
+	injected := errors.New("injected")
+	failAfter := func(n int, op func(*Binding) error) func(*Binding) error {
+		return func(bind *Binding) error {
+			if n--; n < 0 {
+				return injected
+			}
+			return op(bind)
+		}
+	}
+
+	addBinding := func(bind *Binding) error {
+		_, err := dp.AddBinding(bind)
+		return err
+	}
+
+	checkBindings := func(t *testing.T) {
+		t.Helper()
+
+		have, err := dp.Bindings()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Sort(have)
+		if diff := cmp.Diff(previous, have, testutil.IPPrefixComparer()); diff != "" {
+			t.Errorf("bindings weren't restored (-want +got):\n%s", diff)
+		}
+	}
+
+	for n := 0; n < 3; n++ {
+		added, removed, err := dp.replaceBindings(context.Background(), replacement, failAfter(n, addBinding), dp.RemoveBinding)
+		if !errors.Is(err, injected) {
+			t.Fatalf("Failure on add #%d: expected injected error, got %v", n, err)
+		}
+		if len(added) != 0 || len(removed) != 0 {
+			t.Errorf("Failure on add #%d: expected no remaining changes, got %v and %v", n, added, removed)
+		}
+		checkBindings(t)
+	}
+
+	_, _, err := dp.replaceBindings(context.Background(), replacement, addBinding, failAfter(0, dp.RemoveBinding))
+	if !errors.Is(err, injected) {
+		t.Fatal("Failure on remove: expected injected error, got", err)
+	}
+	checkBindings(t)
+}
+
+func TestReplaceBindingsOverlapping(t *testing.T) {
+	netns := testutil.NewNetNS(t, "2001:db8::/32")
+	dp := mustCreateDispatcher(t, netns)
+	mustRegisterSocket(t, dp, "foo", testutil.ListenAndEchoWithName(t, netns, "tcp6", "", "foo"))
+	mustRegisterSocket(t, dp, "bar", testutil.ListenAndEchoWithName(t, netns, "tcp6", "", "bar"))
+
+	foo := mustNewBinding(t, "foo", TCP, "2001:db8::1", 0)
+	bar := mustNewBinding(t, "bar", TCP, "2001:db8::1", 80)
+
+	next := make(chan struct{}, 1)
+	applied := make(chan struct{}, 1)
+	t.Cleanup(func() { close(next) })
+
+	add := func(b *Binding) error {
+		<-next
+		t.Log("adding", b)
+		_, err := dp.AddBinding(b)
+		select {
+		case applied <- struct{}{}:
+		default:
+		}
+		return err
+	}
+
+	go func() {
+		_, _, err := dp.replaceBindings(context.Background(), Bindings{foo, bar}, add, nil)
+		if err != nil {
+			t.Error("Failed to replace bindings:", err)
+		}
+	}()
+
+	next <- struct{}{}
+	<-applied
+	testutil.CanDialName(t, netns, "tcp6", "[2001:db8::1]:80", "bar")
+
+	next <- struct{}{}
+	<-applied
+	testutil.CanDialName(t, netns, "tcp6", "[2001:db8::1]:81", "foo")
+
+	remove := func(b *Binding) error {
+		<-next
+		t.Log("removing", b)
+		err := dp.RemoveBinding(b)
+		select {
+		case applied <- struct{}{}:
+		default:
+		}
+		return err
+	}
+
+	go func() {
+		_, _, err := dp.replaceBindings(context.Background(), nil, nil, remove)
+		if err != nil {
+			t.Error("Failed to replace bindings:", err)
+		}
+	}()
 
 	next <- struct{}{}
 	<-applied
@@ -728,96 +1215,862 @@ func TestReplaceBindingsOverlapping(t *testing.T) {
 		t.Error("bar wasn't removed")
 	}
 
-	next <- struct{}{}
-	<-applied
-	if testutil.CanDial(t, netns, "tcp6", "[2001:db8::1]:80") {
-		t.Error("foo wasn't removed")
+	next <- struct{}{}
+	<-applied
+	if testutil.CanDial(t, netns, "tcp6", "[2001:db8::1]:80") {
+		t.Error("foo wasn't removed")
+	}
+}
+
+func TestRegisterSupportedSocketKind(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	networks := []string{
+		"tcp4",
+		"tcp6",
+		"udp4",
+		"udp6",
+	}
+	for _, network := range networks {
+		t.Run(network, func(t *testing.T) {
+			conn := testutil.Listen(t, netns, network, "")
+			_, created, err := dp.RegisterSocket("service-name", conn)
+			if err != nil {
+				t.Fatal("RegisterSocket failed:", err)
+			}
+
+			if !created {
+				t.Error("RegisterSocket doesn't return true for new sockets")
+			}
+
+			// TODO: Lookup registered socket
+		})
+	}
+}
+
+func TestUpdateRegisteredSocket(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	for i := 0; i < 3; i++ {
+		conn := testutil.Listen(t, netns, "tcp4", "")
+		_, created, err := dp.RegisterSocket("service-name", conn)
+		if err != nil {
+			t.Fatalf("Can't RegisterSocket try #%d: %v", i+1, err)
+		}
+
+		if i > 0 && created {
+			t.Errorf("Created is true on try #%d", i+1)
+		}
+	}
+}
+
+func TestReplaceRegisteredSocket(t *testing.T) {
+	netns := testutil.NewNetNS(t, "1.2.3.0/24")
+	dp := mustCreateDispatcher(t, netns)
+	mustAddBinding(t, dp, mustNewBinding(t, "service-name", TCP, "1.2.3.0/24", 0))
+
+	conns := []syscall.Conn{
+		testutil.ListenAndEcho(t, netns, "tcp4", "127.0.0.1:0"),
+		testutil.ListenAndEcho(t, netns, "tcp4", "127.0.0.1:0"),
+	}
+	mustRegisterSocket(t, dp, "service-name", conns[0])
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if _, _, err := dp.RegisterSocket("service-name", conns[i%2]); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if !testutil.CanDial(t, netns, "tcp4", "1.2.3.4:80") {
+			t.Error("Connection refused while replacing socket, attempt", i)
+			break
+		}
+	}
+
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatal("Can't replace socket:", err)
+	}
+}
+
+func TestRegisterSockets(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	labels := []string{"foo", "bar", "dual"}
+	conns := []syscall.Conn{
+		testutil.Listen(t, netns, "tcp4", ""),
+		testutil.Listen(t, netns, "udp6", ""),
+		// Go creates dual-stack sockets when listening on the wildcard address.
+		testutil.Listen(t, netns, "tcp", ":0"),
+	}
+
+	if _, _, err := dp.RegisterSockets(labels, conns, false); !errors.Is(err, ErrBadSocketState) {
+		t.Fatal("Expected ErrBadSocketState for dual-stack socket, got", err)
+	}
+
+	dests, created, err := dp.RegisterSockets(labels, conns, true)
+	if err != nil {
+		t.Fatal("Can't register sockets:", err)
+	}
+
+	want := [][]*Destination{
+		{{"foo", AF_INET, TCP}},
+		{{"bar", AF_INET6, UDP}},
+		{{"dual", AF_INET, TCP}, {"dual", AF_INET6, TCP}},
+	}
+	if diff := cmp.Diff(want, dests); diff != "" {
+		t.Error("Destinations don't match (+y -x):\n", diff)
+	}
+
+	// foo and bar were registered by the failed call above.
+	if diff := cmp.Diff([][]bool{{false}, {false}, {true, true}}, created); diff != "" {
+		t.Error("Created doesn't match (+y -x):\n", diff)
+	}
+
+	t.Run("first error", func(t *testing.T) {
+		conns := []syscall.Conn{
+			testutil.Listen(t, netns, "tcp4", ""),
+			testutil.Listen(t, netns, "unix", ""),
+			testutil.Listen(t, netns, "tcp", ":0"),
+		}
+
+		dests, created, err := dp.RegisterSockets([]string{"a", "b", "c"}, conns, false)
+		if !errors.Is(err, ErrBadSocketDomain) {
+			t.Fatal("Expected ErrBadSocketDomain, got", err)
+		}
+		if len(dests) != 1 || len(created) != 1 {
+			t.Errorf("Expected one registered socket, got %d and %d", len(dests), len(created))
+		}
+	})
+
+	t.Run("multiple sockets", func(t *testing.T) {
+		conns := []syscall.Conn{
+			testutil.Listen(t, netns, "udp4", ""),
+			testutil.Listen(t, netns, "udp4", ""),
+		}
+
+		_, created, err := dp.RegisterSockets([]string{"dup", "dup"}, conns, false)
+		if err == nil {
+			t.Fatal("Expected an error")
+		}
+		if len(created) != 2 {
+			t.Error("Expected two registered sockets, got", len(created))
+		}
+	})
+}
+
+func TestRegisterUnixSocket(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	networks := []string{
+		"unix",
+		"unixpacket",
+		"unixgram",
+	}
+	for _, network := range networks {
+		t.Run(network, func(t *testing.T) {
+			conn := testutil.Listen(t, netns, network, "")
+			_, _, err := dp.RegisterSocket("service-name", conn)
+			if err == nil {
+				t.Fatal("RegisterSocket didn't fail")
+			}
+		})
+	}
+}
+
+func TestRegisterConnectedSocket(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	networks := []string{
+		"tcp4",
+		"udp4",
+	}
+
+	for _, network := range networks {
+		t.Run(network, func(t *testing.T) {
+			testutil.ListenAndEcho(t, netns, network, "127.0.0.1:1234")
+			conn := testutil.Dial(t, netns, network, "127.0.0.1:1234")
+
+			_, _, err := dp.RegisterSocket("service-name", conn)
+			if err == nil {
+				t.Fatal("RegisterSocket didn't fail")
+			}
+		})
+	}
+}
+
+func TestCheckBinding(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	v6 := mustNewBinding(t, "foo", TCP, "::1", 80)
+	if err := dp.CheckBinding(v6); err != nil {
+		t.Fatal("Label without sockets is rejected:", err)
+	}
+
+	mustRegisterSocket(t, dp, "foo", testutil.Listen(t, netns, "tcp4", "127.0.0.1:0"))
+
+	if err := dp.CheckBinding(v6); !errors.Is(err, ErrWrongFamily) {
+		t.Fatal("Expected ErrWrongFamily, got", err)
+	}
+
+	if err := dp.CheckBinding(mustNewBinding(t, "foo", UDP, "::1", 80)); err != nil {
+		t.Error("Label with socket for other protocol is rejected:", err)
+	}
+
+	if err := dp.CheckBinding(mustNewBinding(t, "foo", TCP, "127.0.0.1", 80)); err != nil {
+		t.Error("Binding matching the socket family is rejected:", err)
+	}
+
+	mustRegisterSocket(t, dp, "foo", testutil.Listen(t, netns, "tcp6", "[::1]:0"))
+
+	if err := dp.CheckBinding(v6); err != nil {
+		t.Error("Label with sockets for both families is rejected:", err)
+	}
+}
+
+func TestProgramStats(t *testing.T) {
+	var stats io.Closer
+	err := testutil.WithCapabilities(func() (err error) {
+		stats, err = ebpf.EnableStats(uint32(unix.BPF_STATS_RUN_TIME))
+		return
+	}, cap.SYS_ADMIN)
+	if err != nil {
+		t.Fatal("Enable stats:", err)
+	}
+	defer stats.Close()
+
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "127.0.0.1", 8080))
+	ln := testutil.ListenAndEcho(t, netns, "tcp4", "127.0.0.1:0")
+	mustRegisterSocket(t, dp, "foo", ln)
+
+	testutil.CanDial(t, netns, "tcp4", "127.0.0.1:8080")
+
+	runs, avg, err := dp.ProgramStats()
+	if err != nil {
+		t.Fatal("Can't get program stats:", err)
+	}
+
+	if runs == 0 {
+		t.Error("Expected a non-zero run count")
+	}
+
+	if avg == 0 {
+		t.Error("Expected a non-zero average runtime")
+	}
+}
+
+func TestOverlappingBindings(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	var (
+		subnet = mustNewBinding(t, "foo", TCP, "127.0.0.0/24", 80)
+		host   = mustNewBinding(t, "bar", TCP, "127.0.0.1", 80)
+	)
+
+	mustAddBinding(t, dp, subnet)
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", UDP, "127.0.0.1", 80))
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "127.0.1.0/24", 80))
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "::1", 80))
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "127.0.0.0/24", 443))
+
+	have, err := dp.OverlappingBindings(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Bindings{subnet}, have, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Overlaps of %s don't match (-want +got):\n%s", host, diff)
+	}
+
+	if err := dp.RemoveBinding(subnet); err != nil {
+		t.Fatal(err)
+	}
+	mustAddBinding(t, dp, host)
+
+	have, err = dp.OverlappingBindings(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Bindings{host}, have, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Overlaps of %s don't match (-want +got):\n%s", subnet, diff)
+	}
+}
+
+func TestBindingsOrder(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	bindings := Bindings{
+		mustNewBinding(t, "foo", TCP, "127.0.0.1", 80),
+		mustNewBinding(t, "foo", TCP, "127.0.0.0/8", 80),
+		mustNewBinding(t, "bar", TCP, "127.0.0.0/8", 0),
+		mustNewBinding(t, "foo", TCP, "::1", 443),
+		mustNewBinding(t, "bar", UDP, "10.0.0.0/8", 53),
+		mustNewBinding(t, "foo", UDP, "::/64", 53),
+	}
+
+	for _, i := range rand.Perm(len(bindings)) {
+		mustAddBinding(t, dp, bindings[i])
+	}
+
+	var foo Bindings
+	for _, bind := range bindings {
+		if bind.Label == "foo" {
+			foo = append(foo, bind)
+		}
+	}
+	sort.Sort(bindings)
+	sort.Sort(foo)
+
+	for _, test := range []struct {
+		name string
+		list func() (Bindings, error)
+		want Bindings
+	}{
+		{"Bindings", dp.Bindings, bindings},
+		{"BindingsForLabel", func() (Bindings, error) { return dp.BindingsForLabel("foo") }, foo},
+	} {
+		for i := 0; i < 2; i++ {
+			have, err := test.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(test.want, have, testutil.IPPrefixComparer()); diff != "" {
+				t.Errorf("%s isn't sorted on call #%d (-want +got):\n%s", test.name, i+1, diff)
+			}
+		}
+	}
+}
+
+func TestBindingsForLabel(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	foo := Bindings{
+		mustNewBinding(t, "foo", TCP, "127.0.0.1", 80),
+		mustNewBinding(t, "foo", UDP, "::1", 53),
+	}
+	for _, bind := range foo {
+		mustAddBinding(t, dp, bind)
+	}
+	mustAddBinding(t, dp, mustNewBinding(t, "bar", TCP, "127.0.0.2", 80))
+
+	have, err := dp.BindingsForLabel("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Sort(foo)
+	sort.Sort(have)
+	if diff := cmp.Diff(foo, have, testutil.IPPrefixComparer()); diff != "" {
+		t.Errorf("Bindings don't match (-want +got):\n%s", diff)
+	}
+
+	if have, err := dp.BindingsForLabel("baz"); err != nil {
+		t.Fatal(err)
+	} else if len(have) != 0 {
+		t.Error("Expected no bindings for unknown label, got", have)
+	}
+}
+
+func TestGCDestinations(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	mustAddBinding(t, dp, mustNewBinding(t, "bound", TCP, "127.0.0.1", 80))
+	live := mustRegisterSocket(t, dp, "live", testutil.Listen(t, netns, "tcp4", ""))
+
+	// Closing a registered socket removes it from the sockmap, but leaves the
+	// allocation behind.
+	ln := testutil.Listen(t, netns, "tcp4", "").(*net.TCPListener)
+	mustRegisterSocket(t, dp, "leaked", ln)
+	ln.Close()
+
+	countAllocs := func() (n int) {
+		t.Helper()
+
+		var (
+			key   destinationKey
+			alloc destinationAlloc
+			iter  = dp.destinations.allocs.Iterate()
+		)
+		for iter.Next(&key, &alloc) {
+			n++
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if n := countAllocs(); n != 3 {
+		t.Fatal("Expected three allocations before GC, got", n)
+	}
+
+	metrics, err := dp.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.DestinationsUsed != 2 {
+		t.Error("Leaked allocation is counted as used:", metrics.DestinationsUsed)
+	}
+
+	want, _, err := dp.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := dp.GCDestinations()
+	if err != nil {
+		t.Fatal("Can't GC destinations:", err)
+	}
+	if removed != 1 {
+		t.Error("Expected one removed destination, got", removed)
+	}
+
+	if n := countAllocs(); n != 2 {
+		t.Error("Expected two allocations after GC, got", n)
+	}
+
+	have, cookies, err := dp.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sortDests := cmp.Transformer("sort", func(in []Destination) []Destination {
+		out := append([]Destination(nil), in...)
+		sort.Slice(out, func(i, j int) bool { return out[i].Label < out[j].Label })
+		return out
+	})
+	if diff := cmp.Diff(want, have, sortDests); diff != "" {
+		t.Errorf("Live destinations changed (-want +got):\n%s", diff)
+	}
+
+	if cookies[*live] == 0 {
+		t.Error("Socket for live destination is missing after GC")
+	}
+
+	if removed, err := dp.GCDestinations(); err != nil {
+		t.Fatal(err)
+	} else if removed != 0 {
+		t.Error("Second GC removed", removed, "destinations")
+	}
+}
+
+func TestAlternateObject(t *testing.T) {
+	spec, err := loadDispatcherSpec(bytes.NewReader(_DispatcherBytes))
+	if err != nil {
+		t.Fatal("Can't load alternate object:", err)
+	}
+
+	if err := isSpecCompatible(spec); err != nil {
+		t.Fatal("Identical object isn't compatible:", err)
+	}
+
+	incompatible := spec.Copy()
+	incompatible.Maps["sockets"].ValueSize *= 2
+	if err := isSpecCompatible(incompatible); err == nil {
+		t.Error("Object with different value size is compatible")
+	}
+
+	incompatible = spec.Copy()
+	delete(incompatible.Maps, "bindings")
+	if err := isSpecCompatible(incompatible); err == nil {
+		t.Error("Object without bindings map is compatible")
+	}
+
+	if _, err := loadDispatcherSpec(bytes.NewReader([]byte("not an ELF"))); err == nil {
+		t.Error("Loading an invalid object doesn't fail")
+	}
+
+	netns := testutil.NewNetNS(t)
+
+	var dp *Dispatcher
+	err = testutil.WithCapabilities(func() (err error) {
+		dp, err = CreateDispatcherWithOptions(netns.Path(), "/sys/fs/bpf", CreateOptions{
+			Permissions: DefaultPermissions,
+			Object:      bytes.NewReader(_DispatcherBytes),
+		})
+		return
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Can't create dispatcher from alternate object:", err)
+	}
+	path := dp.Path
+	t.Cleanup(func() { os.RemoveAll(path) })
+	dp.Close()
+
+	err = testutil.WithCapabilities(func() error {
+		_, err := UpgradeDispatcherWithOptions(netns.Path(), "/sys/fs/bpf", UpgradeOptions{
+			Permissions: DefaultPermissions,
+			Object:      bytes.NewReader(_DispatcherBytes),
+		})
+		return err
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Can't upgrade to alternate object:", err)
 	}
 }
 
-func TestRegisterSupportedSocketKind(t *testing.T) {
+func TestDispatcherNotBPFFS(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dir := t.TempDir()
+
+	_, err := OpenDispatcher(netns.Path(), dir, true)
+	if !errors.Is(err, ErrNotBPFFS) {
+		t.Fatal("Expected ErrNotBPFFS, got", err)
+	}
+	if !strings.Contains(err.Error(), "mount -t bpf bpf "+dir) {
+		t.Error("Error doesn't explain how to mount bpffs:", err)
+	}
+
+	_, err = OpenDispatcher(netns.Path(), filepath.Join(dir, "missing"), true)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Error("Expected os.ErrNotExist for a missing path, got", err)
+	}
+}
+
+func TestCreateDispatcherMaxDestinations(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	spec, err := loadPatchedDispatcher(nil, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultMax := spec.Maps["sockets"].MaxEntries
+
+	var dp *Dispatcher
+	err = testutil.WithCapabilities(func() (err error) {
+		dp, err = CreateDispatcherWithOptions(netns.Path(), "/sys/fs/bpf", CreateOptions{
+			Permissions:     DefaultPermissions,
+			MaxDestinations: defaultMax * 2,
+		})
+		return
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Can't create dispatcher:", err)
+	}
+	path := dp.Path
+	t.Cleanup(func() { os.RemoveAll(path) })
+
+	// This is one more than fits into a dispatcher of the default size.
+	for i := uint32(0); i <= defaultMax; i++ {
+		bind := mustNewBinding(t, fmt.Sprintf("label-%d", i), TCP, "127.0.0.1", 80+uint16(i))
+		mustAddBinding(t, dp, bind)
+	}
+	dp.Close()
+
+	// Upgrading must keep the size of the pinned maps.
+	err = testutil.WithCapabilities(func() error {
+		_, err := UpgradeDispatcher(netns.Path(), "/sys/fs/bpf")
+		return err
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Can't upgrade resized dispatcher:", err)
+	}
+
+	dp = mustOpenDispatcher(t, nil, netns)
+
+	metrics, err := dp.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.DestinationsUsed != uint64(defaultMax)+1 {
+		t.Errorf("Expected %d destinations, got %d", defaultMax+1, metrics.DestinationsUsed)
+	}
+	if metrics.DestinationsCapacity != uint64(defaultMax*2) {
+		t.Errorf("Expected capacity of %d, got %d", defaultMax*2, metrics.DestinationsCapacity)
+	}
+}
+
+func TestRemoveSocket(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
 
-	networks := []string{
-		"tcp4",
-		"tcp6",
-		"udp4",
-		"udp6",
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "127.0.0.1", 80))
+	foo := mustRegisterSocket(t, dp, "foo", testutil.Listen(t, netns, "tcp4", "127.0.0.1:0"))
+	bar := mustRegisterSocket(t, dp, "bar", testutil.Listen(t, netns, "tcp4", "127.0.0.1:0"))
+
+	if err := dp.RemoveSocket(foo); err != nil {
+		t.Fatal("Can't remove socket:", err)
 	}
-	for _, network := range networks {
-		t.Run(network, func(t *testing.T) {
-			conn := testutil.Listen(t, netns, network, "")
-			_, created, err := dp.RegisterSocket("service-name", conn)
-			if err != nil {
-				t.Fatal("RegisterSocket failed:", err)
-			}
 
-			if !created {
-				t.Error("RegisterSocket doesn't return true for new sockets")
-			}
+	sockets, err := dp.destinations.Sockets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets) != 1 {
+		t.Error("Expected one socket after removal, got", len(sockets))
+	}
 
-			// TODO: Lookup registered socket
+	_, cookies, err := dp.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie, ok := cookies[*foo]; !ok {
+		t.Error("Destination with bindings is gone after removing its socket")
+	} else if cookie != 0 {
+		t.Error("Destination still has socket", cookie)
+	}
+	if cookies[*bar] == 0 {
+		t.Error("Removing a socket affects other destinations")
+	}
+
+	if err := dp.RemoveSocket(foo); err == nil {
+		t.Error("Removing a socket twice doesn't return an error")
+	}
+}
+
+func TestVerifySockets(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	mustAddBinding(t, dp, mustNewBinding(t, "live", TCP, "127.0.0.1", 80))
+	mustRegisterSocket(t, dp, "live", testutil.Listen(t, netns, "tcp4", "127.0.0.1:0"))
+
+	ln := testutil.Listen(t, netns, "tcp4", "127.0.0.1:0").(*net.TCPListener)
+	mustAddBinding(t, dp, mustNewBinding(t, "closed", TCP, "127.0.0.1", 81))
+	closed := mustRegisterSocket(t, dp, "closed", ln)
+
+	// A socket without bindings isn't dead even once it's closed, since no
+	// traffic can reach it.
+	unbound := testutil.Listen(t, netns, "tcp4", "127.0.0.1:0").(*net.TCPListener)
+	mustRegisterSocket(t, dp, "unbound", unbound)
+
+	dead, err := dp.VerifySockets()
+	if err != nil {
+		t.Fatal("Can't verify sockets:", err)
+	}
+	if len(dead) != 0 {
+		t.Fatal("Expected no dead destinations, got", dead)
+	}
+
+	ln.Close()
+	unbound.Close()
+
+	dead, err = dp.VerifySockets()
+	if err != nil {
+		t.Fatal("Can't verify sockets:", err)
+	}
+	if diff := cmp.Diff([]Destination{*closed}, dead); diff != "" {
+		t.Errorf("Dead destinations don't match (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckReuseportConsistency(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	group := testutil.ReuseportGroup(t, netns, "tcp4", 2)
+	foo := mustRegisterSocket(t, dp, "foo", group[0])
+	mustRegisterSocket(t, dp, "baz", testutil.Listen(t, netns, "tcp4", "127.0.0.1:0"))
+
+	checkConflicts := func(t *testing.T) []ReuseportConflict {
+		t.Helper()
+
+		var conflicts []ReuseportConflict
+		testutil.JoinNetNS(t, netns, func() (err error) {
+			conflicts, err = dp.CheckReuseportConsistency()
+			return
 		})
+		return conflicts
+	}
+
+	if conflicts := checkConflicts(t); len(conflicts) != 0 {
+		t.Fatal("Expected no conflicts, got", conflicts)
+	}
+
+	bar := mustRegisterSocket(t, dp, "bar", group[1])
+
+	conflicts := checkConflicts(t)
+	if len(conflicts) != 1 {
+		t.Fatal("Expected one conflict, got", conflicts)
+	}
+
+	conflict := conflicts[0]
+	if conflict.Protocol != TCP {
+		t.Error("Expected TCP, got", conflict.Protocol)
+	}
+	if conflict.Addr.IP() != netaddr.MustParseIP("127.0.0.1") || conflict.Addr.Port() == 0 {
+		t.Error("Unexpected address", conflict.Addr)
+	}
+	if diff := cmp.Diff([]Destination{*bar, *foo}, conflict.Destinations); diff != "" {
+		t.Errorf("Destinations don't match (-want +got):\n%s", diff)
 	}
 }
 
-func TestUpdateRegisteredSocket(t *testing.T) {
+func TestCheckReuseportConsistencyDualStack(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
 
-	for i := 0; i < 3; i++ {
-		conn := testutil.Listen(t, netns, "tcp4", "")
-		_, created, err := dp.RegisterSocket("service-name", conn)
-		if err != nil {
-			t.Fatalf("Can't RegisterSocket try #%d: %v", i+1, err)
-		}
+	lc := net.ListenConfig{
+		Control: func(network, address string, raw syscall.RawConn) (err error) {
+			raw.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			return
+		},
+	}
 
-		if i > 0 && created {
-			t.Errorf("Created is true on try #%d", i+1)
+	var group []net.Listener
+	testutil.JoinNetNS(t, netns, func() error {
+		addr := ":0"
+		for i := 0; i < 2; i++ {
+			// Go creates dual-stack sockets when listening on the wildcard
+			// address.
+			ln, err := lc.Listen(context.Background(), "tcp", addr)
+			if err != nil {
+				return err
+			}
+			t.Cleanup(func() { ln.Close() })
+
+			group = append(group, ln)
+			addr = ln.Addr().String()
 		}
+		return nil
+	})
+
+	// A single socket registered for both families isn't a conflict, even
+	// though it has two destinations.
+	_, _, err := dp.RegisterDualStackSocket("dual", group[0].(syscall.Conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A socket without SO_REUSEPORT isn't part of a group.
+	ln := testutil.Listen(t, netns, "tcp4", "127.0.0.1:0")
+	mustRegisterSocket(t, dp, "foo", ln)
+	mustRegisterSocket(t, dp, "bar", ln)
+
+	var conflicts []ReuseportConflict
+	testutil.JoinNetNS(t, netns, func() (err error) {
+		conflicts, err = dp.CheckReuseportConsistency()
+		return
+	})
+	if len(conflicts) != 0 {
+		t.Error("Expected no conflicts, got", conflicts)
 	}
 }
 
-func TestRegisterUnixSocket(t *testing.T) {
+func TestMetricsDoesNotBlockWriters(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
+	for i := 0; i < 100; i++ {
+		mustAddBinding(t, dp, mustNewBinding(t, fmt.Sprintf("label-%d", i), TCP, "127.0.0.1", uint16(i+1)))
+	}
+	dp.Close()
 
-	networks := []string{
-		"unix",
-		"unixpacket",
-		"unixgram",
+	ro, err := OpenDispatcher(netns.Path(), "/sys/fs/bpf", true)
+	if err != nil {
+		t.Fatal("Can't open read-only dispatcher:", err)
 	}
-	for _, network := range networks {
-		t.Run(network, func(t *testing.T) {
-			conn := testutil.Listen(t, netns, network, "")
-			_, _, err := dp.RegisterSocket("service-name", conn)
-			if err == nil {
-				t.Fatal("RegisterSocket didn't fail")
-			}
-		})
+	defer ro.Close()
+
+	bind := mustNewBinding(t, "foo", TCP, "127.0.0.1", 8080)
+	metrics, err := ro.metrics(func() {
+		rw, err := TryOpenDispatcher(netns.Path(), "/sys/fs/bpf", false)
+		if err != nil {
+			t.Error("Can't open writable dispatcher during metrics scan:", err)
+			return
+		}
+		defer rw.Close()
+
+		mustAddBinding(t, rw, bind)
+	})
+	if err != nil {
+		t.Fatal("Can't get metrics:", err)
+	}
+
+	if n := len(metrics.Destinations); n != 100 {
+		t.Errorf("Expected metrics for 100 destinations, got %d", n)
+	}
+
+	if _, err := TryOpenDispatcher(netns.Path(), "/sys/fs/bpf", false); !errors.Is(err, ErrLocked) {
+		t.Error("Metrics doesn't re-acquire the lock:", err)
 	}
 }
 
-func TestRegisterConnectedSocket(t *testing.T) {
+func TestMetricsPerCPU(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
+	ln := testutil.ListenAndEcho(t, netns, "tcp4", "")
 
-	networks := []string{
-		"tcp4",
-		"udp4",
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "127.0.0.1", 8080))
+	mustAddBinding(t, dp, mustNewBinding(t, "bar", UDP, "127.0.0.1", 53))
+	testutil.CanDial(t, netns, "tcp4", "127.0.0.1:8080")
+	mustRegisterSocket(t, dp, "foo", ln.(syscall.Conn))
+	testutil.CanDial(t, netns, "tcp4", "127.0.0.1:8080")
+
+	metrics, err := dp.Metrics()
+	if err != nil {
+		t.Fatal("Can't get metrics:", err)
 	}
 
-	for _, network := range networks {
-		t.Run(network, func(t *testing.T) {
-			testutil.ListenAndEcho(t, netns, network, "127.0.0.1:1234")
-			conn := testutil.Dial(t, netns, network, "127.0.0.1:1234")
+	perCPU, err := dp.MetricsPerCPU()
+	if err != nil {
+		t.Fatal("Can't get per-CPU metrics:", err)
+	}
 
-			_, _, err := dp.RegisterSocket("service-name", conn)
-			if err == nil {
-				t.Fatal("RegisterSocket didn't fail")
-			}
-		})
+	if len(perCPU) != len(metrics.Destinations) {
+		t.Fatalf("Expected %d destinations, got %d", len(metrics.Destinations), len(perCPU))
+	}
+
+	cpus := mustPossibleCPUs(t)
+	for dest, want := range metrics.Destinations {
+		if n := len(perCPU[dest]); n != cpus {
+			t.Errorf("Expected %d CPUs for %s, got %d", cpus, &dest, n)
+		}
+
+		if have := sumDestinationMetrics(perCPU[dest]); have != want {
+			t.Errorf("Sum of per-CPU metrics for %s is %+v instead of %+v", &dest, have, want)
+		}
+	}
+}
+
+// mustPossibleCPUs returns the number of CPUs per-CPU maps have values for.
+func mustPossibleCPUs(tb testing.TB) int {
+	tb.Helper()
+
+	possible, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// The file contains a range like 0-7, or 0 on single CPU machines.
+	var first, last int
+	n, _ := fmt.Sscanf(strings.TrimSpace(string(possible)), "%d-%d", &first, &last)
+	switch n {
+	case 1:
+		return 1
+	case 2:
+		return last + 1
+	default:
+		tb.Fatalf("Can't parse possible CPUs %q", possible)
+		return 0
 	}
 }
 
@@ -827,7 +2080,7 @@ func TestMetrics(t *testing.T) {
 	ln := testutil.ListenAndEcho(t, netns, "tcp4", "").(*net.TCPListener)
 
 	bind := mustNewBinding(t, "foo", TCP, "127.0.0.1", 8080)
-	if err := dp.AddBinding(bind); err != nil {
+	if _, err := dp.AddBinding(bind); err != nil {
 		t.Fatal("Can't add binding:", err)
 	}
 
@@ -877,7 +2130,7 @@ func TestMetrics(t *testing.T) {
 
 	// New binding should re-use ID
 	bind2 := mustNewBinding(t, "foo", UDP, "127.0.0.1", 443)
-	if err := dp.AddBinding(bind2); err != nil {
+	if _, err := dp.AddBinding(bind2); err != nil {
 		t.Fatal("Can't add second binding:", err)
 	}
 
@@ -923,7 +2176,7 @@ func TestBindingPrecedence(t *testing.T) {
 
 	listeners := make(map[string]syscall.Conn)
 	for i, bind := range testcases {
-		if err := dp.AddBinding(bind); err != nil {
+		if _, err := dp.AddBinding(bind); err != nil {
 			t.Fatal("Can't add binding", i, bind, err)
 		}
 
@@ -966,6 +2219,86 @@ func BenchmarkDispatcherAddBinding(b *testing.B) {
 	b.StopTimer()
 }
 
+func BenchmarkDispatcherBindingsForLabel(b *testing.B) {
+	netns := testutil.NewNetNS(b)
+	dp := mustCreateDispatcher(b, netns)
+
+	bindings := mustReadBindings(b, "some-label")
+	for i, bind := range bindings {
+		if i%100 == 0 {
+			bind.Label = "other-label"
+		}
+		mustAddBinding(b, dp, bind)
+	}
+
+	b.Run("BindingsForLabel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := dp.BindingsForLabel("other-label"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Bindings", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			all, err := dp.Bindings()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var filtered Bindings
+			for _, bind := range all {
+				if bind.Label == "other-label" {
+					filtered = append(filtered, bind)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkDispatcherRegisterSockets(b *testing.B) {
+	netns := testutil.NewNetNS(b)
+	dp := mustCreateDispatcher(b, netns)
+
+	var (
+		labels []string
+		conns  []syscall.Conn
+	)
+	for i := 0; i < 256; i++ {
+		labels = append(labels, fmt.Sprintf("label-%d", i))
+		conns = append(conns, testutil.Listen(b, netns, "udp4", ""))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := dp.RegisterSockets(labels, conns, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDispatcherMetrics(b *testing.B) {
+	netns := testutil.NewNetNS(b)
+	dp := mustCreateDispatcher(b, netns)
+	for i := 0; i < 512; i++ {
+		mustAddBinding(b, dp, mustNewBinding(b, fmt.Sprintf("label-%d", i), TCP, "127.0.0.1", uint16(i+1)))
+	}
+	dp.Close()
+
+	ro, err := OpenDispatcher(netns.Path(), "/sys/fs/bpf", true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ro.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ro.Metrics(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkDispatcherManyBindings(b *testing.B) {
 	const label = "some-label"
 
@@ -1108,7 +2441,7 @@ func mustNewBinding(tb testing.TB, label string, proto Protocol, prefix string,
 func mustAddBinding(tb testing.TB, dp *Dispatcher, bind *Binding) {
 	tb.Helper()
 
-	if err := dp.AddBinding(bind); err != nil {
+	if _, err := dp.AddBinding(bind); err != nil {
 		tb.Fatal("Can't add binding:", err)
 	}
 }
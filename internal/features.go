@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// CheckKernelFeatures probes for the program and map types used by the
+// dispatcher, and for attaching sk_lookup programs to a network namespace.
+// It requires the same privileges as CreateDispatcher.
+//
+// Returns an error wrapping ErrMissingKernelFeature if the kernel is too old.
+func CheckKernelFeatures() error {
+	spec, err := loadPatchedDispatcher(nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:       ebpf.SkLookup,
+		AttachType: ebpf.AttachSkLookup,
+		License:    "GPL",
+		Instructions: asm.Instructions{
+			// SK_PASS continues with the regular socket lookup.
+			asm.Mov.Imm(asm.R0, 1),
+			asm.Return(),
+		},
+	})
+	if errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("kernel %s lacks sk_lookup, need >= 5.9: %w", kernelRelease(), ErrMissingKernelFeature)
+	} else if err != nil {
+		return fmt.Errorf("probe sk_lookup: %s", err)
+	}
+	defer prog.Close()
+
+	if err := probeNetNSAttach(prog); err != nil {
+		return err
+	}
+
+	for _, mapSpec := range spec.Maps {
+		probe := mapSpec.Copy()
+		probe.MaxEntries = 1
+		probe.Pinning = ebpf.PinNone
+
+		m, err := ebpf.NewMap(probe)
+		if errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("kernel %s doesn't support %s maps like %q: %w", kernelRelease(), probe.Type, probe.Name, ErrMissingKernelFeature)
+		} else if err != nil {
+			return fmt.Errorf("probe map %q: %s", probe.Name, err)
+		}
+		m.Close()
+	}
+
+	return nil
+}
+
+// probeNetNSAttach attaches prog to a throwaway network namespace, so that
+// probing doesn't affect traffic in the current one.
+//
+// The namespace is created on the calling thread, since capabilities may
+// only be effective there, and the thread is switched back afterwards.
+func probeNetNSAttach(prog *ebpf.Program) (err error) {
+	runtime.LockOSThread()
+
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("open network namespace: %s", err)
+	}
+	defer orig.Close()
+
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("create network namespace: %s", err)
+	}
+	defer func() {
+		// The thread stays locked if it can't be switched back, which makes
+		// the runtime discard it instead of reusing it in the wrong
+		// namespace.
+		if setnsErr := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); setnsErr != nil {
+			if err == nil {
+				err = fmt.Errorf("restore network namespace: %s", setnsErr)
+			}
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+
+	netns, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return fmt.Errorf("open throwaway network namespace: %s", err)
+	}
+	defer netns.Close()
+
+	l, err := link.AttachNetNs(int(netns.Fd()), prog)
+	if errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("kernel %s can't attach sk_lookup to a network namespace: %w", kernelRelease(), ErrMissingKernelFeature)
+	} else if err != nil {
+		return fmt.Errorf("probe sk_lookup attach: %s", err)
+	}
+
+	return l.Close()
+}
+
+func kernelRelease() string {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return "(unknown)"
+	}
+	return unix.ByteSliceToString(uname.Release[:])
+}
@@ -0,0 +1,18 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal/testutil"
+)
+
+func TestCheckKernelFeatures(t *testing.T) {
+	err := testutil.WithCapabilities(CheckKernelFeatures, CreateCapabilities...)
+	if errors.Is(err, ErrMissingKernelFeature) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal("Can't check kernel features:", err)
+	}
+}
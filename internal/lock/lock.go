@@ -2,10 +2,12 @@
 package lock
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/cloudflare/tubular/internal/sysconn"
 
@@ -19,6 +21,9 @@ import (
 type File struct {
 	*os.File
 	how int
+
+	mu   sync.Mutex
+	held bool
 }
 
 var _ sync.Locker = (*File)(nil)
@@ -27,7 +32,7 @@ var _ sync.Locker = (*File)(nil)
 //
 // Returns an unlocked lock.
 func Exclusive(file *os.File) *File {
-	return &File{file, unix.LOCK_EX}
+	return &File{File: file, how: unix.LOCK_EX}
 }
 
 // OpenLockedExclusive opens the given path and acquires an exclusive lock.
@@ -48,7 +53,7 @@ func OpenLockedExclusive(path string) (*File, error) {
 //
 // Returns an unlocked lock.
 func Shared(file *os.File) *File {
-	return &File{file, unix.LOCK_SH}
+	return &File{File: file, how: unix.LOCK_SH}
 }
 
 // OpenShared opens the given path and acquires a shared lock.
@@ -70,6 +75,7 @@ func (fl *File) Lock() {
 	if err := fl.flock(fl.how); err != nil {
 		panic(err.Error())
 	}
+	fl.setHeld(true)
 }
 
 // TryLock attempts to lock the file without blocking.
@@ -84,9 +90,38 @@ func (fl *File) TryLock() bool {
 
 		panic(err.Error())
 	}
+	fl.setHeld(true)
 	return true
 }
 
+// LockContext is like Lock, but gives up once ctx is done.
+//
+// Returns ctx.Err() if the lock wasn't acquired in time.
+func (fl *File) LockContext(ctx context.Context) error {
+	const maxBackoff = 100 * time.Millisecond
+	for backoff := time.Millisecond; ; backoff *= 2 {
+		err := fl.flock(fl.how | unix.LOCK_NB)
+		if err == nil {
+			fl.setHeld(true)
+			return nil
+		} else if !errors.Is(err, unix.EWOULDBLOCK) {
+			return err
+		}
+
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
 // Unlock implements sync.Locker.
 //
 // It panics if the underlying syscalls return an error.
@@ -94,6 +129,30 @@ func (fl *File) Unlock() {
 	if err := fl.flock(unix.LOCK_UN); err != nil {
 		panic(err.Error())
 	}
+	fl.setHeld(false)
+}
+
+// Held returns true if the lock was acquired via fl and hasn't been released
+// since.
+//
+// It doesn't observe locks acquired or released via other file descriptors
+// which share the same file description.
+func (fl *File) Held() bool {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return fl.held
+}
+
+// Close closes the file, which releases the lock.
+func (fl *File) Close() error {
+	fl.setHeld(false)
+	return fl.File.Close()
+}
+
+func (fl *File) setHeld(held bool) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.held = held
 }
 
 func (fl *File) flock(how int) error {
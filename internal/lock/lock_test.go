@@ -1,6 +1,8 @@
 package lock
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -84,6 +86,83 @@ func TestTryLock(t *testing.T) {
 	}
 }
 
+func TestLockContext(t *testing.T) {
+	newHandle := mustTempDir(t)
+	a := Exclusive(newHandle())
+	defer a.Close()
+
+	b := Exclusive(newHandle())
+	defer b.Close()
+
+	a.Lock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.LockContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatal("Expected context.Canceled, got", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.LockContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("Expected context.DeadlineExceeded, got", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.Unlock()
+	}()
+
+	if err := b.LockContext(context.Background()); err != nil {
+		t.Fatal("Can't acquire lock after it was released:", err)
+	}
+}
+
+func TestHeld(t *testing.T) {
+	newHandle := mustTempDir(t)
+	a := Shared(newHandle())
+	defer a.Close()
+
+	if a.Held() {
+		t.Fatal("New lock is held")
+	}
+
+	a.Lock()
+	if !a.Held() {
+		t.Fatal("Lock isn't held after Lock")
+	}
+
+	a.Unlock()
+	if a.Held() {
+		t.Fatal("Lock is held after Unlock")
+	}
+
+	if !a.TryLock() || !a.Held() {
+		t.Fatal("Lock isn't held after TryLock")
+	}
+
+	b := Exclusive(newHandle())
+	defer b.Close()
+
+	if b.TryLock() || b.Held() {
+		t.Fatal("Failed TryLock marks lock as held")
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Held() {
+		t.Fatal("Lock is held after Close")
+	}
+
+	if err := b.LockContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Held() {
+		t.Fatal("Lock isn't held after LockContext")
+	}
+}
+
 func mustTempDir(tb testing.TB) func() *os.File {
 	tb.Helper()
 
@@ -13,6 +13,29 @@ type Logger interface {
 	io.Writer
 }
 
+// FieldLogger is implemented by loggers which emit structured output.
+type FieldLogger interface {
+	// LogFields logs msg together with alternating keys and values.
+	LogFields(msg string, keysAndValues ...interface{})
+}
+
+// Fields logs msg together with alternating keys and values.
+//
+// If l doesn't implement FieldLogger the keys are dropped, and the values
+// are logged after msg as if by calling l.Log.
+func Fields(l Logger, msg string, keysAndValues ...interface{}) {
+	if fl, ok := l.(FieldLogger); ok {
+		fl.LogFields(msg, keysAndValues...)
+		return
+	}
+
+	args := []interface{}{msg}
+	for i := 1; i < len(keysAndValues); i += 2 {
+		args = append(args, keysAndValues[i])
+	}
+	l.Log(args...)
+}
+
 // StdLogger logs to a standard logger.
 type StdLogger struct {
 	*log.Logger
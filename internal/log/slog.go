@@ -0,0 +1,50 @@
+//go:build go1.21
+
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// SlogLogger logs to a structured logger from log/slog.
+//
+// Messages from Log, Logf and Write are emitted at Level without any
+// attributes, while LogFields attaches its keys and values as attributes.
+type SlogLogger struct {
+	Logger *slog.Logger
+	Level  slog.Level
+}
+
+var (
+	_ Logger      = (*SlogLogger)(nil)
+	_ FieldLogger = (*SlogLogger)(nil)
+)
+
+// NewSlogLogger logs to l at info level.
+func NewSlogLogger(l *slog.Logger) *SlogLogger {
+	return &SlogLogger{l, slog.LevelInfo}
+}
+
+func (sl *SlogLogger) Log(args ...interface{}) {
+	sl.log(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+func (sl *SlogLogger) Logf(format string, args ...interface{}) {
+	sl.log(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+func (sl *SlogLogger) LogFields(msg string, keysAndValues ...interface{}) {
+	sl.Logger.Log(context.Background(), sl.Level, msg, keysAndValues...)
+}
+
+func (sl *SlogLogger) Write(buf []byte) (int, error) {
+	sl.log(strings.TrimSuffix(string(buf), "\n"))
+	return len(buf), nil
+}
+
+func (sl *SlogLogger) log(msg string) {
+	sl.Logger.Log(context.Background(), sl.Level, msg)
+}
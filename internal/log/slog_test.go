@@ -0,0 +1,45 @@
+//go:build go1.21
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestFields(t *testing.T) {
+	var buf Buffer
+	Fields(&buf, "added", "label", "foo", "port", 80)
+	if have, want := buf.String(), "added foo 80\n"; have != want {
+		t.Errorf("Expected %q, got %q", want, have)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	decode := func() map[string]interface{} {
+		t.Helper()
+
+		var record map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatal("Can't decode record:", err)
+		}
+		buf.Reset()
+		return record
+	}
+
+	Fields(l, "added", "label", "foo", "port", 80)
+	record := decode()
+	if record["msg"] != "added" || record["label"] != "foo" || record["port"] != float64(80) {
+		t.Error("Record doesn't contain fields:", record)
+	}
+
+	l.Logf("created %s\n", "dispatcher")
+	if record := decode(); record["msg"] != "created dispatcher" {
+		t.Error("Unexpected message:", record["msg"])
+	}
+}
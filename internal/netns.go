@@ -12,26 +12,50 @@ import (
 //
 // Returns the associated state directory.
 func openNetNS(path, bpfFsPath string) (ns.NetNS, string, error) {
-	var fs unix.Statfs_t
-	err := unix.Statfs(bpfFsPath, &fs)
-	if err != nil || fs.Type != unix.BPF_FS_MAGIC {
-		return nil, "", fmt.Errorf("invalid BPF filesystem path: %s", bpfFsPath)
+	if err := checkBPFFS(bpfFsPath); err != nil {
+		return nil, "", err
 	}
 
-	ns, err := ns.GetNS(path)
-	if err != nil {
+	netns, err := ns.GetNS(path)
+	switch err.(type) {
+	case nil:
+	case ns.NSPathNotExistErr:
+		// The namespace was destroyed or its bind mount was removed, for
+		// example because the owning container exited.
+		return nil, "", fmt.Errorf("%s: %w", path, ErrNetNSGone)
+	case ns.NSPathNotNSErr:
+		return nil, "", fmt.Errorf("%s: %w", path, ErrNotNetNS)
+	default:
 		return nil, "", err
 	}
 
 	var stat unix.Stat_t
-	if err := unix.Fstat(int(ns.Fd()), &stat); err != nil {
+	if err := unix.Fstat(int(netns.Fd()), &stat); err != nil {
+		netns.Close()
 		return nil, "", fmt.Errorf("stat netns: %s", err)
 	}
 
 	dir := fmt.Sprintf("%d_dispatcher", stat.Ino)
-	return ns, filepath.Join(bpfFsPath, dir), nil
+	return netns, filepath.Join(bpfFsPath, dir), nil
+}
+
+// checkBPFFS returns an error if path isn't the root of a BPF filesystem.
+func checkBPFFS(path string) error {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return fmt.Errorf("invalid BPF filesystem path %s: %w", path, err)
+	}
+
+	if fs.Type != unix.BPF_FS_MAGIC {
+		// Docker and other container runtimes usually don't mount bpffs.
+		return fmt.Errorf("%s is not a BPF filesystem, mount one with \"mount -t bpf bpf %s\": %w", path, path, ErrNotBPFFS)
+	}
+
+	return nil
 }
 
 func linkPath(base string) string           { return filepath.Join(base, "link") }
 func programPath(base string) string        { return filepath.Join(base, "program") }
 func programUpgradePath(base string) string { return filepath.Join(base, "program-upgrade") }
+func versionPath(base string) string        { return filepath.Join(base, "version") }
+func lastUpgradePath(base string) string    { return filepath.Join(base, "last-upgrade") }
@@ -3,17 +3,51 @@ package pidfd
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/cloudflare/tubular/internal/sysconn"
 
 	"golang.org/x/sys/unix"
 )
 
+// ErrProcessMismatch is returned if a process doesn't match a ProcessPredicate.
+var ErrProcessMismatch = errors.New("process doesn't match")
+
+// ProcessPredicate is a condition on the process files are retrieved from.
+type ProcessPredicate func(pid int) (keep bool, err error)
+
+// Comm matches processes whose name in /proc/<pid>/comm is name.
+//
+// Returns an error wrapping unix.ESRCH if the process doesn't exist.
+func Comm(name string) ProcessPredicate {
+	return func(pid int) (bool, error) {
+		comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+		if errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("read comm: %w", unix.ESRCH)
+		} else if err != nil {
+			return false, err
+		}
+
+		return strings.TrimSuffix(string(comm), "\n") == name, nil
+	}
+}
+
 // Files enumerates all open files of another process.
 //
 // filter controls which files will be returned.
 func Files(pid int, ps ...sysconn.Predicate) (files []*os.File, err error) {
+	return FilesOf(pid, nil, ps...)
+}
+
+// FilesOf is like Files, except that it returns ErrProcessMismatch unless
+// the process matches all of procs.
+//
+// The process is checked after obtaining a pidfd, and must still be alive
+// after the check. This prevents returning files of an unrelated process
+// if pid is reused. Returns an error wrapping unix.ESRCH if the process exits.
+func FilesOf(pid int, procs []ProcessPredicate, ps ...sysconn.Predicate) (files []*os.File, err error) {
 	const maxFDGap = 32
 
 	defer func() {
@@ -36,6 +70,28 @@ func Files(pid int, ps ...sysconn.Predicate) (files []*os.File, err error) {
 	}
 	defer unix.Close(pidfd)
 
+	for _, proc := range procs {
+		keep, err := proc(pid)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			return nil, ErrProcessMismatch
+		}
+	}
+
+	if len(procs) > 0 {
+		// A pidfd becomes readable once the process exits.
+		fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 0)
+		if err != nil {
+			return nil, fmt.Errorf("poll pidfd: %s", err)
+		}
+		if n > 0 {
+			return nil, fmt.Errorf("process exited: %w", unix.ESRCH)
+		}
+	}
+
 	for i, gap := 0, 0; i < int(^uint(0)>>1) && gap < maxFDGap; i++ {
 		target, err := unix.PidfdGetfd(pidfd, i, 0)
 		if errors.Is(err, unix.EBADF) {
@@ -43,7 +99,7 @@ func Files(pid int, ps ...sysconn.Predicate) (files []*os.File, err error) {
 			continue
 		}
 		if err != nil {
-			return nil, fmt.Errorf("target fd %d: %s", i, err)
+			return nil, fmt.Errorf("target fd %d: %w", i, err)
 		}
 		gap = 0
 
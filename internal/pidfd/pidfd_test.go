@@ -1,9 +1,13 @@
 package pidfd
 
 import (
+	"errors"
+	"os/exec"
 	"testing"
 
 	"github.com/cloudflare/tubular/internal/testutil"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestFiles(t *testing.T) {
@@ -28,3 +32,38 @@ func TestFiles(t *testing.T) {
 		t.Errorf("Expected %d files, got %d", want, len(files))
 	}
 }
+
+func TestFilesOf(t *testing.T) {
+	child := testutil.SpawnChildWithFiles(t)
+
+	all := func(int) (bool, error) { return true, nil }
+
+	files, err := FilesOf(child, []ProcessPredicate{Comm("cat")}, all)
+	if err != nil {
+		t.Fatal("Can't get files of child process:", err)
+	}
+	for _, file := range files {
+		file.Close()
+	}
+
+	if len(files) == 0 {
+		t.Error("Expected files when comm matches")
+	}
+
+	_, err = FilesOf(child, []ProcessPredicate{Comm("dog")}, all)
+	if !errors.Is(err, ErrProcessMismatch) {
+		t.Error("Expected ErrProcessMismatch when comm doesn't match, got", err)
+	}
+}
+
+func TestCommExited(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Comm("true")(cmd.Process.Pid)
+	if !errors.Is(err, unix.ESRCH) {
+		t.Error("Expected ESRCH for an exited process, got", err)
+	}
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/cloudflare/tubular/internal/endian"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// Mirrors struct inet_diag_sockid from linux/inet_diag.h.
+type inetDiagSockID struct {
+	SPort  [2]byte
+	DPort  [2]byte
+	Src    [16]byte
+	Dst    [16]byte
+	If     uint32
+	Cookie [2]uint32
+}
+
+// Mirrors struct inet_diag_req_v2 from linux/inet_diag.h.
+type inetDiagReqV2 struct {
+	Family   uint8
+	Protocol uint8
+	Ext      uint8
+	Pad      uint8
+	States   uint32
+	ID       inetDiagSockID
+}
+
+// Mirrors struct inet_diag_msg from linux/inet_diag.h.
+type inetDiagMsg struct {
+	Family  uint8
+	State   uint8
+	Timer   uint8
+	Retrans uint8
+	ID      inetDiagSockID
+	Expires uint32
+	RQueue  uint32
+	WQueue  uint32
+	UID     uint32
+	Inode   uint32
+}
+
+const (
+	sockDiagByFamily = 20
+	tcpListen        = 10
+)
+
+// reuseportKey identifies the sockets that may share a reuseport group.
+type reuseportKey struct {
+	Protocol Protocol
+	Addr     netaddr.IPPort
+	Ifindex  uint32
+}
+
+// listeningSockets returns the key of each unconnected TCP and UDP socket in
+// the current network namespace, indexed by socket cookie.
+func listeningSockets() (map[SocketCookie]reuseportKey, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, fmt.Errorf("open sock_diag socket: %s", err)
+	}
+	defer unix.Close(fd)
+
+	sockets := make(map[SocketCookie]reuseportKey)
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		for _, req := range []inetDiagReqV2{
+			{Family: family, Protocol: unix.IPPROTO_TCP, States: 1 << tcpListen},
+			{Family: family, Protocol: unix.IPPROTO_UDP, States: ^uint32(0)},
+		} {
+			if err := dumpSockets(fd, &req, sockets); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return sockets, nil
+}
+
+func dumpSockets(fd int, req *inetDiagReqV2, sockets map[SocketCookie]reuseportKey) error {
+	var proto Protocol
+	switch req.Protocol {
+	case unix.IPPROTO_TCP:
+		proto = TCP
+	case unix.IPPROTO_UDP:
+		proto = UDP
+	}
+
+	hdr := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + binary.Size(req)),
+		Type:  sockDiagByFamily,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_DUMP,
+		Seq:   1,
+	}
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, endian.NativeEndian, &hdr)
+	_ = binary.Write(&buf, endian.NativeEndian, req)
+
+	if err := unix.Sendto(fd, buf.Bytes(), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("send sock_diag request: %s", err)
+	}
+
+	rbuf := make([]byte, 32*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, rbuf, 0)
+		if err != nil {
+			return fmt.Errorf("receive sock_diag reply: %s", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(rbuf[:n])
+		if err != nil {
+			return fmt.Errorf("parse sock_diag reply: %s", err)
+		}
+
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case unix.NLMSG_DONE:
+				return nil
+
+			case unix.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return errors.New("sock_diag: truncated error")
+				}
+				errno := -int32(endian.NativeEndian.Uint32(msg.Data))
+				return fmt.Errorf("sock_diag: %w", syscall.Errno(errno))
+			}
+
+			var diag inetDiagMsg
+			if err := binary.Read(bytes.NewReader(msg.Data), endian.NativeEndian, &diag); err != nil {
+				return fmt.Errorf("decode sock_diag message: %s", err)
+			}
+
+			if diag.ID.DPort != [2]byte{} {
+				// Connected sockets aren't part of a reuseport group.
+				continue
+			}
+
+			var ip netaddr.IP
+			if diag.Family == unix.AF_INET {
+				var v4 [4]byte
+				copy(v4[:], diag.ID.Src[:])
+				ip = netaddr.IPFrom4(v4)
+			} else {
+				ip = netaddr.IPv6Raw(diag.ID.Src)
+			}
+
+			cookie := SocketCookie(uint64(diag.ID.Cookie[0]) | uint64(diag.ID.Cookie[1])<<32)
+			sockets[cookie] = reuseportKey{
+				proto,
+				netaddr.IPPortFrom(ip, binary.BigEndian.Uint16(diag.ID.SPort[:])),
+				diag.ID.If,
+			}
+		}
+	}
+}
+
+// doInNetNS invokes fn in the network namespace at path.
+//
+// Avoids switching namespaces if the calling thread is already in it, which
+// requires no privileges.
+func doInNetNS(path string, fn func() error) error {
+	var have, want unix.Stat_t
+	if err := unix.Stat(path, &want); err != nil {
+		return fmt.Errorf("stat netns: %s", err)
+	}
+
+	runtime.LockOSThread()
+	err := unix.Stat("/proc/thread-self/ns/net", &have)
+	if err == nil && have.Dev == want.Dev && have.Ino == want.Ino {
+		defer runtime.UnlockOSThread()
+		return fn()
+	}
+	runtime.UnlockOSThread()
+
+	if err != nil {
+		return fmt.Errorf("stat current netns: %s", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, which makes the runtime discard it
+		// once the goroutine exits instead of reusing it in the wrong
+		// namespace.
+		runtime.LockOSThread()
+
+		netns, err := os.Open(path)
+		if err != nil {
+			errs <- fmt.Errorf("open netns: %s", err)
+			return
+		}
+		defer netns.Close()
+
+		if err := unix.Setns(int(netns.Fd()), unix.CLONE_NEWNET); err != nil {
+			errs <- fmt.Errorf("setns: %w", err)
+			return
+		}
+
+		errs <- fn()
+	}()
+
+	return <-errs
+}
@@ -3,7 +3,9 @@ package sysconn
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 	"inet.af/netaddr"
@@ -39,68 +41,137 @@ func FilterConn(conn syscall.Conn, ps ...Predicate) (keep bool, err error) {
 //
 // Returns a list of conns for which all predicates returned true.
 func Filter(conns []syscall.Conn, ps ...Predicate) ([]syscall.Conn, error) {
-	var result []syscall.Conn
+	kept, _, err := Partition(conns, ps...)
+	return kept, err
+}
+
+// Partition is like Filter, except that it also returns the conns for which
+// at least one predicate returned false.
+func Partition(conns []syscall.Conn, ps ...Predicate) (kept, dropped []syscall.Conn, err error) {
 	for _, conn := range conns {
 		keep, err := FilterConn(conn, ps...)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if keep {
-			result = append(result, conn)
+			kept = append(kept, conn)
+		} else {
+			dropped = append(dropped, conn)
 		}
 	}
-	return result, nil
+	return kept, dropped, nil
 }
 
 // FirstReuseport filters out all but the first socket of a reuseport group.
 //
 // Non-reuseport sockets and non-sockets are ignored.
 func FirstReuseport() Predicate {
-	type key struct {
-		proto int
-		ip    netaddr.IP
-		port  uint16
-	}
-
-	seen := make(map[key]bool)
+	seen := make(map[reuseportKey]bool)
 	return func(fd int) (bool, error) {
-		reuseport, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT)
-		if err != nil {
-			return false, fmt.Errorf("getsockopt(SO_REUSEPORT): %w", err)
-		}
-		if reuseport != 1 {
-			return true, nil
+		k, ok, err := reuseportGroup(fd)
+		if err != nil || !ok {
+			return !ok, err
 		}
 
-		proto, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PROTOCOL)
-		if err != nil {
-			return false, fmt.Errorf("getsockopt(SO_PROTOCOL): %w", err)
+		if seen[k] {
+			return false, nil
 		}
 
-		sa, err := unix.Getsockname(fd)
+		seen[k] = true
+		return true, nil
+	}
+}
+
+// ReuseportBy is like FirstReuseport, except that it keeps the socket of
+// each reuseport group with the lowest value returned by selector. Negate the
+// value to prefer the highest one instead. Ties are broken in favour of the
+// socket which comes first.
+//
+// All conns are examined before choosing, so exactly one socket per group
+// is returned. Non-reuseport sockets are always returned.
+func ReuseportBy(conns []syscall.Conn, selector func(fd int) (int, error)) ([]syscall.Conn, error) {
+	type candidate struct {
+		index int
+		value int
+	}
+
+	groups := make([]*reuseportKey, len(conns))
+	best := make(map[reuseportKey]candidate)
+	for i, conn := range conns {
+		err := Control(conn, func(fd int) error {
+			k, ok, err := reuseportGroup(fd)
+			if err != nil || !ok {
+				return err
+			}
+
+			value, err := selector(fd)
+			if err != nil {
+				return fmt.Errorf("select reuseport socket: %w", err)
+			}
+
+			groups[i] = &k
+			if prev, ok := best[k]; !ok || value < prev.value {
+				best[k] = candidate{i, value}
+			}
+			return nil
+		})
 		if err != nil {
-			return false, fmt.Errorf("getsockname: %w", err)
+			return nil, err
 		}
+	}
 
-		k := key{proto: proto}
-		switch addr := sa.(type) {
-		case *unix.SockaddrInet4:
-			k.ip, _ = netaddr.FromStdIP(addr.Addr[:])
-			k.port = uint16(addr.Port)
-		case *unix.SockaddrInet6:
-			k.ip = netaddr.IPv6Raw(addr.Addr)
-			k.port = uint16(addr.Port)
-		default:
-			return false, fmt.Errorf("unsupported address family: %T", sa)
+	var kept []syscall.Conn
+	for i, conn := range conns {
+		if k := groups[i]; k == nil || best[*k].index == i {
+			kept = append(kept, conn)
 		}
+	}
 
-		if seen[k] {
-			return false, nil
-		}
+	return kept, nil
+}
 
-		seen[k] = true
-		return true, nil
+// reuseportKey identifies the sockets which may be part of the same reuseport
+// group.
+type reuseportKey struct {
+	proto int
+	ip    netaddr.IP
+	port  uint16
+}
+
+// reuseportGroup returns the group of a socket, or false if it doesn't have
+// SO_REUSEPORT set.
+func reuseportGroup(fd int) (reuseportKey, bool, error) {
+	reuseport, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT)
+	if err != nil {
+		return reuseportKey{}, false, fmt.Errorf("getsockopt(SO_REUSEPORT): %w", err)
+	}
+	if reuseport != 1 {
+		return reuseportKey{}, false, nil
+	}
+
+	proto, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PROTOCOL)
+	if err != nil {
+		return reuseportKey{}, false, fmt.Errorf("getsockopt(SO_PROTOCOL): %w", err)
+	}
+
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return reuseportKey{}, false, fmt.Errorf("getsockname: %w", err)
+	}
+
+	k := reuseportKey{proto: proto}
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		k.ip, _ = netaddr.FromStdIP(addr.Addr[:])
+		k.port = uint16(addr.Port)
+	case *unix.SockaddrInet6:
+		k.ip = netaddr.IPv6Raw(addr.Addr)
+		k.port = uint16(addr.Port)
+	default:
+		return reuseportKey{}, false, fmt.Errorf("unsupported address family: %T", sa)
 	}
+
+	return k, true, nil
 }
 
 // IgnoreENOTSOCK wraps a predicate and returns false instead of unix.ENOTSOCK.
@@ -179,6 +250,8 @@ func InetListener(network string) Predicate {
 }
 
 // LocalAddress filters for sockets with the given address and port.
+//
+// The zero IP matches any address, and port 0 matches any port.
 func LocalAddress(ip netaddr.IP, port int) Predicate {
 	return func(fd int) (bool, error) {
 		sa, err := unix.Getsockname(fd)
@@ -201,14 +274,46 @@ func LocalAddress(ip netaddr.IP, port int) Predicate {
 			return false, nil
 		}
 
-		if fdIP.Compare(ip) != 0 {
+		if !ip.IsZero() && fdIP.Compare(ip) != 0 {
 			return false, nil
 		}
 
-		if fdPort != port {
+		if port != 0 && fdPort != port {
 			return false, nil
 		}
 
 		return true, nil
 	}
 }
+
+// BoundToDevice filters for sockets bound to the given network interface
+// using SO_BINDTODEVICE.
+//
+// An empty ifname matches sockets which aren't bound to an interface.
+func BoundToDevice(ifname string) Predicate {
+	return func(fd int) (bool, error) {
+		device, err := boundDevice(fd)
+		if err != nil {
+			return false, fmt.Errorf("getsockopt(SO_BINDTODEVICE): %w", err)
+		}
+
+		return device == ifname, nil
+	}
+}
+
+// boundDevice returns the name of the interface a socket is bound to.
+//
+// unix.GetsockoptString can't be used since it panics if the socket isn't
+// bound and the kernel returns an empty value.
+func boundDevice(fd int) (string, error) {
+	buf := make([]byte, unix.IFNAMSIZ)
+	vallen := uint32(len(buf))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT,
+		uintptr(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&vallen)), 0)
+	if errno != 0 {
+		return "", errno
+	}
+
+	return strings.TrimRight(string(buf[:vallen]), "\x00"), nil
+}
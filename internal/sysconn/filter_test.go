@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
 	"syscall"
 	"testing"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/cloudflare/tubular/internal/testutil"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
 	"inet.af/netaddr"
 )
 
@@ -53,6 +55,59 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+func TestPartition(t *testing.T) {
+	conns := testutil.ReuseportGroup(t, testutil.CurrentNetNS(t), "udp4", 4)
+
+	var keep bool
+	tests := []struct {
+		name    string
+		p       sysconn.Predicate
+		kept    []syscall.Conn
+		dropped []syscall.Conn
+	}{
+		{"all", func(_ int) (bool, error) { return true, nil }, conns, nil},
+		{"none", func(_ int) (bool, error) { return false, nil }, nil, conns},
+		{"even", func(_ int) (bool, error) {
+			keep = !keep
+			return keep, nil
+		}, []syscall.Conn{
+			conns[0],
+			conns[2],
+		}, []syscall.Conn{
+			conns[1],
+			conns[3],
+		}},
+	}
+
+	comparer := cmp.Comparer(func(x, y *net.UDPConn) bool {
+		return x == y
+	})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kept, dropped, err := sysconn.Partition(conns, test.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(test.kept, kept, comparer); diff != "" {
+				t.Errorf("kept conns don't match (+y -x):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(test.dropped, dropped, comparer); diff != "" {
+				t.Errorf("dropped conns don't match (+y -x):\n%s", diff)
+			}
+		})
+	}
+
+	_, _, err := sysconn.Partition(conns, func(_ int) (bool, error) {
+		return false, errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("Partition doesn't return error")
+	}
+}
+
 func TestFilterError(t *testing.T) {
 	conns := testutil.ReuseportGroup(t, testutil.CurrentNetNS(t), "udp4", 1)
 	result, err := sysconn.Filter(conns, func(_ int) (bool, error) {
@@ -96,6 +151,66 @@ func TestFirstReuseport(t *testing.T) {
 	}
 }
 
+func TestReuseportBy(t *testing.T) {
+	netns := testutil.CurrentNetNS(t)
+
+	for _, network := range []string{"udp4", "tcp6"} {
+		conns := testutil.ReuseportGroup(t, netns, network, 3)
+
+		// Prefer the second socket, then the third, then the first.
+		rank := make(map[uint64]int)
+		for i, value := range []int{2, 0, 1} {
+			rank[mustSocketCookie(t, conns[i])] = value
+		}
+
+		// A socket outside of the group is always kept.
+		other := testutil.ReuseportGroup(t, netns, network, 1)[0]
+		conns = append(conns, other)
+
+		kept, err := sysconn.ReuseportBy(conns, func(fd int) (int, error) {
+			cookie, err := unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
+			return rank[cookie], err
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", network, err)
+		}
+
+		var keptIndices []int
+		for _, conn := range kept {
+			for i := range conns {
+				if conns[i] == conn {
+					keptIndices = append(keptIndices, i)
+				}
+			}
+		}
+
+		if diff := cmp.Diff([]int{1, 3}, keptIndices); diff != "" {
+			t.Errorf("%s: kept sockets don't match (-want +got):\n%s", network, diff)
+		}
+	}
+
+	conns := testutil.ReuseportGroup(t, netns, "udp4", 1)
+	_, err := sysconn.ReuseportBy(conns, func(int) (int, error) {
+		return 0, errors.New("failed")
+	})
+	if err == nil {
+		t.Error("ReuseportBy doesn't return selector errors")
+	}
+}
+
+func mustSocketCookie(tb testing.TB, conn syscall.Conn) (cookie uint64) {
+	tb.Helper()
+
+	err := sysconn.Control(conn, func(fd int) (err error) {
+		cookie, err = unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
+		return
+	})
+	if err != nil {
+		tb.Fatal("Can't get socket cookie:", err)
+	}
+	return
+}
+
 func TestLocalAddress(t *testing.T) {
 	type test struct {
 		name string
@@ -125,6 +240,18 @@ func TestLocalAddress(t *testing.T) {
 				conn,
 				false,
 			},
+			test{
+				fmt.Sprint(network, " any ip"),
+				sysconn.LocalAddress(netaddr.IP{}, port),
+				conn,
+				true,
+			},
+			test{
+				fmt.Sprint(network, " any port"),
+				sysconn.LocalAddress(ip, 0),
+				conn,
+				true,
+			},
 		)
 	}
 
@@ -277,3 +404,53 @@ func TestListeningSocket(t *testing.T) {
 		})
 	}
 }
+
+func TestBoundToDevice(t *testing.T) {
+	unbound := testutil.Listen(t, testutil.CurrentNetNS(t), "udp4", "")
+	bound := testutil.Listen(t, testutil.CurrentNetNS(t), "udp4", "")
+
+	err := sysconn.Control(bound, func(fd int) error {
+		return unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, "lo")
+	})
+	if err != nil {
+		t.Fatal("Can't bind to device:", err)
+	}
+
+	type test struct {
+		name string
+		p    sysconn.Predicate
+		conn syscall.Conn
+		keep bool
+	}
+
+	var tests = []test{
+		{"bound", sysconn.BoundToDevice("lo"), bound, true},
+		{"bound to other device", sysconn.BoundToDevice("eth0"), bound, false},
+		{"bound to no device", sysconn.BoundToDevice(""), bound, false},
+		{"unbound", sysconn.BoundToDevice("lo"), unbound, false},
+		{"unbound to no device", sysconn.BoundToDevice(""), unbound, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keep, err := sysconn.FilterConn(test.conn, test.p)
+			if err != nil {
+				t.Fatal("Predicate returned an error:", err)
+			}
+			if keep != test.keep {
+				t.Fatalf("Predicate didn't match, want %t got %t", test.keep, keep)
+			}
+		})
+	}
+
+	file, err := ioutil.TempFile("", "tubular")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := sysconn.FilterConn(file, sysconn.BoundToDevice("lo")); !errors.Is(err, unix.ENOTSOCK) {
+		t.Error("Expected ENOTSOCK for a file, got", err)
+	}
+}
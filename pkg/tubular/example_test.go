@@ -0,0 +1,70 @@
+package tubular_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/cloudflare/tubular/pkg/tubular"
+)
+
+// This example steers traffic for 127.0.0.0/8 port 1234 to a TCP listener,
+// like the example service does with tubectl.
+func Example() {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+	defer ln.Close()
+
+	// The dispatcher is usually loaded once per network namespace by the
+	// operator, using tubectl load.
+	dp, err := tubular.Open("/proc/self/ns/net", "/sys/fs/bpf", false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+
+	bind, err := tubular.NewBinding("example", tubular.TCP, "127.0.0.0/8", 1234)
+	if err != nil {
+		dp.Close()
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+
+	if _, err := dp.AddBinding(bind); err != nil {
+		dp.Close()
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+
+	dest, _, err := dp.RegisterSocket("example", ln)
+	// Close the dispatcher right away so that others can make changes.
+	dp.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+
+	fmt.Println("registered", dest)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			fmt.Fprintln(conn, "hi from", conn.LocalAddr())
+			conn.Close()
+		}
+	}()
+
+	<-ctx.Done()
+}
@@ -0,0 +1,187 @@
+// Package tubular manages the tubular socket dispatcher from Go.
+//
+// The dispatcher steers traffic for a binding, which is a combination of
+// protocol, prefix and port, to the socket registered under the label of the
+// binding. This package offers the same operations as tubectl, so that
+// services can manage their own dispatch without executing it.
+package tubular
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/cloudflare/tubular/internal"
+)
+
+type (
+	// Binding redirects traffic for a protocol, prefix and port to a label.
+	Binding = internal.Binding
+	// Bindings is a list of bindings.
+	Bindings = internal.Bindings
+	// Destination is the combination of label, domain and protocol which
+	// a socket is registered for.
+	Destination = internal.Destination
+	// Protocol is an L4 protocol.
+	Protocol = internal.Protocol
+	// Domain is an L3 protocol.
+	Domain = internal.Domain
+	// SocketCookie uniquely identifies a socket.
+	SocketCookie = internal.SocketCookie
+	// ReuseportConflict is a reuseport group registered under more than one
+	// label.
+	ReuseportConflict = internal.ReuseportConflict
+)
+
+// Supported protocols and domains.
+const (
+	TCP = internal.TCP
+	UDP = internal.UDP
+
+	AF_INET  = internal.AF_INET
+	AF_INET6 = internal.AF_INET6
+)
+
+// Errors returned by this package.
+var (
+	ErrLoaded           = internal.ErrLoaded
+	ErrNotLoaded        = internal.ErrNotLoaded
+	ErrNetNSGone        = internal.ErrNetNSGone
+	ErrNotNetNS         = internal.ErrNotNetNS
+	ErrLocked           = internal.ErrLocked
+	ErrNoDestinationIDs = internal.ErrNoDestinationIDs
+	// ErrMissingKernelFeature is returned when loading the dispatcher on
+	// a kernel which is too old.
+	ErrMissingKernelFeature = internal.ErrMissingKernelFeature
+)
+
+// NewBinding creates a new binding.
+//
+// prefix may either be an IP address or a prefix in CIDR notation. A port of
+// zero matches all ports.
+func NewBinding(label string, proto Protocol, prefix string, port uint16) (*Binding, error) {
+	return internal.NewBinding(label, proto, prefix, port)
+}
+
+// Dispatcher is a handle to the dispatcher of a network namespace.
+//
+// Only one writable Dispatcher may be open for a network namespace at a time.
+// Close it as soon as possible to allow other users, for example tubectl,
+// to make changes.
+type Dispatcher struct {
+	dp *internal.Dispatcher
+}
+
+// Load the dispatcher into a network namespace and store its state in a BPF
+// file system.
+//
+// Returns ErrLoaded if the dispatcher is already loaded.
+func Load(netnsPath, bpfFsPath string) (*Dispatcher, error) {
+	dp, err := internal.CreateDispatcher(netnsPath, bpfFsPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Dispatcher{dp}, nil
+}
+
+// Open the dispatcher of a network namespace.
+//
+// Blocks until other writers have closed the dispatcher. Returns
+// ErrNotLoaded if the dispatcher isn't loaded.
+func Open(netnsPath, bpfFsPath string, readOnly bool) (*Dispatcher, error) {
+	dp, err := internal.OpenDispatcher(netnsPath, bpfFsPath, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &Dispatcher{dp}, nil
+}
+
+// Unload the dispatcher from a network namespace, removing all state.
+//
+// Returns ErrNotLoaded if the dispatcher isn't loaded.
+func Unload(netnsPath, bpfFsPath string) error {
+	return internal.UnloadDispatcher(netnsPath, bpfFsPath)
+}
+
+// Close the dispatcher. Bindings and sockets remain active.
+func (d *Dispatcher) Close() error {
+	return d.dp.Close()
+}
+
+// AddBinding redirects traffic for a binding to its label.
+//
+// Returns the binding that was replaced, or nil if there was none.
+func (d *Dispatcher) AddBinding(bind *Binding) (replaced *Binding, err error) {
+	return d.dp.AddBinding(bind)
+}
+
+// RemoveBinding stops redirecting traffic for a binding.
+func (d *Dispatcher) RemoveBinding(bind *Binding) error {
+	return d.dp.RemoveBinding(bind)
+}
+
+// ReplaceBindings changes the active bindings to a new set.
+//
+// Changes aren't applied atomically. If a change fails, the ones already made
+// are undone on a best-effort basis, and the changes that remain applied are
+// returned with the error.
+func (d *Dispatcher) ReplaceBindings(bindings Bindings) (added, removed Bindings, err error) {
+	return d.dp.ReplaceBindings(bindings)
+}
+
+// ReplaceBindingsContext is like ReplaceBindings, but stops making changes
+// once ctx is cancelled.
+//
+// Returns the changes that were applied before the cancellation.
+func (d *Dispatcher) ReplaceBindingsContext(ctx context.Context, bindings Bindings) (added, removed Bindings, err error) {
+	return d.dp.ReplaceBindingsContext(ctx, bindings)
+}
+
+// Bindings returns the active bindings.
+func (d *Dispatcher) Bindings() (Bindings, error) {
+	return d.dp.Bindings()
+}
+
+// OverlappingBindings returns active bindings for the same protocol and port
+// as bind whose prefix overlaps with it.
+func (d *Dispatcher) OverlappingBindings(bind *Binding) (Bindings, error) {
+	return d.dp.OverlappingBindings(bind)
+}
+
+// RegisterSocket steers traffic for all bindings with the given label to a
+// listening TCP or an unconnected UDP socket.
+//
+// An existing socket for the same label, domain and protocol is replaced
+// without dropping traffic. Returns the destination of the socket and
+// whether it was created.
+func (d *Dispatcher) RegisterSocket(label string, conn syscall.Conn) (dest *Destination, created bool, err error) {
+	return d.dp.RegisterSocket(label, conn)
+}
+
+// UnregisterSocket removes the socket registered for a destination.
+func (d *Dispatcher) UnregisterSocket(label string, domain Domain, proto Protocol) error {
+	return d.dp.UnregisterSocket(label, domain, proto)
+}
+
+// RemoveSocket is like UnregisterSocket, but takes a Destination.
+func (d *Dispatcher) RemoveSocket(dest *Destination) error {
+	return d.dp.RemoveSocket(dest)
+}
+
+// Destinations returns all destinations and the cookies of their sockets.
+//
+// The cookie is zero if a destination has no socket.
+func (d *Dispatcher) Destinations() ([]Destination, map[Destination]SocketCookie, error) {
+	return d.dp.Destinations()
+}
+
+// VerifySockets returns destinations which have bindings but no live socket,
+// for example because the socket was closed.
+func (d *Dispatcher) VerifySockets() ([]Destination, error) {
+	return d.dp.VerifySockets()
+}
+
+// CheckReuseportConsistency returns reuseport groups whose sockets are
+// registered under more than one label.
+func (d *Dispatcher) CheckReuseportConsistency() ([]ReuseportConflict, error) {
+	return d.dp.CheckReuseportConsistency()
+}
@@ -0,0 +1,82 @@
+package tubular
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/testutil"
+)
+
+func init() {
+	testutil.EnterUnprivilegedMode()
+}
+
+func TestDispatcher(t *testing.T) {
+	netns := testutil.NewNetNS(t, "1.2.3.0/24")
+
+	var dp *Dispatcher
+	err := testutil.WithCapabilities(func() (err error) {
+		dp, err = Load(netns.Path(), "/sys/fs/bpf")
+		return
+	}, internal.CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Can't load dispatcher:", err)
+	}
+	t.Cleanup(func() { Unload(netns.Path(), "/sys/fs/bpf") })
+	dp.Close()
+
+	err = testutil.WithCapabilities(func() error {
+		_, err := Load(netns.Path(), "/sys/fs/bpf")
+		return err
+	}, internal.CreateCapabilities...)
+	if !errors.Is(err, ErrLoaded) {
+		t.Fatal("Loading twice doesn't return ErrLoaded:", err)
+	}
+
+	dp, err = Open(netns.Path(), "/sys/fs/bpf", false)
+	if err != nil {
+		t.Fatal("Can't open dispatcher:", err)
+	}
+	defer dp.Close()
+
+	bind, err := NewBinding("foo", TCP, "1.2.3.0/24", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dp.AddBinding(bind); err != nil {
+		t.Fatal("Can't add binding:", err)
+	}
+
+	ln := testutil.ListenAndEchoWithName(t, netns, "tcp4", "127.0.0.1:0", "foo")
+	dest, created, err := dp.RegisterSocket("foo", ln)
+	if err != nil {
+		t.Fatal("Can't register socket:", err)
+	}
+	if !created {
+		t.Error("Destination wasn't created")
+	}
+
+	testutil.CanDialName(t, netns, "tcp4", "1.2.3.4:80", "foo")
+
+	if err := dp.UnregisterSocket(dest.Label, dest.Domain, dest.Protocol); err != nil {
+		t.Fatal("Can't unregister socket:", err)
+	}
+
+	if testutil.CanDial(t, netns, "tcp4", "1.2.3.4:80") {
+		t.Error("Traffic is steered to unregistered socket")
+	}
+
+	if err := dp.RemoveBinding(bind); err != nil {
+		t.Fatal("Can't remove binding:", err)
+	}
+
+	bindings, err := dp.Bindings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 0 {
+		t.Error("Bindings aren't empty:", bindings)
+	}
+}